@@ -0,0 +1,5 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS last_login_ip,
+    DROP COLUMN IF EXISTS last_login_at,
+    DROP COLUMN IF EXISTS orgs,
+    DROP COLUMN IF EXISTS role;
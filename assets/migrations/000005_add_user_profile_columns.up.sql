@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'analyst' CHECK (role IN ('admin', 'analyst')),
+    ADD COLUMN orgs TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN last_login_at TIMESTAMPTZ,
+    ADD COLUMN last_login_ip TEXT;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_audit_events_actor_id;
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+DROP FUNCTION IF EXISTS prevent_audit_event_modification();
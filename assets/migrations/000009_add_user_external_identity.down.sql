@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_users_external_identity;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS external_subject,
+    DROP COLUMN IF EXISTS auth_provider;
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN auth_provider TEXT NOT NULL DEFAULT 'local',
+    ADD COLUMN external_subject TEXT;
+
+CREATE UNIQUE INDEX idx_users_external_identity ON users(auth_provider, external_subject)
+    WHERE external_subject IS NOT NULL;
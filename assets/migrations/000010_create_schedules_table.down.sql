@@ -0,0 +1,4 @@
+ALTER TABLE results
+    DROP COLUMN IF EXISTS input_path;
+
+DROP TABLE IF EXISTS schedules;
@@ -0,0 +1,25 @@
+CREATE TABLE schedules (
+    id SERIAL PRIMARY KEY,
+    org_name VARCHAR(512) NOT NULL,
+    simulation_id VARCHAR(255) NOT NULL,
+    cron_spec TEXT NOT NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    last_fired_at TIMESTAMPTZ,
+    next_fire_at TIMESTAMPTZ,
+    last_input_etag TEXT,
+    last_result_id INTEGER REFERENCES results(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_schedules_updated_at
+    BEFORE UPDATE ON schedules
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+CREATE INDEX idx_schedules_org_name ON schedules(org_name);
+
+-- Scheduled results read their schedule's input but write their reports under
+-- their own path.
+ALTER TABLE results
+    ADD COLUMN input_path TEXT;
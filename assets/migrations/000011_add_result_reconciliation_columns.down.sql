@@ -0,0 +1,7 @@
+ALTER TABLE results
+    ALTER COLUMN task_id DROP NOT NULL,
+    ALTER COLUMN task_id DROP DEFAULT;
+
+ALTER TABLE results
+    DROP COLUMN IF EXISTS sla_exceeded_at,
+    DROP COLUMN IF EXISTS s3_bucket_path;
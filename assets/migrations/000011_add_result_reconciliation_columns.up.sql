@@ -0,0 +1,11 @@
+ALTER TABLE results
+    ADD COLUMN s3_bucket_path TEXT,
+    ADD COLUMN sla_exceeded_at TIMESTAMPTZ;
+
+-- A result whose task was never enqueued has no task ID, which has to be
+-- readable for the reconciler to find it.
+UPDATE results SET task_id = '' WHERE task_id IS NULL;
+
+ALTER TABLE results
+    ALTER COLUMN task_id SET DEFAULT '',
+    ALTER COLUMN task_id SET NOT NULL;
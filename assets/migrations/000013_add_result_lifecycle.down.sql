@@ -0,0 +1,18 @@
+DROP TABLE IF EXISTS result_status_history;
+
+ALTER TABLE results DROP CONSTRAINT results_status_check;
+
+UPDATE results SET status = CASE status
+    WHEN 'queued' THEN 'pending'
+    WHEN 'running' THEN 'processing'
+    WHEN 'retrying' THEN 'processing'
+    WHEN 'succeeded' THEN 'success'
+    WHEN 'cancelled' THEN 'failed'
+    WHEN 'expired' THEN 'failed'
+    ELSE status
+END;
+
+ALTER TABLE results
+    ALTER COLUMN status SET DEFAULT 'pending',
+    ADD CONSTRAINT results_status_check
+        CHECK (status IN ('pending', 'processing', 'failed', 'success'));
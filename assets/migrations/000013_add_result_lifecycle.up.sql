@@ -0,0 +1,29 @@
+ALTER TABLE results DROP CONSTRAINT results_status_check;
+
+UPDATE results SET status = CASE status
+    WHEN 'pending' THEN 'queued'
+    WHEN 'processing' THEN 'running'
+    WHEN 'success' THEN 'succeeded'
+    ELSE status
+END;
+
+ALTER TABLE results
+    ALTER COLUMN status SET DEFAULT 'queued',
+    ADD CONSTRAINT results_status_check
+        CHECK (status IN ('queued', 'running', 'retrying', 'succeeded', 'failed', 'cancelled', 'expired'));
+
+CREATE TABLE result_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    result_id INTEGER NOT NULL REFERENCES results(id) ON DELETE CASCADE,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_result_status_history_result_id ON result_status_history(result_id, id);
+
+-- Existing results start their history in whatever state they are in now.
+INSERT INTO result_status_history (result_id, from_status, to_status, actor, reason, created_at)
+SELECT id, NULL, status, 'system', 'history started', updated_at FROM results;
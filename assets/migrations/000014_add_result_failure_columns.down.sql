@@ -0,0 +1,4 @@
+ALTER TABLE results
+    DROP COLUMN IF EXISTS error_message,
+    DROP COLUMN IF EXISTS error_step,
+    DROP COLUMN IF EXISTS error_code;
@@ -0,0 +1,4 @@
+ALTER TABLE results
+    ADD COLUMN error_code TEXT,
+    ADD COLUMN error_step TEXT,
+    ADD COLUMN error_message TEXT;
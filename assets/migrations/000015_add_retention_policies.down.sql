@@ -0,0 +1,9 @@
+ALTER TABLE results
+    DROP COLUMN IF EXISTS purge_last_error,
+    DROP COLUMN IF EXISTS purge_retry_at,
+    DROP COLUMN IF EXISTS purge_attempts,
+    DROP COLUMN IF EXISTS report_purged_at,
+    DROP COLUMN IF EXISTS input_purged_at,
+    DROP COLUMN IF EXISTS legal_hold;
+
+DROP TABLE IF EXISTS retention_policies;
@@ -0,0 +1,22 @@
+CREATE TABLE retention_policies (
+    org_name VARCHAR(512) PRIMARY KEY,
+    input_retention_days INTEGER CHECK (input_retention_days >= 0),
+    report_retention_days INTEGER CHECK (report_retention_days >= 0),
+    legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_retention_policies_updated_at
+    BEFORE UPDATE ON retention_policies
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+ALTER TABLE results
+    ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN input_purged_at TIMESTAMPTZ,
+    ADD COLUMN report_purged_at TIMESTAMPTZ,
+    ADD COLUMN purge_attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN purge_retry_at TIMESTAMPTZ,
+    ADD COLUMN purge_last_error TEXT;
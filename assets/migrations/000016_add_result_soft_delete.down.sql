@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_results_deleted_at;
+
+ALTER TABLE results
+    DROP COLUMN IF EXISTS deleted_by,
+    DROP COLUMN IF EXISTS deleted_at;
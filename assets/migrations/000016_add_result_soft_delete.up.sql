@@ -0,0 +1,5 @@
+ALTER TABLE results
+    ADD COLUMN deleted_at TIMESTAMPTZ,
+    ADD COLUMN deleted_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_results_deleted_at ON results(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE results
+    DROP COLUMN IF EXISTS analysis_options;
+
+DROP TABLE IF EXISTS analysis_defaults;
@@ -0,0 +1,15 @@
+CREATE TABLE analysis_defaults (
+    org_name VARCHAR(512) PRIMARY KEY,
+    options JSONB NOT NULL DEFAULT '{}',
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_analysis_defaults_updated_at
+    BEFORE UPDATE ON analysis_defaults
+    FOR EACH ROW
+    EXECUTE FUNCTION update_updated_at_column();
+
+ALTER TABLE results
+    ADD COLUMN analysis_options JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_results_org_evolution;
+
+ALTER TABLE results
+    DROP COLUMN IF EXISTS evolution_data_path;
@@ -0,0 +1,4 @@
+ALTER TABLE results
+    ADD COLUMN evolution_data_path TEXT;
+
+CREATE INDEX idx_results_org_evolution ON results(org_name, id) WHERE evolution_data_path IS NOT NULL;
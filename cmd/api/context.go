@@ -5,12 +5,14 @@ import (
 	"net/http"
 
 	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/logging"
 )
 
 type contextKey string
 
 const (
 	authenticatedUserContextKey = contextKey("authenticatedUser")
+	requestIDContextKey         = contextKey("requestID")
 )
 
 func contextSetAuthenticatedUser(r *http.Request, user database.User) *http.Request {
@@ -22,3 +24,14 @@ func contextGetAuthenticatedUser(r *http.Request) (database.User, bool) {
 	user, ok := r.Context().Value(authenticatedUserContextKey).(database.User)
 	return user, ok
 }
+
+func contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+	ctx = logging.With(ctx, "request_id", requestID)
+	return r.WithContext(ctx)
+}
+
+func contextGetRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDContextKey).(string)
+	return requestID
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"com.activehacks.ad-miner-backend/internal/response"
 	"com.activehacks.ad-miner-backend/internal/validator"
@@ -20,13 +23,21 @@ func (app *application) reportServerError(r *http.Request, err error) {
 	)
 
 	requestAttrs := slog.Group("request", "method", method, "url", url)
-	app.logger.Error(message, requestAttrs, "trace", trace)
+	app.logger.ErrorContext(r.Context(), message, requestAttrs, "trace", trace)
 }
 
 func (app *application) errorMessage(w http.ResponseWriter, r *http.Request, status int, message string, headers http.Header) {
 	message = strings.ToUpper(message[:1]) + message[1:]
 
-	err := response.JSONWithHeaders(w, status, map[string]string{"Error": message}, headers)
+	data := map[string]string{"Error": message}
+
+	// The request ID lets a user quote an error back to us so it can be
+	// found in the logs.
+	if requestID := contextGetRequestID(r); requestID != "" {
+		data["RequestID"] = requestID
+	}
+
+	err := response.JSONWithHeaders(w, status, data, headers)
 	if err != nil {
 		app.reportServerError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -71,3 +82,28 @@ func (app *application) invalidAuthenticationToken(w http.ResponseWriter, r *htt
 func (app *application) authenticationRequired(w http.ResponseWriter, r *http.Request) {
 	app.errorMessage(w, r, http.StatusUnauthorized, "You must be authenticated to access this resource", nil)
 }
+
+func (app *application) notPermitted(w http.ResponseWriter, r *http.Request) {
+	message := "Your user account doesn't have the necessary permissions to access this resource"
+	app.errorMessage(w, r, http.StatusForbidden, message, nil)
+}
+
+func (app *application) conflict(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorMessage(w, r, http.StatusConflict, message, nil)
+}
+
+func (app *application) passwordLoginDisabled(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusForbidden, "Password login is disabled for this deployment", nil)
+}
+
+func (app *application) invalidCredentials(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusUnauthorized, "Invalid credentials", nil)
+}
+
+func (app *application) tooManyLoginAttempts(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	headers := make(http.Header)
+	headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "Too many failed login attempts, please try again later"
+	app.errorMessage(w, r, http.StatusTooManyRequests, message, headers)
+}
@@ -1,23 +1,33 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"com.activehacks.ad-miner-backend/internal/analysis"
 	"com.activehacks.ad-miner-backend/internal/database"
 	"com.activehacks.ad-miner-backend/internal/env"
+	"com.activehacks.ad-miner-backend/internal/health"
+	"com.activehacks.ad-miner-backend/internal/mfa"
 	"com.activehacks.ad-miner-backend/internal/password"
 	"com.activehacks.ad-miner-backend/internal/queue"
 	"com.activehacks.ad-miner-backend/internal/request"
 	"com.activehacks.ad-miner-backend/internal/response"
+	"com.activehacks.ad-miner-backend/internal/sso"
 	"com.activehacks.ad-miner-backend/internal/validator"
 	"com.activehacks.ad-miner-backend/internal/version"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/pascaldekloe/jwt"
+	"github.com/google/uuid"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +42,60 @@ func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// healthzHandler is the liveness probe. It only confirms that the process is
+// serving requests; dependencies are covered by readyzHandler.
+func (app *application) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	err := response.JSON(w, http.StatusOK, map[string]string{"Status": health.StatusOK})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// readyzHandler is the readiness probe. It only says whether each dependency
+// check passed and answers 503 if any that gates readiness failed; error
+// details and latencies go to the log so they aren't exposed to
+// unauthenticated callers.
+func (app *application) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := app.health.Run(r.Context())
+
+	checks := make(map[string]string, len(report.Checks))
+	for _, check := range report.Checks {
+		checks[check.Name] = check.Status
+
+		if check.Status != health.StatusOK {
+			app.logger.WarnContext(r.Context(), "readiness check failed", "check", check.Name, "latency_ms", check.LatencyMS, "error", check.Error)
+		}
+	}
+
+	status := http.StatusOK
+	if !report.Healthy() {
+		status = http.StatusServiceUnavailable
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	data := map[string]any{
+		"Status": report.Status,
+		"Checks": checks,
+	}
+
+	err := response.JSONWithHeaders(w, status, data, headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	err := response.JSONWithHeaders(w, http.StatusOK, app.keys.JWKS(), headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
 func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email     string              `json:"Email"`
@@ -45,7 +109,7 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	_, found, err := app.db.GetUserByEmail(input.Email)
+	_, found, err := app.db.GetUserByEmail(r.Context(), input.Email)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -71,7 +135,7 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	_, err = app.db.InsertUser(input.Email, hashedPassword)
+	_, err = app.db.InsertUser(r.Context(), input.Email, hashedPassword)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -81,6 +145,11 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.config.passwordLogin.enabled {
+		app.passwordLoginDisabled(w, r)
+		return
+	}
+
 	var input struct {
 		Email     string              `json:"Email"`
 		Password  string              `json:"Password"`
@@ -93,51 +162,88 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, found, err := app.db.GetUserByEmail(input.Email)
+	input.Validator.CheckField(input.Email != "", "Email", "Email is required")
+	input.Validator.CheckField(input.Password != "", "Password", "Password is required")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	account := app.loginAccount(r.Context(), input.Email)
+
+	status, err := app.limiter.Check(r.Context(), account, ip)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	input.Validator.CheckField(input.Email != "", "Email", "Email is required")
-	input.Validator.CheckField(found, "Email", "Email address could not be found")
+	if !status.Allowed {
+		app.recordAuditEvent(r, database.AuditLoginFailed, "account", input.Email, database.AuditMetadata{"Reason": loginLimitReason(status)})
+		app.tooManyLoginAttempts(w, r, status.RetryAfter)
+		return
+	}
 
-	if found {
-		passwordMatches, err := password.Matches(input.Password, user.HashedPassword)
+	user, authenticated, method, err := app.checkCredentials(r.Context(), input.Email, input.Password)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !authenticated {
+		err = app.registerFailedLogin(r, input.Email, account, ip, "invalid_credentials")
 		if err != nil {
 			app.serverError(w, r, err)
 			return
 		}
 
-		input.Validator.CheckField(input.Password != "", "Password", "Password is required")
-		input.Validator.CheckField(passwordMatches, "Password", "Password is incorrect")
-	}
-
-	if input.Validator.HasErrors() {
-		app.failedValidation(w, r, input.Validator)
+		app.invalidCredentials(w, r)
 		return
 	}
 
-	var claims jwt.Claims
-	claims.Subject = strconv.Itoa(user.ID)
+	// A login that still needs its second factor hasn't succeeded yet, so
+	// its failures are only reset, and the login recorded, once MFA passes.
+	if user.MFAEnabled || app.config.mfa.enforced {
+		app.recordAuditEventFor(r, user, database.AuditLoginPasswordVerified, "user", strconv.Itoa(user.ID), database.AuditMetadata{"Method": method})
+
+		mfaToken, expiry, err := app.signToken(user.ID, app.mfaAudience(), mfaTokenTTL)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		data := map[string]any{
+			"MFAToken":       mfaToken,
+			"MFATokenExpiry": expiry.Format(time.RFC3339),
+		}
 
-	expiry := time.Now().Add(24 * time.Hour)
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
-	claims.Expires = jwt.NewNumericTime(expiry)
+		if user.MFAEnabled {
+			data["MFARequired"] = true
+		} else {
+			data["MFAEnrollmentRequired"] = true
+		}
 
-	claims.Issuer = app.config.baseURL
-	claims.Audiences = []string{app.config.baseURL}
+		err = response.JSON(w, http.StatusOK, data)
+		if err != nil {
+			app.serverError(w, r, err)
+		}
+		return
+	}
 
-	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secretKey))
+	err = app.limiter.RegisterSuccess(r.Context(), account)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	data := map[string]string{
-		"AuthenticationToken": string(jwtBytes),
-		"TokenExpiry":         expiry.Format(time.RFC3339),
+	app.recordAuditEventFor(r, user, database.AuditLoginSucceeded, "user", strconv.Itoa(user.ID), database.AuditMetadata{"Method": method})
+
+	data, err := app.issueAuthenticationToken(r, user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
 
 	err = response.JSON(w, http.StatusOK, data)
@@ -146,45 +252,238 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 }
 
-func (app *application) protectedTestHandler(w http.ResponseWriter, r *http.Request) {
-	data := map[string]string{
-		"Data": "This is a test protected handler",
+// oidcStateCookie binds an OIDC login to the browser that started it, so that
+// a callback URL carrying another login's state can't be used to log a
+// victim's browser in as someone else.
+const oidcStateCookie = "oidc_state"
+
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := app.sso.AuthCodeURL(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
-	err := response.JSON(w, http.StatusOK, data)
+
+	// The cookie has to be sent on the identity provider's redirect back,
+	// which SameSite=Lax allows as it is a top-level GET.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(sso.AuthRequestTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler completes an OIDC login and issues the same token as a
+// password login. Local MFA is not applied since the identity provider is
+// responsible for enforcing its own second factor.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if errorCode := qs.Get("error"); errorCode != "" {
+		app.badRequest(w, r, fmt.Errorf("Identity provider returned an error: %s", errorCode))
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(qs.Get("state"))) != 1 {
+		app.badRequest(w, r, errors.New("Login request was not started in this browser"))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	identity, err := app.sso.Exchange(r.Context(), qs.Get("state"), qs.Get("code"))
+	switch {
+	case errors.Is(err, sso.ErrUnknownState):
+		app.badRequest(w, r, errors.New("Login request is unknown or has expired"))
+		return
+	case errors.Is(err, sso.ErrEmailMissing):
+		app.badRequest(w, r, errors.New("Identity provider did not return a verified email address"))
+		return
+	case errors.Is(err, sso.ErrNoMatchingRole):
+		app.recordAuditEvent(r, database.AuditLoginFailed, "account", identity.Email, database.AuditMetadata{"Method": "oidc", "Reason": "no_matching_group"})
+		app.notPermitted(w, r)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	user, err := app.provisionExternalUser(r.Context(), database.AuthProviderOIDC, identity.Subject, identity.Email, identity.Role)
+	switch {
+	case errors.Is(err, errAccountNotLinked):
+		app.recordAuditEvent(r, database.AuditLoginFailed, "account", identity.Email, database.AuditMetadata{"Method": "oidc", "Reason": "account_not_linked"})
+		app.errorMessage(w, r, http.StatusForbidden, "An account with this email already exists, ask an administrator to link it to your identity provider login", nil)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEventFor(r, user, database.AuditLoginSucceeded, "user", strconv.Itoa(user.ID), database.AuditMetadata{"Method": "oidc", "Groups": identity.Groups})
+
+	data, err := app.issueAuthenticationToken(r, user)
 	if err != nil {
 		app.serverError(w, r, err)
+		return
 	}
 
+	if app.config.oidc.postLoginRedirectURL != "" {
+		fragment := url.Values{}
+		fragment.Set("AuthenticationToken", data["AuthenticationToken"].(string))
+		fragment.Set("TokenExpiry", data["TokenExpiry"].(string))
+
+		http.Redirect(w, r, app.config.oidc.postLoginRedirectURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, data)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
 }
 
-func (app *application) readResultHandler(w http.ResponseWriter, r *http.Request) {
-	resultIDStr := chi.URLParam(r, "id")
-	resultID, err := strconv.Atoi(resultIDStr)
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string              `json:"MFAToken"`
+		Code         string              `json:"Code"`
+		RecoveryCode string              `json:"RecoveryCode"`
+		Validator    validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
 	if err != nil {
-		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		app.badRequest(w, r, err)
 		return
 	}
 
-	result, found, err := app.db.GetResult(resultID)
+	user, token, found, err := app.mfaTokenUser(r.Context(), input.MFAToken)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
+
 	if !found {
-		app.notFound(w, r)
+		app.invalidAuthenticationToken(w, r)
 		return
 	}
 
-	err = response.JSON(w, http.StatusOK, result)
+	if !user.MFASecret.Valid {
+		app.badRequest(w, r, errors.New("MFA enrollment has not been started"))
+		return
+	}
+
+	ip := realip.FromRequest(r)
+
+	status, err := app.limiter.Check(r.Context(), userAccount(user), ip)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !status.Allowed {
+		app.recordAuditEventFor(r, user, database.AuditLoginFailed, "account", user.Email, database.AuditMetadata{"Reason": loginLimitReason(status)})
+		app.tooManyLoginAttempts(w, r, status.RetryAfter)
+		return
+	}
+
+	var recoveryCodes []string
+
+	switch {
+	case user.MFAEnabled && input.RecoveryCode != "":
+		used, err := app.db.UseUserRecoveryCode(r.Context(), user.ID, mfa.HashRecoveryCode(input.RecoveryCode))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		input.Validator.CheckField(used, "RecoveryCode", "Recovery code is incorrect or has already been used")
+
+	default:
+		accepted, err := app.acceptTOTPCode(r.Context(), user, input.Code)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		input.Validator.CheckField(input.Code != "", "Code", "Code is required")
+		input.Validator.CheckField(accepted, "Code", "Code is incorrect or has already been used")
+	}
+
+	if input.Validator.HasErrors() {
+		err = app.registerFailedLogin(r, user.Email, userAccount(user), ip, "invalid_mfa_code")
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	// The MFA token is only good for one login, so that a token seen by
+	// someone else can't be reused once it has been.
+	consumed, err := app.db.ConsumeMFAToken(r.Context(), token.ID, user.ID, token.Expires)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !consumed {
+		app.invalidAuthenticationToken(w, r)
+		return
+	}
+
+	err = app.limiter.RegisterSuccess(r.Context(), userAccount(user))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !user.MFAEnabled {
+		recoveryCodes, err = app.completeMFAEnrollment(r.Context(), user)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.recordAuditEventFor(r, user, database.AuditUserMFAEnabled, "user", strconv.Itoa(user.ID), nil)
+	}
+
+	app.recordAuditEventFor(r, user, database.AuditLoginSucceeded, "user", strconv.Itoa(user.ID), database.AuditMetadata{"Method": "mfa", "RecoveryCodeUsed": input.RecoveryCode != ""})
+
+	data, err := app.issueAuthenticationToken(r, user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if recoveryCodes != nil {
+		data["RecoveryCodes"] = recoveryCodes
+	}
+
+	err = response.JSON(w, http.StatusOK, data)
 	if err != nil {
 		app.serverError(w, r, err)
 	}
 }
 
-func (app *application) processResultHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) createMFAEnrollmentWithTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		SimulationID string `json:"Simulation_id"`
-		OrgName      string `json:"Org_name"`
+		MFAToken string `json:"MFAToken"`
 	}
 
 	err := request.DecodeJSON(w, r, &input)
@@ -193,68 +492,1264 @@ func (app *application) processResultHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if input.SimulationID == "" {
-		app.badRequest(w, r, errors.New("Simulation_id is required"))
+	user, _, found, err := app.mfaTokenUser(r.Context(), input.MFAToken)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
-	if input.OrgName == "" {
-		app.badRequest(w, r, errors.New("Org_name is required"))
+	if !found {
+		app.invalidAuthenticationToken(w, r)
 		return
 	}
 
-	_, found, err := app.db.GetResultBySimulationID(input.SimulationID)
+	app.startMFAEnrollment(w, r, user)
+}
+
+func (app *application) createMFAEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	app.startMFAEnrollment(w, r, user)
+}
+
+func (app *application) verifyMFAEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	var input struct {
+		Code      string              `json:"Code"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
 	if err != nil {
-		app.serverError(w, r, err)
+		app.badRequest(w, r, err)
 		return
 	}
 
-	if found {
-		app.badRequest(w, r, errors.New("Simulation_id already exists"))
+	if user.MFAEnabled {
+		app.badRequest(w, r, errors.New("MFA is already enabled"))
 		return
 	}
 
-	resultID, err := app.db.InsertResult(input.SimulationID, input.OrgName, database.StatusPending)
+	if !user.MFASecret.Valid {
+		app.badRequest(w, r, errors.New("MFA enrollment has not been started"))
+		return
+	}
+
+	accepted, err := app.acceptTOTPCode(r.Context(), user, input.Code)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	s3BucketPrefix := env.GetString("S3_BUCKET_PREFIX", "s3://active-hacks/simulations/active_directory/results")
-	s3BucketPath := fmt.Sprintf("%s/%s", s3BucketPrefix, input.SimulationID)
+	input.Validator.CheckField(input.Code != "", "Code", "Code is required")
+	input.Validator.CheckField(accepted, "Code", "Code is incorrect or has already been used")
 
-	payload := queue.BloodhoundTaskPayload{
-		ResultID:     resultID,
-		SimulationID: input.SimulationID,
-		OrgName:      input.OrgName,
-		S3BucketPath: s3BucketPath,
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
 	}
 
-	taskInfo, err := app.queueClient.EnqueueBloodhoundAnalysis(payload)
+	recoveryCodes, err := app.completeMFAEnrollment(r.Context(), user)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.db.UpdateResultTaskID(resultID, taskInfo.ID)
+	app.recordAuditEvent(r, database.AuditUserMFAEnabled, "user", strconv.Itoa(user.ID), nil)
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"RecoveryCodes": recoveryCodes})
 	if err != nil {
 		app.serverError(w, r, err)
 	}
-	app.logger.Info("Task enqueued", "task_id", taskInfo.ID, "simulation_id", input.SimulationID)
+}
+
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	var input struct {
+		Code      string              `json:"Code"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if !user.MFAEnabled {
+		app.badRequest(w, r, errors.New("MFA is not enabled"))
+		return
+	}
 
-	result, found, err := app.db.GetResult(resultID)
+	accepted, err := app.acceptTOTPCode(r.Context(), user, input.Code)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	if !found {
-		app.serverError(w, r, errors.New("Failed to retrieve created result"))
+	input.Validator.CheckField(input.Code != "", "Code", "Code is required")
+	input.Validator.CheckField(accepted, "Code", "Code is incorrect or has already been used")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
 		return
 	}
 
-	err = response.JSON(w, http.StatusCreated, result)
+	recoveryCodes, err := app.completeMFAEnrollment(r.Context(), user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditUserRecoveryCodesReplaced, "user", strconv.Itoa(user.ID), nil)
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"RecoveryCodes": recoveryCodes})
 	if err != nil {
 		app.serverError(w, r, err)
 	}
 }
+
+func (app *application) deleteMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	var input struct {
+		Password  string              `json:"Password"`
+		Code      string              `json:"Code"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if app.config.mfa.enforced {
+		app.notPermitted(w, r)
+		return
+	}
+
+	if !user.MFAEnabled {
+		app.badRequest(w, r, errors.New("MFA is not enabled"))
+		return
+	}
+
+	passwordMatches, err := password.Matches(input.Password, user.HashedPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	accepted, err := app.acceptTOTPCode(r.Context(), user, input.Code)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.Password != "", "Password", "Password is required")
+	input.Validator.CheckField(passwordMatches, "Password", "Password is incorrect")
+	input.Validator.CheckField(input.Code != "", "Code", "Code is required")
+	input.Validator.CheckField(accepted, "Code", "Code is incorrect or has already been used")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	err = app.db.DisableUserMFA(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditUserMFADisabled, "user", strconv.Itoa(user.ID), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) readAuthenticatedUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	err := response.JSON(w, http.StatusOK, user)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) updateAuthenticatedUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := contextGetAuthenticatedUser(r)
+
+	if !app.config.passwordLogin.enabled {
+		app.passwordLoginDisabled(w, r)
+		return
+	}
+
+	var input struct {
+		CurrentPassword string              `json:"CurrentPassword"`
+		NewPassword     string              `json:"NewPassword"`
+		Validator       validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	passwordMatches, err := password.Matches(input.CurrentPassword, user.HashedPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.CurrentPassword != "", "CurrentPassword", "Current password is required")
+	input.Validator.CheckField(passwordMatches, "CurrentPassword", "Current password is incorrect")
+
+	input.Validator.CheckField(input.NewPassword != "", "NewPassword", "New password is required")
+	input.Validator.CheckField(len(input.NewPassword) >= 8, "NewPassword", "New password is too short")
+	input.Validator.CheckField(len(input.NewPassword) <= 72, "NewPassword", "New password is too long")
+	input.Validator.CheckField(validator.NotIn(input.NewPassword, password.CommonPasswords...), "NewPassword", "New password is too common")
+	input.Validator.CheckField(input.NewPassword != input.CurrentPassword, "NewPassword", "New password must be different from the current password")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	hashedPassword, err := password.Hash(input.NewPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.UpdateUserHashedPassword(r.Context(), user.ID, hashedPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditUserPasswordChanged, "user", strconv.Itoa(user.ID), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) deleteUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("User ID is not a valid integer"))
+		return
+	}
+
+	user, found, err := app.db.GetUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	err = app.limiter.Unlock(r.Context(), userAccount(user))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditLoginUnlocked, "user", strconv.Itoa(user.ID), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateUserExternalIdentityHandler links an existing account to an external
+// identity. Logins from an identity provider are never matched to an account
+// by email, so this is the only way an account that predates SSO or the
+// directory can be used with it.
+func (app *application) updateUserExternalIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("User ID is not a valid integer"))
+		return
+	}
+
+	var input struct {
+		AuthProvider    string              `json:"Auth_provider"`
+		ExternalSubject string              `json:"External_subject"`
+		Validator       validator.Validator `json:"-"`
+	}
+
+	err = request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.AuthProvider == database.AuthProviderOIDC || input.AuthProvider == database.AuthProviderLDAP, "Auth_provider", `Must be "oidc" or "ldap"`)
+	input.Validator.CheckField(input.ExternalSubject != "", "External_subject", "External_subject is required")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	linked, err := app.db.LinkUserExternalIdentity(r.Context(), userID, input.AuthProvider, input.ExternalSubject)
+	switch {
+	case errors.Is(err, database.ErrExternalIdentityInUse):
+		app.conflict(w, r, "External identity is already linked to another user")
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+	if !linked {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditUserExternalIdentityLinked, "user", strconv.Itoa(userID), database.AuditMetadata{
+		"AuthProvider":    input.AuthProvider,
+		"ExternalSubject": input.ExternalSubject,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) protectedTestHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]string{
+		"Data": "This is a test protected handler",
+	}
+	err := response.JSON(w, http.StatusOK, data)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+
+}
+
+func (app *application) readResultHandler(w http.ResponseWriter, r *http.Request) {
+	resultIDStr := chi.URLParam(r, "id")
+	resultID, err := strconv.Atoi(resultIDStr)
+	if err != nil {
+		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		return
+	}
+
+	result, found, err := app.db.GetResult(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditResultViewed, "result", strconv.Itoa(result.ID), database.AuditMetadata{"SimulationID": result.SimulationID, "OrgName": result.OrgName})
+
+	err = response.JSON(w, http.StatusOK, result)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) readResultHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	resultID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		return
+	}
+
+	_, found, err := app.db.GetResult(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	history, err := app.db.GetResultStatusHistory(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"History": history})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteResultHandler(w http.ResponseWriter, r *http.Request) {
+	resultID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		return
+	}
+
+	result, found, err := app.db.GetResult(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	policy, _, err := app.db.GetRetentionPolicy(r.Context(), result.OrgName)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if result.LegalHold || policy.LegalHold {
+		app.conflict(w, r, "Result is on legal hold")
+		return
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	// The result is cancelled before its task, so that a running task sees
+	// that it was cancelled rather than failed.
+	if !database.ResultStatusFinal(result.Status) {
+		err = app.db.TransitionResultStatus(r.Context(), result.ID, result.Status, database.StatusCancelled, user.Email, database.ReasonResultDeleted)
+		switch {
+		case errors.Is(err, database.ErrTransitionConflict):
+			app.conflict(w, r, "Result changed while being deleted, try again")
+			return
+		case err != nil:
+			app.serverError(w, r, err)
+			return
+		}
+
+		if result.TaskID != "" {
+			err = app.queueAdmin.CancelTask(result.TaskID)
+			if err != nil && !errors.Is(err, queue.ErrTaskNotFound) {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+	}
+
+	deleted, err := app.db.SoftDeleteResult(r.Context(), result.ID, user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditResultDeleted, "result", strconv.Itoa(result.ID), database.AuditMetadata{
+		"SimulationID": result.SimulationID,
+		"OrgName":      result.OrgName,
+		"Status":       result.Status,
+		"PurgeAfter":   time.Now().Add(app.config.retention.restoreWindow),
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) restoreResultHandler(w http.ResponseWriter, r *http.Request) {
+	resultID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		return
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	// A result that was cancelled by being deleted is queued again.
+	restored, err := app.db.RestoreResult(r.Context(), database.ResultRestore{
+		ID:           resultID,
+		DeletedAfter: time.Now().Add(-app.config.retention.restoreWindow),
+		Actor:        user.Email,
+		TaskID:       uuid.NewString(),
+		TaskType:     queue.TypeBloodhoundAnalysis,
+		Payload: func(result database.Result) ([]byte, error) {
+			return queue.MarshalBloodhoundAnalysis(r.Context(), queue.BloodhoundTaskPayload{
+				ResultID:        result.ID,
+				SimulationID:    result.SimulationID,
+				OrgName:         result.OrgName,
+				S3BucketPath:    queue.ResultBucketPath(result),
+				InputPath:       result.InputPath.String,
+				AnalysisOptions: result.AnalysisOptions,
+				RequestID:       contextGetRequestID(r),
+			})
+		},
+	})
+	switch {
+	case errors.Is(err, database.ErrRestoreWindowElapsed):
+		app.conflict(w, r, "Result was deleted too long ago to be restored")
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+	if !restored {
+		app.notFound(w, r)
+		return
+	}
+
+	result, found, err := app.db.GetResult(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditResultRestored, "result", strconv.Itoa(result.ID), database.AuditMetadata{
+		"SimulationID": result.SimulationID,
+		"OrgName":      result.OrgName,
+		"Status":       result.Status,
+	})
+
+	err = response.JSON(w, http.StatusOK, result)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) processResultHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SimulationID    string              `json:"Simulation_id"`
+		OrgName         string              `json:"Org_name"`
+		AnalysisOptions analysis.Options    `json:"Analysis_options"`
+		Validator       validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if input.SimulationID == "" {
+		app.badRequest(w, r, errors.New("Simulation_id is required"))
+		return
+	}
+
+	if !validPathSegment(input.SimulationID) {
+		app.badRequest(w, r, errors.New(`Simulation_id must not contain "/", "\" or ".."`))
+		return
+	}
+
+	if input.OrgName == "" {
+		app.badRequest(w, r, errors.New("Org_name is required"))
+		return
+	}
+
+	if !validPathSegment(input.OrgName) {
+		app.badRequest(w, r, errors.New(`Org_name must not contain "/", "\" or ".."`))
+		return
+	}
+
+	validateAnalysisOptions(&input.Validator, "Analysis_options", input.AnalysisOptions)
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	// The options are hashed as submitted, not as resolved, so a retry is
+	// still recognised if the organization's defaults change in between.
+	// Requests without options hash as they did before options existed.
+	requestFields := []string{input.SimulationID, input.OrgName}
+	if input.AnalysisOptions != (analysis.Options{}) {
+		submittedOptions, err := json.Marshal(input.AnalysisOptions)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		requestFields = append(requestFields, string(submittedOptions))
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	// A client retrying with the same Idempotency-Key gets the result its
+	// first request created instead of a duplicate error.
+	var idempotencyKey *database.IdempotencyKey
+
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if !validRequestID(key) {
+			app.badRequest(w, r, errors.New("Idempotency-Key must be at most 128 letters, digits, '-', '_', '.' or ':'"))
+			return
+		}
+
+		idempotencyKey = &database.IdempotencyKey{
+			UserID:      user.ID,
+			Key:         key,
+			RequestHash: hashRequest(requestFields...),
+		}
+
+		replayed := app.replayIdempotentRequest(w, r, *idempotencyKey)
+		if replayed {
+			return
+		}
+	}
+
+	_, found, err := app.db.GetResultBySimulationID(r.Context(), input.SimulationID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if found {
+		app.badRequest(w, r, errors.New("Simulation_id already exists"))
+		return
+	}
+
+	s3BucketPrefix := env.GetString("S3_BUCKET_PREFIX", "s3://active-hacks/simulations/active_directory/results")
+	s3BucketPath := fmt.Sprintf("%s/%s", s3BucketPrefix, input.SimulationID)
+
+	opts, err := app.db.EffectiveAnalysisOptions(r.Context(), input.OrgName, input.AnalysisOptions)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// The task is written to the outbox in the same transaction as the
+	// result and published by the relay, so a result is never left without
+	// a task if the queue is unavailable.
+	taskID := uuid.NewString()
+
+	resultID, err := app.db.InsertResultWithTask(r.Context(), database.NewResult{
+		SimulationID:    input.SimulationID,
+		OrgName:         input.OrgName,
+		S3BucketPath:    s3BucketPath,
+		TaskID:          taskID,
+		TaskType:        queue.TypeBloodhoundAnalysis,
+		AnalysisOptions: opts,
+		Actor:           user.Email,
+		Payload: func(resultID int) ([]byte, error) {
+			return queue.MarshalBloodhoundAnalysis(r.Context(), queue.BloodhoundTaskPayload{
+				ResultID:        resultID,
+				SimulationID:    input.SimulationID,
+				OrgName:         input.OrgName,
+				S3BucketPath:    s3BucketPath,
+				AnalysisOptions: opts,
+				RequestID:       contextGetRequestID(r),
+			})
+		},
+	}, idempotencyKey)
+	switch {
+	case errors.Is(err, database.ErrDuplicateSimulationID):
+		app.badRequest(w, r, errors.New("Simulation_id already exists"))
+		return
+	case errors.Is(err, database.ErrDuplicateIdempotencyKey):
+		// A concurrent request with the same key got there first.
+		if !app.replayIdempotentRequest(w, r, *idempotencyKey) {
+			app.serverError(w, r, err)
+		}
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.relay.Notify()
+
+	app.recordAuditEvent(r, database.AuditResultCreated, "result", strconv.Itoa(resultID), database.AuditMetadata{"SimulationID": input.SimulationID, "OrgName": input.OrgName, "AnalysisOptions": opts})
+	app.logger.InfoContext(r.Context(), "task enqueued", "task_id", taskID, "result_id", resultID, "simulation_id", input.SimulationID)
+
+	result, found, err := app.db.GetResult(r.Context(), resultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !found {
+		app.serverError(w, r, errors.New("Failed to retrieve created result"))
+		return
+	}
+
+	err = response.JSON(w, http.StatusCreated, result)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// replayIdempotentRequest responds with the result created by an earlier
+// request with the same Idempotency-Key, if there was one, and reports
+// whether it did. A key reused for a different request is rejected.
+func (app *application) replayIdempotentRequest(w http.ResponseWriter, r *http.Request, key database.IdempotencyKey) bool {
+	previous, found, err := app.db.GetIdempotencyKey(r.Context(), key.UserID, key.Key)
+	if err != nil {
+		app.serverError(w, r, err)
+		return true
+	}
+
+	if !found {
+		return false
+	}
+
+	if previous.RequestHash != key.RequestHash {
+		app.errorMessage(w, r, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request", nil)
+		return true
+	}
+
+	result, found, err := app.db.GetResult(r.Context(), previous.ResultID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return true
+	}
+
+	if !found {
+		app.notFound(w, r)
+		return true
+	}
+
+	headers := make(http.Header)
+	headers.Set("Idempotent-Replayed", "true")
+
+	err = response.JSONWithHeaders(w, http.StatusCreated, result, headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+
+	return true
+}
+
+func (app *application) listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	schedules, err := app.db.GetSchedules(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Schedules": schedules})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SimulationID string              `json:"Simulation_id"`
+		OrgName      string              `json:"Org_name"`
+		Cron         string              `json:"Cron"`
+		Validator    validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	nextFireAt, cronErr := queue.NextScheduleFire(input.Cron, time.Now())
+
+	var interval time.Duration
+	if cronErr == nil {
+		interval, cronErr = queue.ShortestScheduleInterval(input.Cron, time.Now())
+	}
+
+	input.Validator.CheckField(input.SimulationID != "", "Simulation_id", "Simulation_id is required")
+	input.Validator.CheckField(len(input.SimulationID) <= 200, "Simulation_id", "Simulation_id is too long")
+	input.Validator.CheckField(validPathSegment(input.SimulationID), "Simulation_id", `Must not contain "/", "\" or ".."`)
+	input.Validator.CheckField(input.OrgName != "", "Org_name", "Org_name is required")
+	input.Validator.CheckField(validPathSegment(input.OrgName), "Org_name", `Must not contain "/", "\" or ".."`)
+	input.Validator.CheckField(input.Cron != "", "Cron", "Cron is required")
+	input.Validator.CheckField(input.Cron == "" || cronErr == nil, "Cron", "Must be a valid cron expression")
+	input.Validator.CheckField(cronErr != nil || interval >= app.config.schedule.minInterval, "Cron", fmt.Sprintf("Must not fire more often than every %s", app.config.schedule.minInterval))
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	scheduleID, err := app.db.InsertSchedule(r.Context(), input.OrgName, input.SimulationID, input.Cron, user.ID, nextFireAt)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditScheduleCreated, "schedule", strconv.Itoa(scheduleID), database.AuditMetadata{"SimulationID": input.SimulationID, "OrgName": input.OrgName, "Cron": input.Cron})
+
+	schedule, found, err := app.db.GetSchedule(r.Context(), scheduleID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !found {
+		app.serverError(w, r, errors.New("Failed to retrieve created schedule"))
+		return
+	}
+
+	err = response.JSON(w, http.StatusCreated, schedule)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	scheduleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("Schedule ID is not a valid integer"))
+		return
+	}
+
+	deleted, err := app.db.DeleteSchedule(r.Context(), scheduleID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditScheduleDeleted, "schedule", strconv.Itoa(scheduleID), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, v := app.readAuditEventFilter(r)
+
+	filter.Limit = app.readInt(r.URL.Query(), "limit", 100, &v)
+	filter.Offset = app.readInt(r.URL.Query(), "offset", 0, &v)
+
+	v.CheckField(validator.Between(filter.Limit, 1, 1000), "limit", "Must be between 1 and 1000")
+	v.CheckField(filter.Offset >= 0, "offset", "Must not be negative")
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	events, err := app.db.GetAuditEvents(r.Context(), filter)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"AuditEvents": events})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) exportAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, v := app.readAuditEventFilter(r)
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	// Exports can legitimately outlive the server's default write timeout.
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-events.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+
+	err = app.db.StreamAuditEvents(r.Context(), filter, func(event database.AuditEvent) error {
+		return enc.Encode(event)
+	})
+	if err != nil {
+		// The status line has already been sent, so the best we can do is
+		// report the error and cut the stream short.
+		app.reportServerError(r, err)
+	}
+}
+
+func (app *application) readAuditEventFilter(r *http.Request) (database.AuditEventFilter, validator.Validator) {
+	var v validator.Validator
+	qs := r.URL.Query()
+
+	filter := database.AuditEventFilter{
+		ActorID:    app.readInt(qs, "actor_id", 0, &v),
+		Action:     app.readString(qs, "action", ""),
+		TargetType: app.readString(qs, "target_type", ""),
+		TargetID:   app.readString(qs, "target_id", ""),
+		Since:      app.readTime(qs, "since", &v),
+		Until:      app.readTime(qs, "until", &v),
+	}
+
+	return filter, v
+}
+
+func (app *application) readQueueHandler(w http.ResponseWriter, r *http.Request) {
+	summary, err := app.queueAdmin.Queue()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Queue": summary})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) pauseQueueHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.queueAdmin.Pause()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditQueuePaused, "queue", queue.QueueBloodhound, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) unpauseQueueHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.queueAdmin.Unpause()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditQueueUnpaused, "queue", queue.QueueBloodhound, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) listQueueTasksHandler(w http.ResponseWriter, r *http.Request) {
+	var v validator.Validator
+	qs := r.URL.Query()
+
+	state := app.readString(qs, "state", queue.StatePending)
+	page := app.readInt(qs, "page", 1, &v)
+	pageSize := app.readInt(qs, "page_size", 50, &v)
+
+	v.CheckField(validator.In(state, queue.TaskStates...), "state", "Must be one of pending, active, scheduled, retry or archived")
+	v.CheckField(page >= 1, "page", "Must be at least 1")
+	v.CheckField(validator.Between(pageSize, 1, 500), "page_size", "Must be between 1 and 500")
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	tasks, err := app.queueAdmin.ListTasks(state, page, pageSize)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Tasks": tasks})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteQueueTaskHandler(w http.ResponseWriter, r *http.Request) {
+	task, err := app.queueAdmin.DeleteTask(chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, queue.ErrTaskNotFound):
+		app.notFound(w, r)
+		return
+	case errors.Is(err, queue.ErrTaskStateInvalid):
+		app.conflict(w, r, "Active tasks can't be deleted")
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditQueueTaskDeleted, "task", task.ID, database.AuditMetadata{
+		"State":    task.State,
+		"ResultID": task.ResultID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) runQueueTaskHandler(w http.ResponseWriter, r *http.Request) {
+	task, err := app.queueAdmin.RunTask(chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, queue.ErrTaskNotFound):
+		app.notFound(w, r)
+		return
+	case errors.Is(err, queue.ErrTaskStateInvalid):
+		app.conflict(w, r, "Only scheduled, retry and archived tasks can be run now")
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditQueueTaskRun, "task", task.ID, database.AuditMetadata{
+		"State":    task.State,
+		"ResultID": task.ResultID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) runArchivedQueueTasksHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := app.queueAdmin.RunAllArchivedTasks()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditQueueArchivedRequeue, "queue", queue.QueueBloodhound, database.AuditMetadata{
+		"Count": n,
+	})
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Requeued": n})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listRetentionPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := app.db.GetRetentionPolicies(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	defaults := map[string]any{
+		"Input_retention_days":  app.config.retention.inputDays,
+		"Report_retention_days": app.config.retention.reportDays,
+		"Delete_results":        app.config.retention.deleteResults,
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Defaults": defaults, "Policies": policies})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) updateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OrgName             string              `json:"Org_name"`
+		InputRetentionDays  *int                `json:"Input_retention_days"`
+		ReportRetentionDays *int                `json:"Report_retention_days"`
+		LegalHold           *bool               `json:"Legal_hold"`
+		Validator           validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.OrgName != "", "Org_name", "Org_name is required")
+	input.Validator.CheckField(len(input.OrgName) <= 512, "Org_name", "Org_name is too long")
+	input.Validator.CheckField(input.InputRetentionDays == nil || *input.InputRetentionDays >= 0, "Input_retention_days", "Must not be negative")
+	input.Validator.CheckField(input.ReportRetentionDays == nil || *input.ReportRetentionDays >= 0, "Report_retention_days", "Must not be negative")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	update := database.RetentionPolicyUpdate{
+		OrgName:   input.OrgName,
+		UpdatedBy: sql.NullInt64{Int64: int64(user.ID), Valid: user.ID != 0},
+	}
+	if input.InputRetentionDays != nil {
+		update.InputRetentionDays = sql.NullInt64{Int64: int64(*input.InputRetentionDays), Valid: true}
+	}
+	if input.ReportRetentionDays != nil {
+		update.ReportRetentionDays = sql.NullInt64{Int64: int64(*input.ReportRetentionDays), Valid: true}
+	}
+	if input.LegalHold != nil {
+		update.LegalHold = sql.NullBool{Bool: *input.LegalHold, Valid: true}
+	}
+
+	heldBefore, heldAfter, err := app.db.UpsertRetentionPolicy(r.Context(), update)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditRetentionPolicyUpdated, "retention_policy", input.OrgName, database.AuditMetadata{
+		"InputRetentionDays":  input.InputRetentionDays,
+		"ReportRetentionDays": input.ReportRetentionDays,
+		"LegalHold":           heldAfter,
+	})
+
+	switch {
+	case !heldBefore && heldAfter:
+		app.recordAuditEvent(r, database.AuditRetentionPolicyLegalHoldSet, "retention_policy", input.OrgName, nil)
+	case heldBefore && !heldAfter:
+		app.recordAuditEvent(r, database.AuditRetentionPolicyLegalHoldReleased, "retention_policy", input.OrgName, database.AuditMetadata{
+			"Reason": "policy updated",
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) deleteRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	orgName := r.URL.Query().Get("org_name")
+	if orgName == "" {
+		app.badRequest(w, r, errors.New("org_name is required"))
+		return
+	}
+
+	policy, deleted, err := app.db.DeleteRetentionPolicy(r.Context(), orgName)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditRetentionPolicyDeleted, "retention_policy", orgName, database.AuditMetadata{
+		"LegalHold": policy.LegalHold,
+	})
+
+	if policy.LegalHold {
+		app.recordAuditEvent(r, database.AuditRetentionPolicyLegalHoldReleased, "retention_policy", orgName, database.AuditMetadata{
+			"Reason": "policy deleted",
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) listAnalysisDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	defaults, err := app.db.GetAllAnalysisDefaults(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = response.JSON(w, http.StatusOK, map[string]any{"Defaults": analysis.Defaults(), "Organizations": defaults})
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) updateAnalysisDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		OrgName         string              `json:"Org_name"`
+		AnalysisOptions analysis.Options    `json:"Analysis_options"`
+		Validator       validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.OrgName != "", "Org_name", "Org_name is required")
+	input.Validator.CheckField(len(input.OrgName) <= 512, "Org_name", "Org_name is too long")
+	validateAnalysisOptions(&input.Validator, "Analysis_options", input.AnalysisOptions)
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	user, _ := contextGetAuthenticatedUser(r)
+
+	err = app.db.UpsertAnalysisDefaults(r.Context(), database.AnalysisDefaults{
+		OrgName:   input.OrgName,
+		Options:   input.AnalysisOptions,
+		UpdatedBy: database.NullInt64{Int64: int64(user.ID), Valid: user.ID != 0},
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditAnalysisDefaultsUpdated, "analysis_defaults", input.OrgName, database.AuditMetadata{
+		"AnalysisOptions": input.AnalysisOptions,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) deleteAnalysisDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	orgName := r.URL.Query().Get("org_name")
+	if orgName == "" {
+		app.badRequest(w, r, errors.New("org_name is required"))
+		return
+	}
+
+	deleted, err := app.db.DeleteAnalysisDefaults(r.Context(), orgName)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.recordAuditEvent(r, database.AuditAnalysisDefaultsDeleted, "analysis_defaults", orgName, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) updateResultLegalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	resultID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, errors.New(`Result ID is not a valid integer`))
+		return
+	}
+
+	var input struct {
+		LegalHold *bool               `json:"Legal_hold"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err = request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.LegalHold != nil, "Legal_hold", "Legal_hold is required")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	found, err := app.db.SetResultLegalHold(r.Context(), resultID, *input.LegalHold)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !found {
+		app.notFound(w, r)
+		return
+	}
+
+	action := database.AuditResultLegalHoldReleased
+	if *input.LegalHold {
+		action = database.AuditResultLegalHoldSet
+	}
+
+	app.recordAuditEvent(r, action, "result", strconv.Itoa(resultID), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
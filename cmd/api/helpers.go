@@ -1,8 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/directory"
+	"com.activehacks.ad-miner-backend/internal/lockout"
+	"com.activehacks.ad-miner-backend/internal/mfa"
+	"com.activehacks.ad-miner-backend/internal/password"
+	"com.activehacks.ad-miner-backend/internal/response"
+	"com.activehacks.ad-miner-backend/internal/validator"
+
+	"github.com/google/uuid"
+	"github.com/pascaldekloe/jwt"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) newEmailData() map[string]any {
@@ -32,3 +54,502 @@ func (app *application) backgroundTask(r *http.Request, fn func() error) {
 		}
 	}()
 }
+
+const (
+	authenticationTokenTTL = 24 * time.Hour
+	mfaTokenTTL            = 5 * time.Minute
+)
+
+// mfaAudience is the audience of the short-lived intermediate tokens issued
+// between the password and TOTP steps of a login. Those tokens are never
+// accepted by the authenticate middleware.
+func (app *application) mfaAudience() string {
+	return app.config.baseURL + "/mfa"
+}
+
+func (app *application) signToken(userID int, audience string, ttl time.Duration) (string, time.Time, error) {
+	var claims jwt.Claims
+	claims.Subject = strconv.Itoa(userID)
+
+	expiry := time.Now().Add(ttl)
+	claims.Issued = jwt.NewNumericTime(time.Now())
+	claims.NotBefore = jwt.NewNumericTime(time.Now())
+	claims.Expires = jwt.NewNumericTime(expiry)
+
+	claims.Issuer = app.config.baseURL
+	claims.Audiences = []string{audience}
+	claims.ID = uuid.NewString()
+
+	jwtBytes, err := app.keys.Sign(&claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(jwtBytes), expiry, nil
+}
+
+func (app *application) checkToken(token, audience string) (int, bool, error) {
+	claims, valid := app.tokenClaims(token, audience)
+	if !valid {
+		return 0, false, nil
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return userID, true, nil
+}
+
+// tokenClaims returns the claims of a token this deployment signed for
+// audience, if it is still valid.
+func (app *application) tokenClaims(token, audience string) (*jwt.Claims, bool) {
+	claims, err := app.keys.Check([]byte(token))
+	if err != nil {
+		return nil, false
+	}
+
+	if !claims.Valid(time.Now()) {
+		return nil, false
+	}
+
+	if claims.Issuer != app.config.baseURL {
+		return nil, false
+	}
+
+	if !claims.AcceptAudience(audience) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// issueAuthenticationToken signs a full authentication token for the user and
+// records the login. The returned data is ready to be sent to the client.
+func (app *application) issueAuthenticationToken(r *http.Request, user database.User) (map[string]any, error) {
+	token, expiry, err := app.signToken(user.ID, app.config.baseURL, authenticationTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.db.UpdateUserLastLogin(r.Context(), user.ID, time.Now(), realip.FromRequest(r))
+	if err != nil {
+		return nil, err
+	}
+
+	app.recordAuditEventFor(r, user, database.AuditTokenCreated, "user", strconv.Itoa(user.ID), database.AuditMetadata{"Expiry": expiry})
+
+	data := map[string]any{
+		"AuthenticationToken": token,
+		"TokenExpiry":         expiry.Format(time.RFC3339),
+	}
+
+	return data, nil
+}
+
+// completeMFAEnrollment enables MFA for the user and returns a fresh set of
+// plaintext recovery codes to hand to them exactly once.
+func (app *application) completeMFAEnrollment(ctx context.Context, user database.User) ([]string, error) {
+	recoveryCodes, err := mfa.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	hashedRecoveryCodes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashedRecoveryCodes[i] = mfa.HashRecoveryCode(code)
+	}
+
+	err = app.db.EnableUserMFA(ctx, user.ID, hashedRecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+// mfaToken identifies an MFA token, so that it can only be exchanged for an
+// authentication token once.
+type mfaToken struct {
+	ID      string
+	Expires time.Time
+}
+
+func (app *application) mfaTokenUser(ctx context.Context, token string) (database.User, mfaToken, bool, error) {
+	claims, valid := app.tokenClaims(token, app.mfaAudience())
+	if !valid || claims.ID == "" || claims.Expires == nil {
+		return database.User{}, mfaToken{}, false, nil
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return database.User{}, mfaToken{}, false, err
+	}
+
+	user, found, err := app.db.GetUser(ctx, userID)
+	return user, mfaToken{ID: claims.ID, Expires: claims.Expires.Time()}, found, err
+}
+
+// acceptTOTPCode checks a TOTP code from the user's authenticator. A code is
+// only accepted once: a code for the same time step as an earlier one, or an
+// earlier step, is refused even if it is otherwise correct.
+func (app *application) acceptTOTPCode(ctx context.Context, user database.User, code string) (bool, error) {
+	step, valid := mfa.Validate(code, user.MFASecret.String, time.Now())
+	if !valid {
+		return false, nil
+	}
+
+	return app.db.AcceptUserMFAStep(ctx, user.ID, step)
+}
+
+func (app *application) startMFAEnrollment(w http.ResponseWriter, r *http.Request, user database.User) {
+	if user.MFAEnabled {
+		app.badRequest(w, r, errors.New("MFA is already enabled"))
+		return
+	}
+
+	enrollment, err := mfa.NewEnrollment(app.config.mfa.issuer, user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.UpdateUserMFASecret(r.Context(), user.ID, enrollment.Secret)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.recordAuditEventFor(r, user, database.AuditUserMFAEnrollmentStarted, "user", strconv.Itoa(user.ID), nil)
+
+	err = response.JSON(w, http.StatusOK, enrollment)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// recordAuditEvent appends an event to the audit trail on behalf of the
+// authenticated user, or an anonymous actor if there is none. Failures are
+// reported but never interrupt the request.
+func (app *application) recordAuditEvent(r *http.Request, action, targetType, targetID string, metadata database.AuditMetadata) {
+	user, _ := contextGetAuthenticatedUser(r)
+	app.recordAuditEventFor(r, user, action, targetType, targetID, metadata)
+}
+
+func (app *application) recordAuditEventFor(r *http.Request, actor database.User, action, targetType, targetID string, metadata database.AuditMetadata) {
+	event := database.AuditEvent{
+		Actor:      "anonymous",
+		IP:         database.NullString{String: realip.FromRequest(r), Valid: true},
+		Action:     action,
+		TargetType: database.NullString{String: targetType, Valid: targetType != ""},
+		TargetID:   database.NullString{String: targetID, Valid: targetID != ""},
+		Metadata:   metadata,
+	}
+
+	if actor.ID != 0 {
+		event.ActorID = database.NullInt64{Int64: int64(actor.ID), Valid: true}
+		event.Actor = actor.Email
+	}
+
+	// The audit write shouldn't be abandoned just because the client went
+	// away, so it keeps the request's trace but not its cancellation.
+	err := app.db.InsertAuditEvent(context.WithoutCancel(r.Context()), event)
+	if err != nil {
+		app.reportServerError(r, err)
+	}
+}
+
+// registerFailedLogin counts a failed login attempt against account and
+// records any lockout or suspicious pattern it triggers in the audit trail
+// under the email or login name that was used.
+func (app *application) registerFailedLogin(r *http.Request, email, account, ip, reason string) error {
+	failure, err := app.limiter.RegisterFailure(r.Context(), account, ip)
+	if err != nil {
+		return err
+	}
+
+	metadata := database.AuditMetadata{
+		"Reason":          reason,
+		"AccountFailures": failure.AccountFailures,
+		"IPFailures":      failure.IPFailures,
+	}
+
+	app.recordAuditEvent(r, database.AuditLoginFailed, "account", email, metadata)
+
+	if failure.AccountLocked {
+		app.recordAuditEvent(r, database.AuditLoginLocked, "account", email, metadata)
+	}
+
+	if failure.IPLocked {
+		app.recordAuditEvent(r, database.AuditLoginIPLocked, "ip", ip, metadata)
+	}
+
+	if failure.Suspicious {
+		app.recordAuditEvent(r, database.AuditLoginSuspicious, "ip", ip, metadata)
+	}
+
+	return nil
+}
+
+// loginLimitReason returns the audit reason for a login attempt the limiter
+// turned away, telling a lockout from the delay that follows each failure.
+func loginLimitReason(status lockout.Status) string {
+	if status.AccountLocked || status.IPLocked {
+		return "locked_out"
+	}
+
+	return "throttled"
+}
+
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	return s
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddFieldError(key, "Must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) sql.NullTime {
+	s := qs.Get(key)
+	if s == "" {
+		return sql.NullTime{}
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddFieldError(key, "Must be an RFC 3339 timestamp")
+		return sql.NullTime{}
+	}
+
+	return sql.NullTime{Time: t, Valid: true}
+}
+
+// errAccountNotLinked is returned when an external identity has no account of
+// its own but its email belongs to an existing account. Taking that account
+// over on the strength of the email alone would let whoever controls the
+// email at the provider log in as it, so an administrator has to link it.
+var errAccountNotLinked = errors.New("an account with this email exists but is not linked to the identity")
+
+// provisionExternalUser finds or creates the local user for an identity that
+// was authenticated by an external provider. Users are matched on the
+// provider and subject only, and the role is refreshed from the provider's
+// group mapping on every login.
+func (app *application) provisionExternalUser(ctx context.Context, authProvider, subject, email, role string) (database.User, error) {
+	user, found, err := app.db.GetUserByExternalSubject(ctx, authProvider, subject)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if !found {
+		_, exists, err := app.db.GetUserByEmail(ctx, email)
+		if err != nil {
+			return database.User{}, err
+		}
+
+		if exists {
+			return database.User{}, errAccountNotLinked
+		}
+
+		userID, err := app.db.InsertExternalUser(ctx, email, authProvider, subject, role)
+		if err != nil {
+			return database.User{}, err
+		}
+
+		user, _, err = app.db.GetUser(ctx, userID)
+		return user, err
+	}
+
+	if user.Role != role {
+		err = app.db.UpdateUserRole(ctx, user.ID, role)
+		if err != nil {
+			return database.User{}, err
+		}
+
+		user.Role = role
+	}
+
+	return user, nil
+}
+
+// checkCredentials verifies a login against the directory, if one is
+// configured, and otherwise against local accounts. Local accounts are only
+// consulted alongside a directory when local fallback is enabled and the
+// directory either has no such user or can't be reached. The returned method
+// names the provider that authenticated the user.
+func (app *application) checkCredentials(ctx context.Context, login, plaintextPassword string) (database.User, bool, string, error) {
+	if app.directory != nil {
+		identity, err := app.directory.Authenticate(login, plaintextPassword)
+
+		switch {
+		case err == nil:
+			user, err := app.provisionExternalUser(ctx, database.AuthProviderLDAP, identity.DN, identity.Email, identity.Role)
+			if errors.Is(err, errAccountNotLinked) {
+				app.logger.WarnContext(ctx, "directory user matches an unlinked local account", "dn", identity.DN)
+				return database.User{}, false, database.AuthProviderLDAP, nil
+			}
+			if err != nil {
+				return database.User{}, false, "", err
+			}
+			return user, true, database.AuthProviderLDAP, nil
+
+		case errors.Is(err, directory.ErrInvalidCredentials), errors.Is(err, directory.ErrNoMatchingRole):
+			return database.User{}, false, database.AuthProviderLDAP, nil
+
+		case errors.Is(err, directory.ErrEmailMissing):
+			app.logger.WarnContext(ctx, "directory user has no email address", "login", login)
+			return database.User{}, false, database.AuthProviderLDAP, nil
+
+		case errors.Is(err, directory.ErrUserNotFound):
+			if !app.config.ldap.localFallback {
+				password.SimulateMatch(plaintextPassword)
+				return database.User{}, false, database.AuthProviderLDAP, nil
+			}
+
+		default:
+			if !app.config.ldap.localFallback {
+				return database.User{}, false, "", err
+			}
+			app.logger.WarnContext(ctx, "directory unavailable, falling back to local accounts", "error", err)
+		}
+	}
+
+	user, found, err := app.db.GetUserByEmail(ctx, login)
+	if err != nil {
+		return database.User{}, false, "", err
+	}
+
+	if !found {
+		password.SimulateMatch(plaintextPassword)
+		return database.User{}, false, database.AuthProviderLocal, nil
+	}
+
+	passwordMatches, err := password.Matches(plaintextPassword, user.HashedPassword)
+	if err != nil {
+		return database.User{}, false, "", err
+	}
+
+	return user, passwordMatches, database.AuthProviderLocal, nil
+}
+
+// loginAccount returns the account that attempts to log in with a login name
+// count against. A directory user can log in with any name the user filter
+// matches, so their attempts are counted against their DN rather than the
+// name used, or trying each name in turn would multiply the attempts allowed
+// before a lockout.
+func (app *application) loginAccount(ctx context.Context, login string) string {
+	if app.directory == nil {
+		return login
+	}
+
+	dn, err := app.directory.LookUp(login)
+	if err != nil {
+		if !errors.Is(err, directory.ErrUserNotFound) {
+			app.logger.WarnContext(ctx, "failed to look up login in directory", "error", err)
+		}
+		return login
+	}
+
+	return dn
+}
+
+// userAccount returns the account that a user's login attempts count
+// against, matching loginAccount.
+func userAccount(user database.User) string {
+	if user.AuthProvider == database.AuthProviderLDAP && user.ExternalSubject.Valid {
+		return user.ExternalSubject.String
+	}
+
+	return user.Email
+}
+
+// splitDNs splits a semicolon separated list of distinguished names. Commas
+// can't be used as a separator since they appear inside DNs.
+func splitDNs(value string) []string {
+	var dns []string
+
+	for _, dn := range strings.Split(value, ";") {
+		dn = strings.TrimSpace(dn)
+		if dn != "" {
+			dns = append(dns, dn)
+		}
+	}
+
+	return dns
+}
+
+const requestIDHeader = "X-Request-ID"
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// validRequestID reports whether a caller-supplied request ID is safe to log
+// and echo back: short and limited to characters used by common ID formats.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, c := range requestID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// validPathSegment reports whether a simulation ID or organization name is
+// safe to use as a single segment of a storage or local path. A value
+// containing a slash or ".." could point a result, and so its deletion, at
+// another result's artifacts or outside the working directory.
+func validPathSegment(value string) bool {
+	return !strings.Contains(value, "/") && !strings.Contains(value, "\\") && !strings.Contains(value, "..")
+}
+
+// hashRequest fingerprints the fields of a request that an Idempotency-Key
+// covers, so that reusing a key for a different request can be detected.
+func hashRequest(fields ...string) string {
+	h := sha256.New()
+
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validateAnalysisOptions checks a submitted set of AD-miner options, with
+// field errors named after the options' keys under field.
+func validateAnalysisOptions(v *validator.Validator, field string, opts analysis.Options) {
+	if opts.Level != nil {
+		v.CheckField(validator.Between(*opts.Level, analysis.MinLevel, analysis.MaxLevel), field+".Level", fmt.Sprintf("Must be between %d and %d", analysis.MinLevel, analysis.MaxLevel))
+	}
+
+	if opts.RenewalPasswordDays != nil {
+		v.CheckField(validator.Between(*opts.RenewalPasswordDays, analysis.MinRenewalPasswordDays, analysis.MaxRenewalPasswordDays), field+".Renewal_password_days", fmt.Sprintf("Must be between %d and %d", analysis.MinRenewalPasswordDays, analysis.MaxRenewalPasswordDays))
+	}
+
+	if opts.EvolutionRuns != nil {
+		v.CheckField(validator.Between(*opts.EvolutionRuns, 0, analysis.MaxEvolutionRuns), field+".Evolution_runs", fmt.Sprintf("Must be between 0 and %d", analysis.MaxEvolutionRuns))
+	}
+}
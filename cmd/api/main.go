@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"runtime/debug"
+	"slices"
 	"sync"
+	"time"
 
+	"com.activehacks.ad-miner-backend/internal/analysis"
 	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/directory"
 	"com.activehacks.ad-miner-backend/internal/env"
+	"com.activehacks.ad-miner-backend/internal/health"
+	"com.activehacks.ad-miner-backend/internal/jwtkeys"
+	"com.activehacks.ad-miner-backend/internal/lockout"
+	"com.activehacks.ad-miner-backend/internal/logging"
+	"com.activehacks.ad-miner-backend/internal/metrics"
 	"com.activehacks.ad-miner-backend/internal/queue"
+	"com.activehacks.ad-miner-backend/internal/services"
 	"com.activehacks.ad-miner-backend/internal/smtp"
+	"com.activehacks.ad-miner-backend/internal/sso"
+	"com.activehacks.ad-miner-backend/internal/tracing"
 	"com.activehacks.ad-miner-backend/internal/version"
 
 	"github.com/lmittmann/tint"
@@ -29,6 +44,7 @@ func main() {
 }
 
 type config struct {
+	mode     string
 	baseURL  string
 	httpPort int
 	db       struct {
@@ -40,7 +56,87 @@ type config struct {
 		password string
 	}
 	jwt struct {
-		secretKey string
+		secretKey   string
+		keysDir     string
+		activeKeyID string
+	}
+	mfa struct {
+		enforced bool
+		issuer   string
+	}
+	passwordLogin struct {
+		enabled bool
+	}
+	admin struct {
+		email string
+	}
+	oidc struct {
+		enabled              bool
+		issuerURL            string
+		clientID             string
+		clientSecret         string
+		redirectURL          string
+		groupsClaim          string
+		adminGroups          []string
+		analystGroups        []string
+		requireVerifiedEmail bool
+		postLoginRedirectURL string
+	}
+	ldap struct {
+		enabled            bool
+		url                string
+		startTLS           bool
+		caCertFile         string
+		insecureSkipVerify bool
+		bindDN             string
+		bindPassword       string
+		baseDN             string
+		userFilter         string
+		emailAttribute     string
+		groupAttribute     string
+		groupBaseDN        string
+		groupFilter        string
+		adminGroups        []string
+		analystGroups      []string
+		localFallback      bool
+	}
+	worker struct {
+		shutdownGracePeriod time.Duration
+		reconcileInterval   time.Duration
+		resultSLA           time.Duration
+	}
+	schedule struct {
+		minInterval time.Duration
+	}
+	retention struct {
+		purgeInterval time.Duration
+		inputDays     int
+		reportDays    int
+		deleteResults bool
+		restoreWindow time.Duration
+	}
+	health struct {
+		timeout       time.Duration
+		cacheTTL      time.Duration
+		minFreeDiskMB int
+		checkStorage  bool
+	}
+	log struct {
+		format string
+		level  string
+	}
+	tracing struct {
+		exporter string
+	}
+	metrics struct {
+		listenAddr string
+		token      string
+	}
+	login struct {
+		maxAccountAttempts int
+		maxIPAttempts      int
+		window             time.Duration
+		lockoutDuration    time.Duration
 	}
 	smtp struct {
 		host     string
@@ -54,17 +150,44 @@ type config struct {
 type application struct {
 	config      config
 	db          *database.DB
+	directory   *directory.Authenticator
+	health      *health.Checker
+	keys        *jwtkeys.KeySet
+	limiter     *lockout.Limiter
 	logger      *slog.Logger
 	mailer      *smtp.Mailer
 	queueClient *queue.Client
+	queueAdmin  *queue.Inspector
+	relay       *queue.Relay
+	sso         *sso.Provider
 	wg          sync.WaitGroup
 }
 
+// Run modes. The API and the worker can be deployed separately so that task
+// processing runs on hosts with BloodHound and AD-miner installed, while the
+// API runs somewhere smaller.
+const (
+	modeAPI    = "api"
+	modeWorker = "worker"
+	modeAll    = "all"
+)
+
+// serviceName identifies this service in traces.
+const serviceName = "ad-miner-backend"
+
+// insecureJWTSecretKeys are secrets that have shipped in this repository as
+// defaults or examples and must never be used to sign tokens.
+var insecureJWTSecretKeys = []string{
+	"4jgnm2k4z7cf54gnyyudvqfqsd7cyeh3",
+	"SuperSecureJWTSecretKey@321",
+}
+
 func run(logger *slog.Logger) error {
 	// Handle loading environment variabled
 	envFile := flag.String("env", "", "path to environment file (required)")
 
 	showVersion := flag.Bool("version", false, "display version and exit")
+	mode := flag.String("mode", modeAll, "what to run: api, worker or all")
 	flag.Parse()
 
 	if *showVersion {
@@ -72,6 +195,10 @@ func run(logger *slog.Logger) error {
 		return nil
 	}
 
+	if !slices.Contains([]string{modeAPI, modeWorker, modeAll}, *mode) {
+		return fmt.Errorf("invalid mode %q, must be one of api, worker or all", *mode)
+	}
+
 	if *envFile == "" {
 		return fmt.Errorf("environment file path is required.")
 	}
@@ -82,52 +209,332 @@ func run(logger *slog.Logger) error {
 
 	var cfg config
 
+	cfg.mode = *mode
 	cfg.baseURL = env.GetString("BASE_URL", "http://localhost:6666")
 	cfg.httpPort = env.GetInt("HTTP_PORT", 6666)
 	cfg.db.dsn = env.GetString("DB_DSN", "user:pass@localhost:5432/db")
 	cfg.db.automigrate = env.GetBool("DB_AUTOMIGRATE", true)
 	cfg.redis.addr = env.GetString("REDIS_ADDR", "localhost:6379")
 	cfg.redis.password = env.GetString("REDIS_PASSWORD", "SuperSecure@123")
-	cfg.jwt.secretKey = env.GetString("JWT_SECRET_KEY", "4jgnm2k4z7cf54gnyyudvqfqsd7cyeh3")
+	cfg.jwt.secretKey = env.GetString("JWT_SECRET_KEY", "")
+	cfg.jwt.keysDir = env.GetString("JWT_KEYS_DIR", "")
+	cfg.jwt.activeKeyID = env.GetString("JWT_ACTIVE_KEY_ID", "")
+	cfg.mfa.enforced = env.GetBool("MFA_ENFORCED", false)
+	cfg.mfa.issuer = env.GetString("MFA_ISSUER", "ActiveHacks AD Miner")
+	cfg.passwordLogin.enabled = env.GetBool("PASSWORD_LOGIN_ENABLED", true)
+	cfg.admin.email = env.GetString("ADMIN_EMAIL", "")
+	cfg.oidc.enabled = env.GetBool("OIDC_ENABLED", false)
+	cfg.oidc.issuerURL = env.GetString("OIDC_ISSUER_URL", "")
+	cfg.oidc.clientID = env.GetString("OIDC_CLIENT_ID", "")
+	cfg.oidc.clientSecret = env.GetString("OIDC_CLIENT_SECRET", "")
+	cfg.oidc.redirectURL = env.GetString("OIDC_REDIRECT_URL", cfg.baseURL+"/oidc/callback")
+	cfg.oidc.groupsClaim = env.GetString("OIDC_GROUPS_CLAIM", "groups")
+	cfg.oidc.adminGroups = env.GetStringSlice("OIDC_ADMIN_GROUPS", nil)
+	cfg.oidc.analystGroups = env.GetStringSlice("OIDC_ANALYST_GROUPS", nil)
+	cfg.oidc.requireVerifiedEmail = env.GetBool("OIDC_REQUIRE_VERIFIED_EMAIL", true)
+	cfg.oidc.postLoginRedirectURL = env.GetString("OIDC_POST_LOGIN_REDIRECT_URL", "")
+	cfg.ldap.enabled = env.GetBool("LDAP_ENABLED", false)
+	cfg.ldap.url = env.GetString("LDAP_URL", "ldaps://localhost:636")
+	cfg.ldap.startTLS = env.GetBool("LDAP_START_TLS", false)
+	cfg.ldap.caCertFile = env.GetString("LDAP_CA_CERT_FILE", "")
+	cfg.ldap.insecureSkipVerify = env.GetBool("LDAP_INSECURE_SKIP_VERIFY", false)
+	cfg.ldap.bindDN = env.GetString("LDAP_BIND_DN", "")
+	cfg.ldap.bindPassword = env.GetString("LDAP_BIND_PASSWORD", "")
+	cfg.ldap.baseDN = env.GetString("LDAP_BASE_DN", "")
+	cfg.ldap.userFilter = env.GetString("LDAP_USER_FILTER", "(&(objectClass=user)(|(sAMAccountName={username})(userPrincipalName={username})(mail={username})))")
+	cfg.ldap.emailAttribute = env.GetString("LDAP_EMAIL_ATTRIBUTE", "mail")
+	cfg.ldap.groupAttribute = env.GetString("LDAP_GROUP_ATTRIBUTE", "memberOf")
+	cfg.ldap.groupBaseDN = env.GetString("LDAP_GROUP_BASE_DN", "")
+	cfg.ldap.groupFilter = env.GetString("LDAP_GROUP_FILTER", "")
+	cfg.ldap.adminGroups = splitDNs(env.GetString("LDAP_ADMIN_GROUPS", ""))
+	cfg.ldap.analystGroups = splitDNs(env.GetString("LDAP_ANALYST_GROUPS", ""))
+	cfg.ldap.localFallback = env.GetBool("LDAP_LOCAL_FALLBACK", true)
+	cfg.worker.shutdownGracePeriod = env.GetDuration("WORKER_SHUTDOWN_GRACE_PERIOD", 5*time.Minute)
+	cfg.worker.reconcileInterval = env.GetDuration("WORKER_RECONCILE_INTERVAL", 5*time.Minute)
+	cfg.worker.resultSLA = env.GetDuration("RESULT_SLA", 2*time.Hour)
+	cfg.schedule.minInterval = env.GetDuration("SCHEDULE_MIN_INTERVAL", time.Hour)
+	cfg.retention.purgeInterval = env.GetDuration("RETENTION_PURGE_INTERVAL", time.Hour)
+	cfg.retention.inputDays = env.GetInt("RETENTION_INPUT_DAYS", 0)
+	cfg.retention.reportDays = env.GetInt("RETENTION_REPORT_DAYS", 0)
+	cfg.retention.deleteResults = env.GetBool("RETENTION_DELETE_RESULTS", false)
+	cfg.retention.restoreWindow = env.GetDuration("RESULT_RESTORE_WINDOW", 7*24*time.Hour)
+	cfg.health.timeout = env.GetDuration("HEALTH_CHECK_TIMEOUT", 5*time.Second)
+	cfg.health.cacheTTL = env.GetDuration("HEALTH_CACHE_TTL", 10*time.Second)
+	cfg.health.minFreeDiskMB = env.GetInt("HEALTH_MIN_FREE_DISK_MB", 5120)
+	cfg.health.checkStorage = env.GetBool("HEALTH_CHECK_STORAGE", true)
+	cfg.log.format = env.GetString("LOG_FORMAT", logging.FormatText)
+	cfg.log.level = env.GetString("LOG_LEVEL", "debug")
+	cfg.tracing.exporter = env.GetString("TRACING_EXPORTER", tracing.ExporterNone)
+	cfg.metrics.listenAddr = env.GetString("METRICS_LISTEN_ADDR", "")
+	cfg.metrics.token = env.GetString("METRICS_TOKEN", "")
+	cfg.login.maxAccountAttempts = env.GetInt("LOGIN_MAX_ACCOUNT_ATTEMPTS", 5)
+	cfg.login.maxIPAttempts = env.GetInt("LOGIN_MAX_IP_ATTEMPTS", 50)
+	cfg.login.window = env.GetDuration("LOGIN_ATTEMPT_WINDOW", time.Hour)
+	cfg.login.lockoutDuration = env.GetDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
 	cfg.smtp.host = env.GetString("SMTP_HOST", "example.smtp.host")
 	cfg.smtp.port = env.GetInt("SMTP_PORT", 25)
 	cfg.smtp.username = env.GetString("SMTP_USERNAME", "example_username")
 	cfg.smtp.password = env.GetString("SMTP_PASSWORD", "pa55word")
 	cfg.smtp.from = env.GetString("SMTP_FROM", "Example Name <no_reply@example.org>")
 
+	err = analysis.CheckDefaults()
+	if err != nil {
+		return err
+	}
+
+	logger, err = logging.New(os.Stdout, cfg.log.format, cfg.log.level)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.tracing.exporter, serviceName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := shutdownTracing(ctx)
+		if err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+	}()
+
 	db, err := database.New(cfg.db.dsn, cfg.db.automigrate)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	queueClient := queue.NewClient(cfg.redis.addr, cfg.redis.password)
-	defer queueClient.Close()
+	queueInspector := queue.NewInspector(cfg.redis.addr, cfg.redis.password)
+	defer queueInspector.Close()
 
-	mailer, err := smtp.NewMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.from)
+	err = metrics.RegisterDB(db.DB.DB)
 	if err != nil {
 		return err
 	}
 
+	err = metrics.Registry.Register(queue.NewQueueCollector(queueInspector))
+	if err != nil {
+		return err
+	}
+
+	relay := queue.NewRelay(cfg.redis.addr, cfg.redis.password, db, logger)
+	relay.Start()
+	defer relay.Shutdown()
+
 	app := &application{
-		config:      cfg,
-		db:          db,
-		logger:      logger,
-		mailer:      mailer,
-		queueClient: queueClient,
-	}
-
-	// Start worker
-	go func() {
-		worker := queue.NewWorker(cfg.redis.addr, cfg.redis.password, logger)
-		handler := queue.NewTaskHandler(db)
-
-		logger.Info("Starting worker")
-		if err := worker.Start(handler, logger); err != nil {
-			logger.Error("Worker failed", "Error", err)
-			os.Exit(1)
+		config: cfg,
+		db:     db,
+		logger: logger,
+		relay:  relay,
+	}
+
+	var srv *http.Server
+	var worker *queue.Worker
+
+	if cfg.mode != modeWorker {
+		err = app.initAPI(queueInspector)
+		if err != nil {
+			return err
 		}
-	}()
+		defer app.closeAPI()
+
+		srv = app.newHTTPServer()
+	}
+
+	app.health = newHealthChecker(cfg, db, app.queueClient, queueInspector, logger)
+
+	if cfg.mode != modeAPI {
+		worker, err = app.startWorker()
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.serve(srv, worker)
+}
+
+// initAPI sets up the dependencies only needed to serve the HTTP API. None of
+// these are required, or validated, when running as a worker.
+func (app *application) initAPI(queueInspector *queue.Inspector) error {
+	cfg := app.config
+
+	keys, err := loadJWTKeys(cfg, app.logger)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.passwordLogin.enabled && !cfg.oidc.enabled {
+		return errors.New("at least one of PASSWORD_LOGIN_ENABLED or OIDC_ENABLED must be true")
+	}
+
+	err = app.seedAdmin()
+	if err != nil {
+		return err
+	}
+
+	mailer, err := smtp.NewMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.from)
+	if err != nil {
+		return err
+	}
+
+	if cfg.oidc.enabled {
+		app.sso, err = sso.NewProvider(cfg.redis.addr, cfg.redis.password, cfg.oidc.issuerURL, cfg.oidc.clientID, cfg.oidc.clientSecret, cfg.oidc.redirectURL, cfg.oidc.groupsClaim, cfg.oidc.adminGroups, cfg.oidc.analystGroups, cfg.oidc.requireVerifiedEmail)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ldap.enabled {
+		app.directory, err = directory.NewAuthenticator(directory.Config{
+			URL:                cfg.ldap.url,
+			StartTLS:           cfg.ldap.startTLS,
+			CACertFile:         cfg.ldap.caCertFile,
+			InsecureSkipVerify: cfg.ldap.insecureSkipVerify,
+			BindDN:             cfg.ldap.bindDN,
+			BindPassword:       cfg.ldap.bindPassword,
+			BaseDN:             cfg.ldap.baseDN,
+			UserFilter:         cfg.ldap.userFilter,
+			EmailAttribute:     cfg.ldap.emailAttribute,
+			GroupAttribute:     cfg.ldap.groupAttribute,
+			GroupBaseDN:        cfg.ldap.groupBaseDN,
+			GroupFilter:        cfg.ldap.groupFilter,
+			AdminGroups:        cfg.ldap.adminGroups,
+			AnalystGroups:      cfg.ldap.analystGroups,
+		})
+		if err != nil {
+			app.closeAPI()
+			return err
+		}
+	}
+
+	app.keys = keys
+	app.mailer = mailer
+	app.queueClient = queue.NewClient(cfg.redis.addr, cfg.redis.password)
+	app.queueAdmin = queueInspector
+	app.limiter = lockout.NewLimiter(cfg.redis.addr, cfg.redis.password, cfg.login.maxAccountAttempts, cfg.login.maxIPAttempts, cfg.login.window, cfg.login.lockoutDuration)
+
+	return nil
+}
+
+// seedAdmin gives the local ADMIN_EMAIL account the admin role while nobody
+// has it, so that a fresh install has someone who can manage users and
+// schedules. Once there is an admin it does nothing, so an account that was
+// demoted stays demoted.
+func (app *application) seedAdmin() error {
+	if app.config.admin.email == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	exists, err := app.db.AdminExists(ctx)
+	if err != nil || exists {
+		return err
+	}
+
+	promoted, err := app.db.SeedAdmin(ctx, app.config.admin.email)
+	if err != nil {
+		return err
+	}
+
+	if promoted {
+		app.logger.Info("gave the admin role to the configured account", "email", app.config.admin.email)
+	} else {
+		app.logger.Warn("no local account has the configured admin email, nobody is an admin", "email", app.config.admin.email)
+	}
+
+	return nil
+}
+
+func (app *application) closeAPI() {
+	if app.queueClient != nil {
+		app.queueClient.Close()
+	}
+	if app.limiter != nil {
+		app.limiter.Close()
+	}
+	if app.sso != nil {
+		app.sso.Close()
+	}
+}
+
+// newHealthChecker returns the readiness checks of what this process runs.
+// The API depends on the database and redis; the worker on the host tools,
+// scratch space and storage it runs analyses with. Whether any worker is
+// alive is reported by the API without gating its readiness, since the API
+// can still serve requests and queue work while the workers are down.
+func newHealthChecker(cfg config, db *database.DB, queueClient *queue.Client, queueInspector *queue.Inspector, logger *slog.Logger) *health.Checker {
+	var checks []health.Check
+
+	if cfg.mode != modeWorker {
+		checks = append(checks,
+			health.Check{Name: "database", Fn: func(ctx context.Context) error {
+				err := db.PingContext(ctx)
+				if err != nil {
+					return err
+				}
+				return db.CheckMigrations(ctx)
+			}},
+			health.Check{Name: "redis", Fn: func(ctx context.Context) error {
+				return queueClient.Ping()
+			}},
+			health.Check{Name: "worker", Informational: true, Fn: func(ctx context.Context) error {
+				return queueInspector.CheckWorkerHeartbeat()
+			}},
+		)
+	}
+
+	if cfg.mode != modeAPI {
+		s3Svc := services.NewS3Service(logger)
+		bloodhoundSvc, bloodhoundErr := services.NewBloodhoundRunner(logger)
+		adminerSvc := services.NewADMinerService(logger)
+
+		checks = append(checks,
+			health.Check{Name: "bloodhound", Fn: func(ctx context.Context) error {
+				if bloodhoundErr != nil {
+					return bloodhoundErr
+				}
+				return bloodhoundSvc.Check(ctx)
+			}},
+			health.Check{Name: "adminer", Fn: adminerSvc.Check},
+			health.Check{Name: "disk", Fn: func(ctx context.Context) error {
+				return s3Svc.CheckFreeSpace(ctx, uint64(cfg.health.minFreeDiskMB)<<20)
+			}},
+		)
+
+		if cfg.health.checkStorage {
+			checks = append(checks, health.Check{Name: "storage", Fn: s3Svc.Check})
+		}
+	}
+
+	return health.NewChecker(cfg.health.timeout, cfg.health.cacheTTL, checks...)
+}
+
+// loadJWTKeys returns the keys tokens are signed and verified with. Without
+// JWT_KEYS_DIR tokens are signed with the HS256 secret, which every API host
+// has to share and which can't be published for other services to verify
+// tokens with, so that is only meant for development.
+func loadJWTKeys(cfg config, logger *slog.Logger) (*jwtkeys.KeySet, error) {
+	if slices.Contains(insecureJWTSecretKeys, cfg.jwt.secretKey) {
+		return nil, errors.New("JWT_SECRET_KEY is set to a built-in default value, refusing to start")
+	}
+
+	if cfg.jwt.keysDir != "" {
+		if cfg.jwt.activeKeyID == "" {
+			return nil, errors.New("JWT_ACTIVE_KEY_ID is required when JWT_KEYS_DIR is set")
+		}
+
+		return jwtkeys.Load(cfg.jwt.keysDir, cfg.jwt.activeKeyID, cfg.jwt.secretKey)
+	}
+
+	if cfg.jwt.secretKey == "" {
+		return nil, errors.New("either JWT_KEYS_DIR or JWT_SECRET_KEY must be set")
+	}
+
+	logger.Warn("JWT_KEYS_DIR is not set, signing tokens with the shared HS256 JWT_SECRET_KEY; this is only meant for development, set JWT_KEYS_DIR and JWT_ACTIVE_KEY_ID in production")
 
-	return app.serveHTTP()
+	return jwtkeys.NewHMAC(cfg.jwt.secretKey), nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -8,9 +9,12 @@ import (
 	"strings"
 	"time"
 
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/metrics"
 	"com.activehacks.ad-miner-backend/internal/response"
 
-	"github.com/pascaldekloe/jwt"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/tomasen/realip"
 )
 
@@ -27,8 +31,27 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requestID tags the request with an ID, taken from the X-Request-ID header if
+// the caller (usually a proxy) sent a sensible one and generated otherwise. The
+// ID is echoed back in the response and attached to every log line for the
+// request.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+
+		next.ServeHTTP(w, contextSetRequestID(r, requestID))
+	})
+}
+
 func (app *application) logAccess(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
 		mw := response.NewMetricsResponseWriter(w)
 		next.ServeHTTP(mw, r)
 
@@ -41,9 +64,9 @@ func (app *application) logAccess(next http.Handler) http.Handler {
 
 		userAttrs := slog.Group("user", "ip", ip)
 		requestAttrs := slog.Group("request", "method", method, "url", url, "proto", proto)
-		responseAttrs := slog.Group("repsonse", "status", mw.StatusCode, "size", mw.BytesCount)
+		responseAttrs := slog.Group("repsonse", "status", mw.StatusCode, "size", mw.BytesCount, "duration", time.Since(start).String())
 
-		app.logger.Info("access", userAttrs, requestAttrs, responseAttrs)
+		app.logger.InfoContext(r.Context(), "access", userAttrs, requestAttrs, responseAttrs)
 	})
 }
 
@@ -59,34 +82,18 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			if len(headerParts) == 2 && headerParts[0] == "Bearer" {
 				token := headerParts[1]
 
-				claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secretKey))
+				userID, valid, err := app.checkToken(token, app.config.baseURL)
 				if err != nil {
-					app.invalidAuthenticationToken(w, r)
-					return
-				}
-
-				if !claims.Valid(time.Now()) {
-					app.invalidAuthenticationToken(w, r)
-					return
-				}
-
-				if claims.Issuer != app.config.baseURL {
-					app.invalidAuthenticationToken(w, r)
+					app.serverError(w, r, err)
 					return
 				}
 
-				if !claims.AcceptAudience(app.config.baseURL) {
+				if !valid {
 					app.invalidAuthenticationToken(w, r)
 					return
 				}
 
-				userID, err := strconv.Atoi(claims.Subject)
-				if err != nil {
-					app.serverError(w, r, err)
-					return
-				}
-
-				user, found, err := app.db.GetUser(userID)
+				user, found, err := app.db.GetUser(r.Context(), userID)
 				if err != nil {
 					app.serverError(w, r, err)
 					return
@@ -114,3 +121,51 @@ func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := contextGetAuthenticatedUser(r)
+
+		if user.Role != database.RoleAdmin {
+			app.notPermitted(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		mw := response.NewMetricsResponseWriter(w)
+		next.ServeHTTP(mw, r)
+
+		// chi fills in the matched pattern while routing, so it is only
+		// available once the request has been served. Using the pattern
+		// rather than the raw path keeps label cardinality bounded.
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := strconv.Itoa(mw.StatusCode)
+
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, status).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (app *application) requireMetricsToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := "Bearer " + app.config.metrics.token
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			app.invalidAuthenticationToken(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"net/http"
 
+	"com.activehacks.ad-miner-backend/internal/metrics"
+
 	"github.com/go-chi/chi/v5"
+	"github.com/riandyrn/otelchi"
 )
 
 func (app *application) routes() http.Handler {
@@ -12,24 +15,89 @@ func (app *application) routes() http.Handler {
 	mux.NotFound(app.notFound)
 	mux.MethodNotAllowed(app.methodNotAllowed)
 
+	mux.Use(app.requestID)
+	mux.Use(otelchi.Middleware(serviceName, otelchi.WithChiRoutes(mux)))
 	mux.Use(app.logAccess)
+	mux.Use(app.recordMetrics)
 	mux.Use(app.recoverPanic)
 	mux.Use(app.authenticate)
 
 	mux.Get("/status", app.statusHandler)
+	mux.Get("/healthz", app.healthzHandler)
+	mux.Get("/readyz", app.readyzHandler)
+	mux.Get("/.well-known/jwks.json", app.jwksHandler)
 	// User registration disabled due to security implications
 	// mux.Post("/users", app.createUserHandler)
 	mux.Post("/authentication-tokens", app.createAuthenticationTokenHandler)
+	mux.Post("/authentication-tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	mux.Post("/authentication-tokens/mfa/enrollment", app.createMFAEnrollmentWithTokenHandler)
+
+	if app.sso != nil {
+		mux.Get("/oidc/login", app.oidcLoginHandler)
+		mux.Get("/oidc/callback", app.oidcCallbackHandler)
+	}
 
 	mux.Group(func(mux chi.Router) {
 		mux.Use(app.requireAuthenticatedUser)
 
 		mux.Get("/protected", app.protectedTestHandler)
 
+		mux.Get("/me", app.readAuthenticatedUserHandler)
+		mux.Put("/me/password", app.updateAuthenticatedUserPasswordHandler)
+		mux.Post("/me/mfa", app.createMFAEnrollmentHandler)
+		mux.Post("/me/mfa/verification", app.verifyMFAEnrollmentHandler)
+		mux.Post("/me/mfa/recovery-codes", app.regenerateRecoveryCodesHandler)
+		mux.Delete("/me/mfa", app.deleteMFAHandler)
+
 		// Bloodhound data processing
 		mux.Get("/results/{id}", app.readResultHandler)
+		mux.Get("/results/{id}/history", app.readResultHistoryHandler)
 		mux.Post("/results", app.processResultHandler)
+
+		mux.Get("/schedules", app.listSchedulesHandler)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireAdmin)
+
+			mux.Delete("/users/{id}/lockout", app.deleteUserLockoutHandler)
+			mux.Put("/users/{id}/external-identity", app.updateUserExternalIdentityHandler)
+
+			mux.Get("/audit-events", app.listAuditEventsHandler)
+			mux.Get("/audit-events/export", app.exportAuditEventsHandler)
+
+			mux.Get("/queue", app.readQueueHandler)
+			mux.Post("/queue/pause", app.pauseQueueHandler)
+			mux.Post("/queue/unpause", app.unpauseQueueHandler)
+			mux.Get("/queue/tasks", app.listQueueTasksHandler)
+			mux.Delete("/queue/tasks/{id}", app.deleteQueueTaskHandler)
+			mux.Post("/queue/tasks/{id}/run", app.runQueueTaskHandler)
+			mux.Post("/queue/archived/run", app.runArchivedQueueTasksHandler)
+
+			mux.Post("/schedules", app.createScheduleHandler)
+			mux.Delete("/schedules/{id}", app.deleteScheduleHandler)
+
+			mux.Get("/retention-policies", app.listRetentionPoliciesHandler)
+			mux.Put("/retention-policies", app.updateRetentionPolicyHandler)
+			mux.Delete("/retention-policies", app.deleteRetentionPolicyHandler)
+			mux.Get("/analysis-defaults", app.listAnalysisDefaultsHandler)
+			mux.Put("/analysis-defaults", app.updateAnalysisDefaultsHandler)
+			mux.Delete("/analysis-defaults", app.deleteAnalysisDefaultsHandler)
+			mux.Delete("/results/{id}", app.deleteResultHandler)
+			mux.Post("/results/{id}/restore", app.restoreResultHandler)
+			mux.Put("/results/{id}/legal-hold", app.updateResultLegalHoldHandler)
+		})
 	})
 
+	// A metrics token exposes /metrics on the main listener. It is matched
+	// ahead of the router so the bearer token isn't mistaken for a JWT by
+	// the authenticate middleware.
+	if app.config.metrics.token != "" && app.config.metrics.listenAddr == "" {
+		root := http.NewServeMux()
+		root.Handle("GET /metrics", app.requireMetricsToken(metrics.Handler()))
+		root.Handle("/", mux)
+
+		return root
+	}
+
 	return mux
 }
@@ -10,6 +10,10 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"com.activehacks.ad-miner-backend/internal/metrics"
+	"com.activehacks.ad-miner-backend/internal/queue"
+	"com.activehacks.ad-miner-backend/internal/services"
 )
 
 const (
@@ -17,10 +21,80 @@ const (
 	defaultReadTimeout    = 5 * time.Second
 	defaultWriteTimeout   = 10 * time.Second
 	defaultShutdownPeriod = 30 * time.Second
+	exportWriteTimeout    = 5 * time.Minute
 )
 
-func (app *application) serveHTTP() error {
-	srv := &http.Server{
+// serve runs the HTTP API and/or the task worker, whichever are given, until
+// the process is signalled to stop, and then shuts them down in order:
+//
+//  1. the worker stops fetching new tasks, so nothing new starts while the
+//     rest of the process winds down;
+//  2. the HTTP server stops accepting connections and drains open requests;
+//  3. in-flight tasks get the worker's grace period to finish, after which
+//     they are interrupted, requeued and cleaned up;
+//  4. the metrics listener goes last, so the drain can still be observed.
+func (app *application) serve(srv *http.Server, worker *queue.Worker) error {
+	metricsSrv := app.startMetricsServer()
+
+	serveErrorChan := make(chan error, 1)
+
+	if srv != nil {
+		go func() {
+			app.logger.Info("starting server", slog.Group("server", "addr", srv.Addr))
+
+			err := srv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				serveErrorChan <- err
+			}
+		}()
+	}
+
+	quitChan := make(chan os.Signal, 1)
+	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
+
+	var serveErr error
+
+	select {
+	case sig := <-quitChan:
+		app.logger.Info("shutting down", "signal", sig.String())
+	case serveErr = <-serveErrorChan:
+		app.logger.Error("server failed, shutting down", "error", serveErr)
+	}
+
+	if worker != nil {
+		worker.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
+	defer cancel()
+
+	var shutdownErr error
+
+	if srv != nil {
+		shutdownErr = srv.Shutdown(ctx)
+		app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
+	}
+
+	if worker != nil {
+		worker.Shutdown()
+		app.logger.Info("stopped worker")
+	}
+
+	if metricsSrv != nil {
+		// The worker's grace period may well have outlasted ctx.
+		metricsCtx, metricsCancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
+		defer metricsCancel()
+
+		metricsSrv.Shutdown(metricsCtx)
+	}
+
+	app.wg.Wait()
+
+	return errors.Join(serveErr, shutdownErr)
+}
+
+func (app *application) newHTTPServer() *http.Server {
+	return &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.httpPort),
 		Handler:      app.routes(),
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelWarn),
@@ -28,34 +102,97 @@ func (app *application) serveHTTP() error {
 		ReadTimeout:  defaultReadTimeout,
 		WriteTimeout: defaultWriteTimeout,
 	}
+}
 
-	shutdownErrorChan := make(chan error)
+// startWorker checks that the tools the pipeline shells out to are installed,
+// so a misconfigured worker host fails at startup rather than on its first
+// task, and then starts processing tasks in the background.
+func (app *application) startWorker() (*queue.Worker, error) {
+	bloodhoundSvc, err := services.NewBloodhoundRunner(app.logger)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		quitChan := make(chan os.Signal, 1)
-		signal.Notify(quitChan, syscall.SIGINT, syscall.SIGTERM)
-		<-quitChan
+	handler := queue.NewTaskHandler(app.db, services.NewS3Service(app.logger), bloodhoundSvc, services.NewADMinerService(app.logger), app.logger)
+
+	err = handler.Check(context.Background())
+	if err != nil {
+		return nil, err
+	}
 
-		ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
-		defer cancel()
+	if app.config.worker.reconcileInterval <= 0 {
+		return nil, errors.New("WORKER_RECONCILE_INTERVAL must be positive")
+	}
 
-		shutdownErrorChan <- srv.Shutdown(ctx)
-	}()
+	if app.config.retention.purgeInterval < 0 || app.config.retention.inputDays < 0 || app.config.retention.reportDays < 0 || app.config.retention.restoreWindow < 0 {
+		return nil, errors.New("RETENTION_PURGE_INTERVAL, RETENTION_INPUT_DAYS, RETENTION_REPORT_DAYS and RESULT_RESTORE_WINDOW must not be negative")
+	}
 
-	app.logger.Info("starting server", slog.Group("server", "addr", srv.Addr))
+	retention := queue.RetentionConfig{
+		Interval:      app.config.retention.purgeInterval,
+		InputDays:     app.config.retention.inputDays,
+		ReportDays:    app.config.retention.reportDays,
+		DeleteResults: app.config.retention.deleteResults,
+		RestoreWindow: app.config.retention.restoreWindow,
+	}
 
-	err := srv.ListenAndServe()
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+	scheduler, err := queue.NewScheduler(app.config.redis.addr, app.config.redis.password, app.db, app.config.worker.reconcileInterval, app.config.worker.resultSLA, retention, app.logger)
+	if err != nil {
+		return nil, err
 	}
 
-	err = <-shutdownErrorChan
+	worker := queue.NewWorker(app.config.redis.addr, app.config.redis.password, app.config.worker.shutdownGracePeriod, app.logger)
+
+	err = worker.Start(handler, scheduler, app.logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
+	return worker, nil
+}
 
-	app.wg.Wait()
-	return nil
+func (app *application) startMetricsServer() *http.Server {
+	if app.config.metrics.listenAddr == "" {
+		return nil
+	}
+
+	metricsSrv := &http.Server{
+		Addr:         app.config.metrics.listenAddr,
+		Handler:      app.metricsHandler(),
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelWarn),
+		IdleTimeout:  defaultIdleTimeout,
+		ReadTimeout:  defaultReadTimeout,
+		WriteTimeout: defaultWriteTimeout,
+	}
+
+	go func() {
+		app.logger.Info("starting metrics server", slog.Group("server", "addr", metricsSrv.Addr))
+
+		err := metricsSrv.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.logger.Error("metrics server failed", "error", err)
+		}
+	}()
+
+	return metricsSrv
+}
+
+// metricsHandler serves /metrics on the dedicated metrics listener. The token
+// is still enforced if one is configured. A worker has no other listener, so
+// its readiness probe is served here too.
+func (app *application) metricsHandler() http.Handler {
+	var handler http.Handler = metrics.Handler()
+
+	if app.config.metrics.token != "" {
+		handler = app.requireMetricsToken(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", handler)
+
+	if app.config.mode == modeWorker {
+		mux.HandleFunc("GET /readyz", app.readyzHandler)
+	}
+
+	return mux
 }
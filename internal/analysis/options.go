@@ -0,0 +1,184 @@
+// Package analysis describes how an AD-miner analysis is run. It is shared by
+// the API, which accepts options, the database, which stores them with each
+// result, and the worker, which turns them into AD-miner flags.
+package analysis
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"com.activehacks.ad-miner-backend/internal/env"
+)
+
+// Options tunes an AD-miner run. Each option maps onto one AD-miner flag, and
+// only these flags can be passed, so a submission can't point AD-miner at
+// another database or at files on the worker. An unset option leaves
+// AD-miner's own default in place.
+//
+// Spreading queries over a Neo4j cluster is configured on the worker with
+// ADMINER_CLUSTER rather than here, since the worker's Neo4j credentials are
+// sent to every node.
+//
+// Individual controls can't be turned off per run: AD-miner has no flag for
+// it, only its package-wide configuration, which every run on a worker
+// shares.
+type Options struct {
+	// Cache makes AD-miner keep the results of its Neo4j queries on disk and
+	// reuse them when a query is repeated (-c).
+	Cache *bool `json:"Cache,omitempty"`
+
+	// Level is how many hops path queries follow (--level).
+	Level *int `json:"Level,omitempty"`
+
+	// RDP includes CanRDP edges in the paths AD-miner draws (--rdp).
+	RDP *bool `json:"Rdp,omitempty"`
+
+	// GPOLow uses a faster but incomplete query for GPOs (--gpo_low).
+	GPOLow *bool `json:"Gpo_low,omitempty"`
+
+	// RenewalPasswordDays is the password renewal policy that passwords are
+	// checked against (-r).
+	RenewalPasswordDays *int `json:"Renewal_password_days,omitempty"`
+
+	// EvolutionRuns is how many of the organization's previous runs are
+	// passed to AD-miner to show its evolution over them (--evolution).
+	// Zero turns evolution off.
+	EvolutionRuns *int `json:"Evolution_runs,omitempty"`
+}
+
+// Bounds on the numeric options.
+const (
+	MinLevel               = 1
+	MaxLevel               = 20
+	MinRenewalPasswordDays = 1
+	MaxRenewalPasswordDays = 3650
+	MaxEvolutionRuns       = 20
+)
+
+const defaultEvolutionRuns = 5
+
+// Defaults are the options used where neither the submission nor the
+// organization sets one. RDP was always enabled before options could be set,
+// so it stays on.
+//
+// ADMINER_EVOLUTION_RUNS is checked by CheckDefaults at startup; should it
+// not be a number, the built-in default is used.
+func Defaults() Options {
+	rdp := true
+
+	evolutionRuns, err := evolutionRunsFromEnv()
+	if err != nil {
+		evolutionRuns = defaultEvolutionRuns
+	}
+
+	return Options{RDP: &rdp, EvolutionRuns: &evolutionRuns}
+}
+
+// CheckDefaults reports whether the defaults configured in the environment
+// are valid. A bad default would fail every analysis that doesn't set its
+// own.
+func CheckDefaults() error {
+	_, err := evolutionRunsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	_, err = Defaults().Args()
+	if err != nil {
+		return fmt.Errorf("ADMINER_EVOLUTION_RUNS must be between 0 and %d: %w", MaxEvolutionRuns, err)
+	}
+
+	return nil
+}
+
+func evolutionRunsFromEnv() (int, error) {
+	value := env.GetString("ADMINER_EVOLUTION_RUNS", strconv.Itoa(defaultEvolutionRuns))
+
+	runs, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("ADMINER_EVOLUTION_RUNS must be a number: %w", err)
+	}
+
+	return runs, nil
+}
+
+// WithDefaults returns o with any unset option taken from defaults.
+func (o Options) WithDefaults(defaults Options) Options {
+	if o.Cache == nil {
+		o.Cache = defaults.Cache
+	}
+	if o.Level == nil {
+		o.Level = defaults.Level
+	}
+	if o.RDP == nil {
+		o.RDP = defaults.RDP
+	}
+	if o.GPOLow == nil {
+		o.GPOLow = defaults.GPOLow
+	}
+	if o.RenewalPasswordDays == nil {
+		o.RenewalPasswordDays = defaults.RenewalPasswordDays
+	}
+	if o.EvolutionRuns == nil {
+		o.EvolutionRuns = defaults.EvolutionRuns
+	}
+	return o
+}
+
+// Args returns the AD-miner flags for the options that are set. Options are
+// validated when they are submitted, but the values are checked again here
+// since they come back out of the queue and the database.
+//
+// EvolutionRuns has no flag of its own: the worker fetches that many runs
+// and passes --evolution if it finds any.
+func (o Options) Args() ([]string, error) {
+	var args []string
+
+	if o.Cache != nil && *o.Cache {
+		args = append(args, "-c")
+	}
+
+	if o.Level != nil {
+		if *o.Level < MinLevel || *o.Level > MaxLevel {
+			return nil, fmt.Errorf("invalid analysis level %d", *o.Level)
+		}
+		args = append(args, "--level", strconv.Itoa(*o.Level))
+	}
+
+	if o.RDP != nil && *o.RDP {
+		args = append(args, "--rdp")
+	}
+
+	if o.GPOLow != nil && *o.GPOLow {
+		args = append(args, "--gpo_low")
+	}
+
+	if o.RenewalPasswordDays != nil {
+		if *o.RenewalPasswordDays < MinRenewalPasswordDays || *o.RenewalPasswordDays > MaxRenewalPasswordDays {
+			return nil, fmt.Errorf("invalid password renewal policy %d", *o.RenewalPasswordDays)
+		}
+		args = append(args, "-r", strconv.Itoa(*o.RenewalPasswordDays))
+	}
+
+	if o.EvolutionRuns != nil && (*o.EvolutionRuns < 0 || *o.EvolutionRuns > MaxEvolutionRuns) {
+		return nil, fmt.Errorf("invalid number of evolution runs %d", *o.EvolutionRuns)
+	}
+
+	return args, nil
+}
+
+func (o Options) Value() (driver.Value, error) {
+	return json.Marshal(o)
+}
+
+func (o *Options) Scan(src any) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("analysis options must be a byte slice")
+	}
+
+	return json.Unmarshal(b, o)
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+)
+
+// AnalysisDefaults are the AD-miner options an organization's analyses run
+// with unless a submission sets them.
+type AnalysisDefaults struct {
+	OrgName   string           `db:"org_name"`
+	Options   analysis.Options `db:"options"`
+	UpdatedBy NullInt64        `db:"updated_by"`
+	CreatedAt time.Time        `db:"created_at"`
+	UpdatedAt time.Time        `db:"updated_at"`
+}
+
+func (db *DB) UpsertAnalysisDefaults(ctx context.Context, defaults AnalysisDefaults) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO analysis_defaults (org_name, options, updated_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (org_name) DO UPDATE SET
+			options = EXCLUDED.options,
+			updated_by = EXCLUDED.updated_by`
+
+	_, err := db.ExecContext(ctx, query, defaults.OrgName, defaults.Options, defaults.UpdatedBy)
+	return err
+}
+
+func (db *DB) GetAllAnalysisDefaults(ctx context.Context) ([]AnalysisDefaults, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	defaults := []AnalysisDefaults{}
+	query := `SELECT * FROM analysis_defaults ORDER BY org_name`
+
+	err := db.SelectContext(ctx, &defaults, query)
+	return defaults, err
+}
+
+func (db *DB) GetAnalysisDefaults(ctx context.Context, orgName string) (AnalysisDefaults, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var defaults AnalysisDefaults
+	query := `SELECT * FROM analysis_defaults WHERE org_name = $1`
+
+	err := db.GetContext(ctx, &defaults, query, orgName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AnalysisDefaults{}, false, nil
+	}
+	return defaults, true, err
+}
+
+func (db *DB) DeleteAnalysisDefaults(ctx context.Context, orgName string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `DELETE FROM analysis_defaults WHERE org_name = $1`
+
+	res, err := db.ExecContext(ctx, query, orgName)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EffectiveAnalysisOptions returns the options an analysis of orgName's
+// collection runs with: opts, then the organization's defaults, then the
+// built-in defaults.
+func (db *DB) EffectiveAnalysisOptions(ctx context.Context, orgName string, opts analysis.Options) (analysis.Options, error) {
+	defaults, _, err := db.GetAnalysisDefaults(ctx, orgName)
+	if err != nil {
+		return analysis.Options{}, err
+	}
+
+	return opts.WithDefaults(defaults.Options).WithDefaults(analysis.Defaults()), nil
+}
+
+func (db *DB) SetResultEvolutionData(ctx context.Context, id int, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE results SET evolution_data_path = $1 WHERE id = $2`
+
+	_, err := db.ExecContext(ctx, query, path, id)
+	return err
+}
+
+// EvolutionArchive is the archived data file of a previous run.
+type EvolutionArchive struct {
+	ResultID int    `db:"id"`
+	Path     string `db:"evolution_data_path"`
+}
+
+// GetEvolutionArchives returns the archived data files of up to limit of
+// orgName's runs before resultID, newest first. Runs that were deleted, or
+// whose reports have been purged, are left out.
+func (db *DB) GetEvolutionArchives(ctx context.Context, orgName string, resultID, limit int) ([]EvolutionArchive, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	archives := []EvolutionArchive{}
+	query := `
+		SELECT id, evolution_data_path FROM results
+		WHERE org_name = $1
+			AND id < $2
+			AND status = $3
+			AND evolution_data_path IS NOT NULL
+			AND report_purged_at IS NULL
+			AND deleted_at IS NULL
+		ORDER BY id DESC
+		LIMIT $4`
+
+	err := db.SelectContext(ctx, &archives, query, orgName, resultID, StatusSucceeded, limit)
+	return archives, err
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type AuditEvent struct {
+	ID         int64         `db:"id"`
+	Created    time.Time     `db:"created"`
+	ActorID    NullInt64     `db:"actor_id"`
+	Actor      string        `db:"actor"`
+	IP         NullString    `db:"ip"`
+	Action     string        `db:"action"`
+	TargetType NullString    `db:"target_type"`
+	TargetID   NullString    `db:"target_id"`
+	Metadata   AuditMetadata `db:"metadata"`
+}
+
+// Audit action constants for type safety
+const (
+	AuditLoginSucceeded        = "login.succeeded"
+	AuditLoginPasswordVerified = "login.password_verified"
+	AuditLoginFailed           = "login.failed"
+	AuditLoginLocked           = "login.locked"
+	AuditLoginIPLocked         = "login.ip_locked"
+	AuditLoginSuspicious       = "login.suspicious"
+	AuditLoginUnlocked         = "login.unlocked"
+
+	AuditTokenCreated = "token.created"
+
+	AuditUserPasswordChanged        = "user.password_changed"
+	AuditUserMFAEnrollmentStarted   = "user.mfa_enrollment_started"
+	AuditUserMFAEnabled             = "user.mfa_enabled"
+	AuditUserMFADisabled            = "user.mfa_disabled"
+	AuditUserRecoveryCodesReplaced  = "user.recovery_codes_replaced"
+	AuditUserExternalIdentityLinked = "user.external_identity_linked"
+
+	AuditResultCreated = "result.created"
+	AuditResultViewed  = "result.viewed"
+	AuditResultRetried = "result.retried"
+
+	AuditResultInterrupted = "result.interrupted"
+	AuditResultReconciled  = "result.reconciled"
+	AuditResultSLAExceeded = "result.sla_exceeded"
+
+	AuditResultLegalHoldSet      = "result.legal_hold_set"
+	AuditResultLegalHoldReleased = "result.legal_hold_released"
+	AuditResultPurged            = "result.purged"
+	AuditResultDeleted           = "result.deleted"
+	AuditResultRestored          = "result.restored"
+	AuditResultHardDeleted       = "result.hard_deleted"
+
+	AuditRetentionPolicyUpdated           = "retention_policy.updated"
+	AuditRetentionPolicyDeleted           = "retention_policy.deleted"
+	AuditRetentionPolicyLegalHoldSet      = "retention_policy.legal_hold_set"
+	AuditRetentionPolicyLegalHoldReleased = "retention_policy.legal_hold_released"
+
+	AuditAnalysisDefaultsUpdated = "analysis_defaults.updated"
+	AuditAnalysisDefaultsDeleted = "analysis_defaults.deleted"
+
+	AuditScheduleCreated = "schedule.created"
+	AuditScheduleDeleted = "schedule.deleted"
+
+	AuditQueuePaused          = "queue.paused"
+	AuditQueueUnpaused        = "queue.unpaused"
+	AuditQueueTaskDeleted     = "queue.task_deleted"
+	AuditQueueTaskRun         = "queue.task_run"
+	AuditQueueArchivedRequeue = "queue.archived_requeued"
+	AuditQueueTaskArchived    = "queue.task_archived"
+)
+
+type AuditEventFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      sql.NullTime
+	Until      sql.NullTime
+	Limit      int
+	Offset     int
+}
+
+const auditEventFilterClause = `
+	WHERE ($1 = 0 OR actor_id = $1)
+	AND ($2 = '' OR action = $2)
+	AND ($3 = '' OR target_type = $3)
+	AND ($4 = '' OR target_id = $4)
+	AND ($5::timestamptz IS NULL OR created >= $5)
+	AND ($6::timestamptz IS NULL OR created < $6)`
+
+const exportTimeout = 5 * time.Minute
+
+type AuditMetadata map[string]any
+
+func (m AuditMetadata) Value() (driver.Value, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(m)
+}
+
+func (m *AuditMetadata) Scan(src any) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return errors.New("audit metadata must be a byte slice")
+	}
+
+	return json.Unmarshal(b, m)
+}
+
+func (db *DB) InsertAuditEvent(ctx context.Context, event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO audit_events (actor_id, actor, ip, action, target_type, target_id, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := db.ExecContext(ctx, query, event.ActorID, event.Actor, event.IP, event.Action, event.TargetType, event.TargetID, event.Metadata)
+	return err
+}
+
+func (db *DB) GetAuditEvents(ctx context.Context, filter AuditEventFilter) ([]AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	events := []AuditEvent{}
+
+	query := `SELECT * FROM audit_events` + auditEventFilterClause + `
+		ORDER BY id DESC
+		LIMIT $7 OFFSET $8`
+
+	err := db.SelectContext(ctx, &events, query, filter.ActorID, filter.Action, filter.TargetType, filter.TargetID, filter.Since, filter.Until, filter.Limit, filter.Offset)
+	return events, err
+}
+
+// StreamAuditEvents calls fn for every event matching the filter in
+// chronological order, without holding the full result set in memory. The
+// filter's Limit and Offset are ignored.
+func (db *DB) StreamAuditEvents(ctx context.Context, filter AuditEventFilter, fn func(AuditEvent) error) error {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	query := `SELECT * FROM audit_events` + auditEventFilterClause + `
+		ORDER BY id ASC`
+
+	rows, err := db.QueryxContext(ctx, query, filter.ActorID, filter.Action, filter.TargetType, filter.TargetID, filter.Since, filter.Until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err = rows.StructScan(&event)
+		if err != nil {
+			return err
+		}
+
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -2,14 +2,19 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"io/fs"
 	"time"
 
 	"com.activehacks.ad-miner-backend/assets"
 
+	"github.com/XSAM/otelsql"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jmoiron/sqlx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/lib/pq"
@@ -25,11 +30,27 @@ func New(dsn string, automigrate bool) (*DB, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancel()
 
-	db, err := sqlx.ConnectContext(ctx, "postgres", "postgres://"+dsn)
+	// Wrapping the driver gives every query a span under the caller's trace,
+	// as long as the caller passes its context through.
+	sqlDB, err := otelsql.Open("postgres", "postgres://"+dsn,
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+		}),
+	)
 	if err != nil {
 		return nil, err
 	}
 
+	db := sqlx.NewDb(sqlDB, "postgres")
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	db.SetMaxOpenConns(25)
 	db.SetMaxIdleConns(25)
 	db.SetConnMaxIdleTime(5 * time.Minute)
@@ -57,3 +78,63 @@ func New(dsn string, automigrate bool) (*DB, error) {
 
 	return &DB{db}, nil
 }
+
+// CheckMigrations reports an error unless the schema is clean and at the
+// latest version embedded in the binary.
+func (db *DB) CheckMigrations(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var current struct {
+		Version uint `db:"version"`
+		Dirty   bool `db:"dirty"`
+	}
+
+	err := db.GetContext(ctx, &current, `SELECT version, dirty FROM schema_migrations LIMIT 1`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("no migrations have been applied")
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.Dirty {
+		return fmt.Errorf("migration %d is dirty", current.Version)
+	}
+
+	latest, err := latestMigrationVersion()
+	if err != nil {
+		return err
+	}
+
+	if current.Version != latest {
+		return fmt.Errorf("schema is at version %d, expected %d", current.Version, latest)
+	}
+
+	return nil
+}
+
+func latestMigrationVersion() (uint, error) {
+	source, err := iofs.New(assets.EmbeddedFiles, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		version = next
+	}
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+)
+
+// NullString, NullInt64 and NullTime are the sql.Null types of columns that
+// are returned by the API. They are stored and read the same way, but are
+// marshalled to JSON as their value, or null, rather than as a struct.
+type (
+	NullString sql.NullString
+	NullInt64  sql.NullInt64
+	NullTime   sql.NullTime
+)
+
+func (n *NullString) Scan(src any) error {
+	return (*sql.NullString)(n).Scan(src)
+}
+
+func (n NullString) Value() (driver.Value, error) {
+	return sql.NullString(n).Value()
+}
+
+func (n NullString) MarshalJSON() ([]byte, error) {
+	if !n.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(n.String)
+}
+
+func (n *NullInt64) Scan(src any) error {
+	return (*sql.NullInt64)(n).Scan(src)
+}
+
+func (n NullInt64) Value() (driver.Value, error) {
+	return sql.NullInt64(n).Value()
+}
+
+func (n NullInt64) MarshalJSON() ([]byte, error) {
+	if !n.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(n.Int64)
+}
+
+func (n *NullTime) Scan(src any) error {
+	return (*sql.NullTime)(n).Scan(src)
+}
+
+func (n NullTime) Value() (driver.Value, error) {
+	return sql.NullTime(n).Value()
+}
+
+func (n NullTime) MarshalJSON() ([]byte, error) {
+	if !n.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(n.Time)
+}
@@ -0,0 +1,266 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+
+	"github.com/lib/pq"
+)
+
+// IdempotencyKeyTTL is how long a client-supplied Idempotency-Key is
+// remembered. A key reused after that starts a new request.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+const outboxTimeout = 30 * time.Second
+
+var (
+	ErrDuplicateSimulationID   = errors.New("simulation ID already exists")
+	ErrDuplicateIdempotencyKey = errors.New("idempotency key already exists")
+)
+
+// OutboxMessage is a task written in the same transaction as the rows it
+// refers to, and published to the queue afterwards by the relay.
+type OutboxMessage struct {
+	ID          int64          `db:"id"`
+	ResultID    sql.NullInt64  `db:"result_id"`
+	TaskID      string         `db:"task_id"`
+	TaskType    string         `db:"task_type"`
+	Payload     []byte         `db:"payload"`
+	CreatedAt   time.Time      `db:"created_at"`
+	PublishedAt sql.NullTime   `db:"published_at"`
+	Attempts    int            `db:"attempts"`
+	LastError   sql.NullString `db:"last_error"`
+
+	// NextAttemptAt is when the message is next due to be published.
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+
+	// DeadLetteredAt is set once the relay gives up on the message.
+	DeadLetteredAt sql.NullTime `db:"dead_lettered_at"`
+}
+
+// NewResult describes a result to create along with the task that processes
+// it. The task ID is chosen up front so that it can be stored on the result
+// before the task is published.
+type NewResult struct {
+	SimulationID string
+	OrgName      string
+	S3BucketPath string
+	TaskID       string
+	TaskType     string
+
+	// InputPath, if set, is where the result's SharpHound collection is read
+	// from when it isn't under S3BucketPath, as for scheduled results.
+	InputPath string
+
+	// AnalysisOptions are the effective options the analysis runs with.
+	AnalysisOptions analysis.Options
+
+	// Actor is recorded as having queued the result in its status history.
+	Actor string
+
+	// Payload builds the task payload once the result's ID is known.
+	Payload func(resultID int) ([]byte, error)
+
+	// ScheduleInput, if set, is claimed for its schedule along with the
+	// result. The result isn't created if the input has already been
+	// claimed.
+	ScheduleInput *ScheduleInput
+}
+
+type IdempotencyKey struct {
+	UserID      int    `db:"user_id"`
+	Key         string `db:"key"`
+	RequestHash string `db:"request_hash"`
+	ResultID    int    `db:"result_id"`
+}
+
+// InsertResultWithTask creates a queued result and queues its task in the
+// outbox in a single transaction, so that either both exist or neither does.
+// If key is not nil it is recorded against the new result.
+func (db *DB) InsertResultWithTask(ctx context.Context, result NewResult, key *IdempotencyKey) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if result.ScheduleInput != nil {
+		err = claimScheduleInput(ctx, tx, *result.ScheduleInput)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var id int
+	query := `
+		INSERT INTO results (simulation_id, org_name, s3_bucket_path, input_path, task_id, status, analysis_options)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)
+		RETURNING id`
+
+	err = tx.GetContext(ctx, &id, query, result.SimulationID, result.OrgName, result.S3BucketPath, result.InputPath, result.TaskID, StatusQueued, result.AnalysisOptions)
+	if err != nil {
+		if isUniqueViolation(err, "results_simulation_id_key") {
+			return 0, ErrDuplicateSimulationID
+		}
+		return 0, err
+	}
+
+	err = insertResultStatusChange(ctx, tx, id, sql.NullString{}, StatusQueued, result.Actor, "created")
+	if err != nil {
+		return 0, err
+	}
+
+	payload, err := result.Payload(id)
+	if err != nil {
+		return 0, err
+	}
+
+	query = `
+		INSERT INTO outbox (result_id, task_id, task_type, payload)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, id, result.TaskID, result.TaskType, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	if result.ScheduleInput != nil {
+		err = updateScheduleLastResult(ctx, tx, result.ScheduleInput.ScheduleID, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if key != nil {
+		// An expired key is free to be used again.
+		query = `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND created_at < $3`
+
+		_, err = tx.ExecContext(ctx, query, key.UserID, key.Key, time.Now().Add(-IdempotencyKeyTTL))
+		if err != nil {
+			return 0, err
+		}
+
+		query = `
+			INSERT INTO idempotency_keys (user_id, key, request_hash, result_id)
+			VALUES ($1, $2, $3, $4)`
+
+		_, err = tx.ExecContext(ctx, query, key.UserID, key.Key, key.RequestHash, id)
+		if err != nil {
+			if isUniqueViolation(err, "idempotency_keys_pkey") {
+				return 0, ErrDuplicateIdempotencyKey
+			}
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+func (db *DB) GetIdempotencyKey(ctx context.Context, userID int, key string) (IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var idempotencyKey IdempotencyKey
+	query := `
+		SELECT user_id, key, request_hash, result_id FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND created_at >= $3`
+
+	err := db.GetContext(ctx, &idempotencyKey, query, userID, key, time.Now().Add(-IdempotencyKeyTTL))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, false, nil
+	}
+	return idempotencyKey, true, err
+}
+
+// ClaimOutboxMessages claims up to limit messages that are due to be
+// published, oldest first, and counts the attempt. A claimed message isn't
+// due again until lease has passed, so several relays can run at once
+// without publishing the same message twice, and a message claimed by a
+// relay that died is picked up by another once its lease runs out.
+//
+// The claim is committed before the messages are returned, so no
+// transaction is held open while they are published.
+func (db *DB) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, outboxTimeout)
+	defer cancel()
+
+	var messages []OutboxMessage
+	query := `
+		UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE published_at IS NULL AND dead_lettered_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`
+
+	err := db.SelectContext(ctx, &messages, query, time.Now().Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(messages, func(a, b OutboxMessage) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return messages, nil
+}
+
+func (db *DB) MarkOutboxMessagePublished(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE outbox SET published_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1`
+	_, err := db.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkOutboxMessageFailed records a failed attempt to publish a message and
+// either sets when it is next due or, if deadLetter is true, gives up on it.
+// A dead-lettered message is never published; the reconciler fails its
+// result.
+func (db *DB) MarkOutboxMessageFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time, deadLetter bool) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE outbox SET
+			last_error = $1,
+			next_attempt_at = $2,
+			dead_lettered_at = CASE WHEN $3 THEN CURRENT_TIMESTAMP END
+		WHERE id = $4`
+
+	_, err := db.ExecContext(ctx, query, lastError, nextAttemptAt, deadLetter, id)
+	return err
+}
+
+// DeleteExpiredOutboxData removes messages published or dead-lettered before
+// olderThan and idempotency keys that have expired.
+func (db *DB) DeleteExpiredOutboxData(ctx context.Context, olderThan time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1 OR dead_lettered_at < $1`, olderThan)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, time.Now().Add(-IdempotencyKeyTTL))
+	return err
+}
+
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
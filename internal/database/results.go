@@ -4,52 +4,147 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"slices"
 	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type Result struct {
-	ID           int          `db:"id"`
-	SimulationID string       `db:"simulation_id"`
-	TaskID       string       `db:"task_id"`
-	OrgName      string       `db:"org_name"`
-	Status       string       `db:"status"`
-	StartTime    sql.NullTime `db:"start_time"`
-	EndTime      sql.NullTime `db:"end_time"`
-	CreatedAt    time.Time    `db:"created_at"`
-	UpdatedAt    time.Time    `db:"updated_at"`
-}
-
-// Status constants for type safety
+	ID             int          `db:"id"`
+	SimulationID   string       `db:"simulation_id"`
+	TaskID         string       `db:"task_id"`
+	OrgName        string       `db:"org_name"`
+	Status         string       `db:"status"`
+	StartTime      sql.NullTime `db:"start_time"`
+	EndTime        sql.NullTime `db:"end_time"`
+	CreatedAt      time.Time    `db:"created_at"`
+	UpdatedAt      time.Time    `db:"updated_at"`
+	S3BucketPath   NullString   `db:"s3_bucket_path"`
+	InputPath      NullString   `db:"input_path"`
+	SLAExceededAt  NullTime     `db:"sla_exceeded_at"`
+	ErrorCode      NullString   `db:"error_code"`
+	ErrorStep      NullString   `db:"error_step"`
+	ErrorMessage   NullString   `db:"error_message"`
+	LegalHold      bool         `db:"legal_hold"`
+	InputPurgedAt  NullTime     `db:"input_purged_at"`
+	ReportPurgedAt NullTime     `db:"report_purged_at"`
+	DeletedAt      NullTime     `db:"deleted_at"`
+	DeletedBy      NullInt64    `db:"deleted_by"`
+
+	// AnalysisOptions are the options the analysis ran with, after the
+	// organization's and the built-in defaults were applied.
+	AnalysisOptions analysis.Options `db:"analysis_options"`
+
+	// EvolutionDataPath is where the run's AD-miner data file was archived
+	// for later runs to show the organization's evolution.
+	EvolutionDataPath NullString `db:"evolution_data_path"`
+
+	// PurgeAttempts counts the retention purge's failed attempts on the
+	// result since it last succeeded; it isn't tried again until
+	// PurgeRetryAt.
+	PurgeAttempts  int            `db:"purge_attempts" json:"-"`
+	PurgeRetryAt   sql.NullTime   `db:"purge_retry_at" json:"-"`
+	PurgeLastError sql.NullString `db:"purge_last_error" json:"-"`
+}
+
+// Result statuses. A result is queued until a worker picks up its task, and
+// goes back to queued if the worker is stopped mid-run. A failed run is
+// retrying while its task has retries left.
 const (
-	StatusPending    = "pending"
-	StatusProcessing = "processing"
-	StatusFailed     = "failed"
-	StatusSuccess    = "success"
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusRetrying  = "retrying"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+	StatusExpired   = "expired"
 )
 
-func (db *DB) InsertResult(simulationID, orgName, status string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-	defer cancel()
+// legacyResultStatuses maps the statuses results had before the lifecycle
+// was introduced onto the current ones. Results were migrated, but callers
+// may still filter by the old names.
+var legacyResultStatuses = map[string]string{
+	"pending":    StatusQueued,
+	"processing": StatusRunning,
+	"success":    StatusSucceeded,
+}
 
-	var id int
-	query := `
-		INSERT INTO results (simulation_id, org_name, status)
-		VALUES ($1, $2, $3)
-		RETURNING id`
+// NormalizeResultStatus returns the current name of a status that may have
+// been given by its name from before the lifecycle was introduced.
+func NormalizeResultStatus(status string) string {
+	if current, ok := legacyResultStatuses[status]; ok {
+		return current
+	}
+	return status
+}
 
-	err := db.GetContext(ctx, &id, query, simulationID, orgName, status)
-	if err != nil {
-		return 0, err
+// resultTransitions lists the statuses a result may move to from each status.
+// Finished results only move on to expired, once retention purges their
+// reports. A result cancelled by being deleted is queued again by
+// RestoreResult rather than through a transition.
+var resultTransitions = map[string][]string{
+	StatusQueued:    {StatusRunning, StatusFailed, StatusCancelled, StatusExpired},
+	StatusRunning:   {StatusSucceeded, StatusFailed, StatusRetrying, StatusQueued, StatusCancelled},
+	StatusRetrying:  {StatusRunning, StatusFailed, StatusCancelled, StatusExpired},
+	StatusSucceeded: {StatusExpired},
+	StatusFailed:    {StatusExpired},
+	StatusCancelled: {StatusExpired},
+}
+
+// ReasonResultDeleted is recorded as the reason for cancelling a result that
+// was deleted before it finished.
+const ReasonResultDeleted = "result deleted"
+
+var (
+	ErrIllegalTransition    = errors.New("illegal result status transition")
+	ErrTransitionConflict   = errors.New("result status changed concurrently")
+	ErrRestoreWindowElapsed = errors.New("result restore window has elapsed")
+)
+
+// CanTransitionResult reports whether a result may move from one status to
+// another.
+func CanTransitionResult(from, to string) bool {
+	return slices.Contains(resultTransitions[from], to)
+}
+
+// ResultStatusFinal reports whether a result in the given status is finished
+// and can't change any more.
+func ResultStatusFinal(status string) bool {
+	switch status {
+	case StatusQueued, StatusRunning, StatusRetrying:
+		return false
 	}
-	return id, nil
+	return true
+}
+
+// ResultFailure describes why a run failed: a machine-readable code, the
+// pipeline step that failed, if any, and a human-readable message.
+type ResultFailure struct {
+	Code    string
+	Step    string
+	Message string
+}
+
+type ResultStatusChange struct {
+	ID         int64      `db:"id"`
+	ResultID   int        `db:"result_id"`
+	FromStatus NullString `db:"from_status"`
+	ToStatus   string     `db:"to_status"`
+	Actor      string     `db:"actor"`
+	Reason     string     `db:"reason"`
+	CreatedAt  time.Time  `db:"created_at"`
 }
 
-func (db *DB) GetResult(id int) (Result, bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetResult(ctx context.Context, id int) (Result, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var result Result
-	query := `SELECT * FROM results WHERE id = $1`
+	query := `SELECT * FROM results WHERE id = $1 AND deleted_at IS NULL`
 
 	err := db.GetContext(ctx, &result, query, id)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -58,12 +153,12 @@ func (db *DB) GetResult(id int) (Result, bool, error) {
 	return result, true, err
 }
 
-func (db *DB) GetResultBySimulationID(simulationID string) (Result, bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetResultBySimulationID(ctx context.Context, simulationID string) (Result, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var result Result
-	query := `SELECT * FROM results WHERE simulation_id = $1`
+	query := `SELECT * FROM results WHERE simulation_id = $1 AND deleted_at IS NULL`
 
 	err := db.GetContext(ctx, &result, query, simulationID)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -72,30 +167,70 @@ func (db *DB) GetResultBySimulationID(simulationID string) (Result, bool, error)
 	return result, true, err
 }
 
-func (db *DB) GetResultsByOrgName(orgName string) ([]Result, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetResultsByOrgName(ctx context.Context, orgName string) ([]Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var results []Result
-	query := `SELECT * FROM results WHERE org_name = $1 ORDER BY created_at DESC`
+	query := `SELECT * FROM results WHERE org_name = $1 AND deleted_at IS NULL ORDER BY created_at DESC`
 
 	err := db.SelectContext(ctx, &results, query, orgName)
 	return results, err
 }
 
-func (db *DB) GetResultsByStatus(status string) ([]Result, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// GetResultsByStatus returns the results in status, which may be given by its
+// name from before the lifecycle was introduced.
+func (db *DB) GetResultsByStatus(ctx context.Context, status string) ([]Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var results []Result
+	query := `SELECT * FROM results WHERE status = $1 AND deleted_at IS NULL ORDER BY created_at DESC`
+
+	err := db.SelectContext(ctx, &results, query, NormalizeResultStatus(status))
+	return results, err
+}
+
+// GetUnfinishedResults returns the results that haven't reached a final
+// status, oldest first. Results whose task is still waiting in the outbox
+// are left out, as their task isn't expected to be in the queue yet. Those
+// whose task was dead-lettered are included, and so are failed as their task
+// is missing from the queue.
+func (db *DB) GetUnfinishedResults(ctx context.Context) ([]Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var results []Result
-	query := `SELECT * FROM results WHERE status = $1 ORDER BY created_at DESC`
+	query := `
+		SELECT * FROM results
+		WHERE status IN ($1, $2, $3)
+		AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM outbox WHERE outbox.result_id = results.id AND outbox.published_at IS NULL AND outbox.dead_lettered_at IS NULL)
+		ORDER BY created_at`
 
-	err := db.SelectContext(ctx, &results, query, status)
+	err := db.SelectContext(ctx, &results, query, StatusQueued, StatusRunning, StatusRetrying)
 	return results, err
 }
 
-func (db *DB) UpdateResultTaskID(id int, taskID string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// FlagResultSLAExceeded marks a result as having run past its SLA. It reports
+// false if the result had already been flagged.
+func (db *DB) FlagResultSLAExceeded(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE results SET sla_exceeded_at = CURRENT_TIMESTAMP WHERE id = $1 AND sla_exceeded_at IS NULL`
+
+	res, err := db.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (db *DB) UpdateResultTaskID(ctx context.Context, id int, taskID string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `UPDATE results SET task_id = $1 WHERE id = $2`
@@ -103,44 +238,256 @@ func (db *DB) UpdateResultTaskID(id int, taskID string) error {
 	return err
 }
 
-func (db *DB) UpdateResultStatus(id int, status string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// TransitionResultStatus moves a result from one status to another and
+// records the change in its history. It returns ErrIllegalTransition if the
+// lifecycle doesn't allow the move, and ErrTransitionConflict if the result is
+// no longer in the from status.
+//
+// Starting a run sets the start time; going back to queued clears the run's
+// times; reaching a final status sets the end time. Succeeding clears any
+// failure recorded by an earlier attempt.
+func (db *DB) TransitionResultStatus(ctx context.Context, id int, from, to, actor, reason string) error {
+	return db.transitionResultStatus(ctx, id, from, to, actor, reason, nil)
+}
+
+// FailResultStatus is like TransitionResultStatus, for a transition caused by
+// a failure, and records the failure on the result.
+func (db *DB) FailResultStatus(ctx context.Context, id int, from, to, actor string, failure ResultFailure) error {
+	return db.transitionResultStatus(ctx, id, from, to, actor, failure.Message, &failure)
+}
+
+func (db *DB) transitionResultStatus(ctx context.Context, id int, from, to, actor, reason string, failure *ResultFailure) error {
+	if !CanTransitionResult(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrIllegalTransition, from, to)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	query := `UPDATE results SET status = $1 WHERE id = $2`
-	_, err := db.ExecContext(ctx, query, status, id)
-	return err
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current struct {
+		Status    string       `db:"status"`
+		StartTime sql.NullTime `db:"start_time"`
+		EndTime   sql.NullTime `db:"end_time"`
+	}
+
+	query := `SELECT status, start_time, end_time FROM results WHERE id = $1 FOR UPDATE`
+
+	err = tx.GetContext(ctx, &current, query, id)
+	if err != nil {
+		return err
+	}
+
+	if current.Status != from {
+		return ErrTransitionConflict
+	}
+
+	startTime, endTime := current.StartTime, current.EndTime
+	now := time.Now()
+
+	switch {
+	case to == StatusRunning:
+		startTime = sql.NullTime{Time: now, Valid: true}
+		endTime = sql.NullTime{}
+	case to == StatusQueued:
+		startTime = sql.NullTime{}
+		endTime = sql.NullTime{}
+	case ResultStatusFinal(to) && !endTime.Valid:
+		endTime = sql.NullTime{Time: now, Valid: true}
+	}
+
+	query = `UPDATE results SET status = $1, start_time = $2, end_time = $3 WHERE id = $4`
+
+	_, err = tx.ExecContext(ctx, query, to, startTime, endTime, id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case failure != nil:
+		query = `UPDATE results SET error_code = $1, error_step = NULLIF($2, ''), error_message = $3 WHERE id = $4`
+		_, err = tx.ExecContext(ctx, query, failure.Code, failure.Step, failure.Message, id)
+	case to == StatusSucceeded:
+		query = `UPDATE results SET error_code = NULL, error_step = NULL, error_message = NULL WHERE id = $1`
+		_, err = tx.ExecContext(ctx, query, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = insertResultStatusChange(ctx, tx, id, sql.NullString{String: from, Valid: true}, to, actor, reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (db *DB) UpdateResultStartTime(id int, startTime time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetResultStatusHistory(ctx context.Context, resultID int) ([]ResultStatusChange, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	query := `UPDATE results SET start_time = $1 WHERE id = $2`
-	_, err := db.ExecContext(ctx, query, startTime, id)
+	history := []ResultStatusChange{}
+	query := `SELECT * FROM result_status_history WHERE result_id = $1 ORDER BY id`
+
+	err := db.SelectContext(ctx, &history, query, resultID)
+	return history, err
+}
+
+func insertResultStatusChange(ctx context.Context, tx *sqlx.Tx, resultID int, from sql.NullString, to, actor, reason string) error {
+	query := `
+		INSERT INTO result_status_history (result_id, from_status, to_status, actor, reason)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := tx.ExecContext(ctx, query, resultID, from, to, actor, reason)
 	return err
 }
 
-func (db *DB) UpdateResultEndTime(id int, endTime time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// SoftDeleteResult hides a result from everything but RestoreResult until it
+// is deleted for good. It reports false if the result doesn't exist or has
+// already been deleted.
+func (db *DB) SoftDeleteResult(ctx context.Context, id, deletedBy int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	query := `UPDATE results SET end_time = $1 WHERE id = $2`
-	_, err := db.ExecContext(ctx, query, endTime, id)
-	return err
+	query := `
+		UPDATE results SET deleted_at = CURRENT_TIMESTAMP, deleted_by = NULLIF($1, 0)
+		WHERE id = $2 AND deleted_at IS NULL`
+
+	res, err := db.ExecContext(ctx, query, deletedBy, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
-func (db *DB) UpdateResultStatusWithTimes(id int, status string, startTime, endTime *time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// ResultRestore describes a deleted result to restore. Deleting an unfinished
+// result cancels it, so a result whose last status change was that
+// cancellation is queued again, with a new task, when it is restored.
+type ResultRestore struct {
+	ID int
+
+	// DeletedAfter is when the restore window opened. A result deleted
+	// before it may already be being purged and can't be restored.
+	DeletedAfter time.Time
+
+	// Actor is recorded as having queued the result again.
+	Actor    string
+	TaskID   string
+	TaskType string
+
+	// Payload builds the task payload for a result that is queued again.
+	Payload func(result Result) ([]byte, error)
+}
+
+// RestoreResult undoes SoftDeleteResult. It reports false if the result
+// doesn't exist or isn't deleted, and returns ErrRestoreWindowElapsed if it
+// was deleted before the restore window opened.
+func (db *DB) RestoreResult(ctx context.Context, restore ResultRestore) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	query := `UPDATE results SET status = $1, start_time = $2, end_time = $3 WHERE id = $4`
-	_, err := db.ExecContext(ctx, query, status, startTime, endTime, id)
-	return err
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var result Result
+	query := `SELECT * FROM results WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE`
+
+	err = tx.GetContext(ctx, &result, query, restore.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if result.DeletedAt.Time.Before(restore.DeletedAfter) {
+		return false, ErrRestoreWindowElapsed
+	}
+
+	query = `UPDATE results SET deleted_at = NULL, deleted_by = NULL WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, result.ID)
+	if err != nil {
+		return false, err
+	}
+
+	var last ResultStatusChange
+	query = `SELECT * FROM result_status_history WHERE result_id = $1 ORDER BY id DESC LIMIT 1`
+
+	err = tx.GetContext(ctx, &last, query, result.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	cancelledByDelete := result.Status == StatusCancelled && last.ToStatus == StatusCancelled && last.Reason == ReasonResultDeleted
+	if !cancelledByDelete {
+		return true, tx.Commit()
+	}
+
+	query = `UPDATE results SET status = $1, task_id = $2, start_time = NULL, end_time = NULL WHERE id = $3`
+
+	_, err = tx.ExecContext(ctx, query, StatusQueued, restore.TaskID, result.ID)
+	if err != nil {
+		return false, err
+	}
+
+	err = insertResultStatusChange(ctx, tx, result.ID, sql.NullString{String: StatusCancelled, Valid: true}, StatusQueued, restore.Actor, "result restored")
+	if err != nil {
+		return false, err
+	}
+
+	payload, err := restore.Payload(result)
+	if err != nil {
+		return false, err
+	}
+
+	query = `
+		INSERT INTO outbox (result_id, task_id, task_type, payload)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, result.ID, restore.TaskID, restore.TaskType, payload)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetResultsDeletedBefore returns up to limit soft-deleted results, oldest
+// first, that were deleted before cutoff. Results on legal hold, or belonging
+// to an organization on legal hold, are left out.
+func (db *DB) GetResultsDeletedBefore(ctx context.Context, cutoff time.Time, limit int) ([]Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var results []Result
+	query := `
+		SELECT results.* FROM results
+		LEFT JOIN retention_policies policy ON policy.org_name = results.org_name
+		WHERE results.deleted_at < $1
+		AND NOT results.legal_hold
+		AND NOT COALESCE(policy.legal_hold, FALSE)
+		AND (results.purge_retry_at IS NULL OR results.purge_retry_at <= CURRENT_TIMESTAMP)
+		ORDER BY results.deleted_at
+		LIMIT $2`
+
+	err := db.SelectContext(ctx, &results, query, cutoff, limit)
+	return results, err
 }
 
-func (db *DB) DeleteResult(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) DeleteResult(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `DELETE FROM results WHERE id = $1`
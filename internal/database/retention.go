@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Artifacts kept in storage for each result, which are retained separately:
+// the SharpHound collection a run analysed and the reports it rendered.
+const (
+	ArtifactInput  = "input"
+	ArtifactReport = "report"
+)
+
+// RetentionPolicy overrides the global retention periods for an
+// organization's results. A nil period falls back to the global one, and a
+// period of zero keeps artifacts forever. While LegalHold is set nothing of
+// the organization's is purged.
+type RetentionPolicy struct {
+	OrgName             string    `db:"org_name"`
+	InputRetentionDays  NullInt64 `db:"input_retention_days"`
+	ReportRetentionDays NullInt64 `db:"report_retention_days"`
+	LegalHold           bool      `db:"legal_hold"`
+	UpdatedBy           NullInt64 `db:"updated_by"`
+	CreatedAt           time.Time `db:"created_at"`
+	UpdatedAt           time.Time `db:"updated_at"`
+}
+
+// RetentionPolicyUpdate sets an organization's retention policy. A null
+// LegalHold keeps the policy's current hold, or no hold for a new policy.
+type RetentionPolicyUpdate struct {
+	OrgName             string
+	InputRetentionDays  sql.NullInt64
+	ReportRetentionDays sql.NullInt64
+	LegalHold           sql.NullBool
+	UpdatedBy           sql.NullInt64
+}
+
+// UpsertRetentionPolicy creates or replaces an organization's retention
+// policy. It returns whether the organization was on legal hold before and
+// after the update.
+func (db *DB) UpsertRetentionPolicy(ctx context.Context, update RetentionPolicyUpdate) (heldBefore, heldAfter bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var hold struct {
+		Before bool `db:"before"`
+		After  bool `db:"after"`
+	}
+
+	query := `
+		WITH previous AS (
+			SELECT legal_hold FROM retention_policies WHERE org_name = $1 FOR UPDATE
+		)
+		INSERT INTO retention_policies (org_name, input_retention_days, report_retention_days, legal_hold, updated_by)
+		VALUES ($1, $2, $3, COALESCE($4, FALSE), $5)
+		ON CONFLICT (org_name) DO UPDATE SET
+			input_retention_days = EXCLUDED.input_retention_days,
+			report_retention_days = EXCLUDED.report_retention_days,
+			legal_hold = COALESCE($4, retention_policies.legal_hold),
+			updated_by = EXCLUDED.updated_by
+		RETURNING COALESCE((SELECT legal_hold FROM previous), FALSE) AS before, legal_hold AS after`
+
+	err = db.GetContext(ctx, &hold, query, update.OrgName, update.InputRetentionDays, update.ReportRetentionDays, update.LegalHold, update.UpdatedBy)
+	return hold.Before, hold.After, err
+}
+
+func (db *DB) GetRetentionPolicies(ctx context.Context) ([]RetentionPolicy, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	policies := []RetentionPolicy{}
+	query := `SELECT * FROM retention_policies ORDER BY org_name`
+
+	err := db.SelectContext(ctx, &policies, query)
+	return policies, err
+}
+
+func (db *DB) GetRetentionPolicy(ctx context.Context, orgName string) (RetentionPolicy, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var policy RetentionPolicy
+	query := `SELECT * FROM retention_policies WHERE org_name = $1`
+
+	err := db.GetContext(ctx, &policy, query, orgName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RetentionPolicy{}, false, nil
+	}
+	return policy, true, err
+}
+
+// DeleteRetentionPolicy deletes an organization's retention policy and
+// returns it, so that a legal hold it released can be recorded.
+func (db *DB) DeleteRetentionPolicy(ctx context.Context, orgName string) (RetentionPolicy, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var policy RetentionPolicy
+	query := `DELETE FROM retention_policies WHERE org_name = $1 RETURNING *`
+
+	err := db.GetContext(ctx, &policy, query, orgName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RetentionPolicy{}, false, nil
+	}
+	return policy, true, err
+}
+
+// SetResultLegalHold places a legal hold on a result, or releases it. It
+// reports false if the result doesn't exist.
+func (db *DB) SetResultLegalHold(ctx context.Context, id int, hold bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE results SET legal_hold = $1 WHERE id = $2`
+
+	res, err := db.ExecContext(ctx, query, hold, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetResultsDueForPurge returns up to limit finished results, oldest first,
+// whose artifact has outlived its organization's retention period, or
+// defaultDays where the organization has no period of its own. Results on
+// legal hold, or belonging to an organization on legal hold, are left out, as
+// are deleted results, which are purged separately, and results whose last
+// purge failed until they are due to be retried.
+func (db *DB) GetResultsDueForPurge(ctx context.Context, artifact string, defaultDays, limit int) ([]Result, error) {
+	var retentionColumn, purgedColumn string
+	var statuses []string
+
+	switch artifact {
+	case ArtifactInput:
+		retentionColumn, purgedColumn = "input_retention_days", "input_purged_at"
+		statuses = []string{StatusSucceeded, StatusFailed, StatusCancelled, StatusExpired}
+	case ArtifactReport:
+		retentionColumn, purgedColumn = "report_retention_days", "report_purged_at"
+		statuses = []string{StatusSucceeded, StatusFailed, StatusCancelled}
+	default:
+		return nil, fmt.Errorf("unknown artifact %q", artifact)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var results []Result
+	query := fmt.Sprintf(`
+		SELECT results.* FROM results
+		LEFT JOIN retention_policies policy ON policy.org_name = results.org_name
+		WHERE results.status = ANY($1)
+		AND results.%[2]s IS NULL
+		AND results.deleted_at IS NULL
+		AND NOT results.legal_hold
+		AND NOT COALESCE(policy.legal_hold, FALSE)
+		AND (results.purge_retry_at IS NULL OR results.purge_retry_at <= CURRENT_TIMESTAMP)
+		AND COALESCE(policy.%[1]s, $2) > 0
+		AND COALESCE(results.end_time, results.created_at) < CURRENT_TIMESTAMP - make_interval(days => COALESCE(policy.%[1]s, $2))
+		ORDER BY results.id
+		LIMIT $3`, retentionColumn, purgedColumn)
+
+	err := db.SelectContext(ctx, &results, query, pq.Array(statuses), defaultDays, limit)
+	return results, err
+}
+
+// MarkResultArtifactPurged records that a result's artifact has been deleted
+// from storage, and clears any earlier failures to purge it.
+func (db *DB) MarkResultArtifactPurged(ctx context.Context, id int, artifact string) error {
+	var purgedColumn string
+
+	switch artifact {
+	case ArtifactInput:
+		purgedColumn = "input_purged_at"
+	case ArtifactReport:
+		purgedColumn = "report_purged_at"
+	default:
+		return fmt.Errorf("unknown artifact %q", artifact)
+	}
+
+	query := fmt.Sprintf(`
+		UPDATE results SET
+			%s = CURRENT_TIMESTAMP,
+			purge_attempts = 0,
+			purge_retry_at = NULL,
+			purge_last_error = NULL
+		WHERE id = $1`, purgedColumn)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, query, id)
+	return err
+}
+
+// RecordResultPurgeFailure records a failed attempt to purge a result, which
+// the purge leaves alone until retryAt.
+func (db *DB) RecordResultPurgeFailure(ctx context.Context, id int, purgeErr string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE results SET
+			purge_attempts = purge_attempts + 1,
+			purge_retry_at = $1,
+			purge_last_error = $2
+		WHERE id = $3`
+
+	_, err := db.ExecContext(ctx, query, retryAt, purgeErr, id)
+	return err
+}
+
+// OrgHasLaterResult reports whether the organization has a result created
+// after result id. A later run replaces the artifacts of earlier ones in the
+// organization's working directory.
+func (db *DB) OrgHasLaterResult(ctx context.Context, id int, orgName string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var exists bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM results WHERE id > $1 AND org_name = $2)`
+
+	err := db.GetContext(ctx, &exists, query, id, orgName)
+	return exists, err
+}
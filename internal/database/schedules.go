@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrScheduleInputClaimed = errors.New("schedule input already claimed")
+
+type Schedule struct {
+	ID            int        `db:"id"`
+	OrgName       string     `db:"org_name"`
+	SimulationID  string     `db:"simulation_id"`
+	CronSpec      string     `db:"cron_spec"`
+	CreatedBy     NullInt64  `db:"created_by"`
+	LastFiredAt   NullTime   `db:"last_fired_at"`
+	NextFireAt    NullTime   `db:"next_fire_at"`
+	LastInputETag NullString `db:"last_input_etag"`
+	LastResultID  NullInt64  `db:"last_result_id"`
+	CreatedAt     time.Time  `db:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at"`
+}
+
+func (db *DB) InsertSchedule(ctx context.Context, orgName, simulationID, cronSpec string, createdBy int, nextFireAt time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var id int
+	query := `
+		INSERT INTO schedules (org_name, simulation_id, cron_spec, created_by, next_fire_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5)
+		RETURNING id`
+
+	err := db.GetContext(ctx, &id, query, orgName, simulationID, cronSpec, createdBy, nextFireAt)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (db *DB) GetSchedule(ctx context.Context, id int) (Schedule, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var schedule Schedule
+	query := `SELECT * FROM schedules WHERE id = $1`
+
+	err := db.GetContext(ctx, &schedule, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Schedule{}, false, nil
+	}
+	return schedule, true, err
+}
+
+func (db *DB) GetSchedules(ctx context.Context) ([]Schedule, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	schedules := []Schedule{}
+	query := `SELECT * FROM schedules ORDER BY id`
+
+	err := db.SelectContext(ctx, &schedules, query)
+	return schedules, err
+}
+
+func (db *DB) DeleteSchedule(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `DELETE FROM schedules WHERE id = $1`
+
+	res, err := db.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateScheduleFired records that a schedule fired, whether or not it found
+// new input.
+func (db *DB) UpdateScheduleFired(ctx context.Context, id int, firedAt, nextFireAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE schedules SET last_fired_at = $1, next_fire_at = $2 WHERE id = $3`
+	_, err := db.ExecContext(ctx, query, firedAt, nextFireAt, id)
+	return err
+}
+
+// ScheduleInput is the SharpHound collection a schedule fired on, identified
+// by its S3 ETag.
+type ScheduleInput struct {
+	ScheduleID int
+	ETag       string
+}
+
+// claimScheduleInput records input as the latest a schedule has processed,
+// locking the schedule until tx ends. It returns ErrScheduleInputClaimed if
+// the schedule has already claimed that input, so that when more than one
+// worker fires the same schedule only one of them creates a result.
+func claimScheduleInput(ctx context.Context, tx *sqlx.Tx, input ScheduleInput) error {
+	query := `
+		UPDATE schedules SET last_input_etag = $1
+		WHERE id = $2 AND last_input_etag IS DISTINCT FROM $1`
+
+	res, err := tx.ExecContext(ctx, query, input.ETag, input.ScheduleID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrScheduleInputClaimed
+	}
+
+	return nil
+}
+
+func updateScheduleLastResult(ctx context.Context, tx *sqlx.Tx, id, resultID int) error {
+	query := `UPDATE schedules SET last_result_id = $1 WHERE id = $2`
+	_, err := tx.ExecContext(ctx, query, resultID, id)
+	return err
+}
@@ -5,17 +5,42 @@ import (
 	"database/sql"
 	"errors"
 	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type User struct {
-	ID             int       `db:"id"`
-	Created        time.Time `db:"created"`
-	Email          string    `db:"email"`
-	HashedPassword string    `db:"hashed_password"`
+	ID              int            `db:"id"`
+	Created         time.Time      `db:"created"`
+	Email           string         `db:"email"`
+	HashedPassword  string         `db:"hashed_password" json:"-"`
+	Role            string         `db:"role"`
+	Orgs            pq.StringArray `db:"orgs"`
+	LastLoginAt     *time.Time     `db:"last_login_at"`
+	LastLoginIP     *string        `db:"last_login_ip"`
+	MFASecret       sql.NullString `db:"mfa_secret" json:"-"`
+	MFAEnabled      bool           `db:"mfa_enabled"`
+	MFALastStep     sql.NullInt64  `db:"mfa_last_step" json:"-"`
+	AuthProvider    string         `db:"auth_provider"`
+	ExternalSubject sql.NullString `db:"external_subject" json:"-"`
 }
 
-func (db *DB) InsertUser(email, hashedPassword string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// Role constants for type safety
+const (
+	RoleAdmin   = "admin"
+	RoleAnalyst = "analyst"
+)
+
+// Auth provider constants for type safety
+const (
+	AuthProviderLocal = "local"
+	AuthProviderOIDC  = "oidc"
+	AuthProviderLDAP  = "ldap"
+)
+
+func (db *DB) InsertUser(ctx context.Context, email, hashedPassword string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var id int
@@ -33,8 +58,8 @@ func (db *DB) InsertUser(email, hashedPassword string) (int, error) {
 	return id, err
 }
 
-func (db *DB) GetUser(id int) (User, bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetUser(ctx context.Context, id int) (User, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var user User
@@ -49,8 +74,8 @@ func (db *DB) GetUser(id int) (User, bool, error) {
 	return user, true, err
 }
 
-func (db *DB) GetUserByEmail(email string) (User, bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetUserByEmail(ctx context.Context, email string) (User, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var user User
@@ -65,8 +90,8 @@ func (db *DB) GetUserByEmail(email string) (User, bool, error) {
 	return user, true, err
 }
 
-func (db *DB) UpdateUserHashedPassword(id int, hashedPassword string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) UpdateUserHashedPassword(ctx context.Context, id int, hashedPassword string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `UPDATE users SET hashed_password = $1 WHERE id = $2`
@@ -74,3 +99,272 @@ func (db *DB) UpdateUserHashedPassword(id int, hashedPassword string) error {
 	_, err := db.ExecContext(ctx, query, hashedPassword, id)
 	return err
 }
+
+func (db *DB) UpdateUserLastLogin(ctx context.Context, id int, loginTime time.Time, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET last_login_at = $1, last_login_ip = $2 WHERE id = $3`
+
+	_, err := db.ExecContext(ctx, query, loginTime, ip, id)
+	return err
+}
+
+func (db *DB) UpdateUserMFASecret(ctx context.Context, id int, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET mfa_secret = $1, mfa_enabled = FALSE WHERE id = $2`
+
+	_, err := db.ExecContext(ctx, query, secret, id)
+	return err
+}
+
+// EnableUserMFA marks MFA as enabled and replaces any existing recovery codes
+// with the given hashes in a single transaction.
+func (db *DB) EnableUserMFA(ctx context.Context, id int, hashedRecoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET mfa_enabled = TRUE WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, id, hashedRecoveryCodes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) DisableUserMFA(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET mfa_secret = NULL, mfa_enabled = FALSE WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AcceptUserMFAStep records step as the last TOTP time step the user
+// authenticated with. It reports false if a code for that step, or a later
+// one, was already accepted, so that each code can only be used once.
+func (db *DB) AcceptUserMFAStep(ctx context.Context, id int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE users SET mfa_last_step = $1
+		WHERE id = $2 AND (mfa_last_step IS NULL OR mfa_last_step < $1)`
+
+	res, err := db.ExecContext(ctx, query, step, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ConsumeMFAToken marks an MFA token as used, returning false if it already
+// was. Tokens that have expired are forgotten, as they can't be used anyway.
+func (db *DB) ConsumeMFAToken(ctx context.Context, tokenID string, userID int, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM used_mfa_tokens WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		INSERT INTO used_mfa_tokens (token_id, user_id, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token_id) DO NOTHING`
+
+	res, err := tx.ExecContext(ctx, query, tokenID, userID, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, tx.Commit()
+}
+
+// UseUserRecoveryCode consumes an unused recovery code, returning false if no
+// matching unused code exists.
+func (db *DB) UseUserRecoveryCode(ctx context.Context, id int, hashedRecoveryCode string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE user_recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND hashed_code = $3 AND used_at IS NULL`
+
+	res, err := db.ExecContext(ctx, query, time.Now(), id, hashedRecoveryCode)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int, hashedRecoveryCodes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hashedCode := range hashedRecoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_recovery_codes (user_id, hashed_code) VALUES ($1, $2)`, userID, hashedCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertExternalUser provisions a user authenticated by an external identity
+// provider. Such users have no local password.
+func (db *DB) InsertExternalUser(ctx context.Context, email, authProvider, externalSubject, role string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var id int
+
+	query := `
+		INSERT INTO users (created, email, hashed_password, auth_provider, external_subject, role)
+		VALUES ($1, $2, '', $3, $4, $5)
+		RETURNING id`
+
+	err := db.GetContext(ctx, &id, query, time.Now(), email, authProvider, externalSubject, role)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (db *DB) GetUserByExternalSubject(ctx context.Context, authProvider, externalSubject string) (User, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var user User
+
+	query := `SELECT * FROM users WHERE auth_provider = $1 AND external_subject = $2`
+
+	err := db.GetContext(ctx, &user, query, authProvider, externalSubject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, false, nil
+	}
+
+	return user, true, err
+}
+
+// ErrExternalIdentityInUse is returned when linking an external identity that
+// is already linked to another user.
+var ErrExternalIdentityInUse = errors.New("external identity is already linked to another user")
+
+// LinkUserExternalIdentity links an existing user to an external identity, so
+// that logging in with that identity logs in as the user. It reports false
+// if the user doesn't exist.
+func (db *DB) LinkUserExternalIdentity(ctx context.Context, id int, authProvider, externalSubject string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET auth_provider = $1, external_subject = $2 WHERE id = $3`
+
+	res, err := db.ExecContext(ctx, query, authProvider, externalSubject, id)
+	if err != nil {
+		if isUniqueViolation(err, "idx_users_external_identity") {
+			return false, ErrExternalIdentityInUse
+		}
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateUserRole applies the role that an external user's groups map to.
+func (db *DB) UpdateUserRole(ctx context.Context, id int, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE users SET role = $1 WHERE id = $2`
+
+	_, err := db.ExecContext(ctx, query, role, id)
+	return err
+}
+
+// AdminExists reports whether any user has the admin role.
+func (db *DB) AdminExists(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var exists bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)`
+
+	err := db.GetContext(ctx, &exists, query, RoleAdmin)
+	return exists, err
+}
+
+// SeedAdmin gives the local user with the given email the admin role, unless
+// some user already has it. External users are left alone, since their role
+// follows their groups. It reports whether the user was promoted.
+func (db *DB) SeedAdmin(ctx context.Context, email string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE users SET role = $1
+		WHERE email = $2 AND auth_provider = $3
+		AND NOT EXISTS (SELECT 1 FROM users WHERE role = $1)`
+
+	res, err := db.ExecContext(ctx, query, RoleAdmin, email, AuthProviderLocal)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,292 @@
+package directory
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const defaultTimeout = 10 * time.Second
+
+var (
+	ErrInvalidCredentials = errors.New("directory: invalid credentials")
+	ErrUserNotFound       = errors.New("directory: user not found")
+	ErrNoMatchingRole     = errors.New("directory: user is not a member of any permitted group")
+	ErrEmailMissing       = errors.New("directory: user has no email address")
+)
+
+// Config describes how to reach the directory and how to map its entries
+// onto local users. In UserFilter and GroupFilter the placeholders
+// {username} and {dn} are replaced with the escaped login name and the
+// user's DN respectively.
+type Config struct {
+	URL                string
+	StartTLS           bool
+	CACertFile         string
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	EmailAttribute     string
+	GroupAttribute     string
+	GroupBaseDN        string
+	GroupFilter        string
+	AdminGroups        []string
+	AnalystGroups      []string
+}
+
+type Authenticator struct {
+	config    Config
+	tlsConfig *tls.Config
+}
+
+// Identity is a directory entry that successfully bound with the supplied
+// password.
+type Identity struct {
+	DN     string
+	Email  string
+	Groups []string
+	Role   string
+}
+
+func NewAuthenticator(config Config) (*Authenticator, error) {
+	host := config.URL
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("directory: reading CA certificate: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("directory: no certificates found in %s", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	a := &Authenticator{
+		config:    config,
+		tlsConfig: tlsConfig,
+	}
+
+	return a, nil
+}
+
+// Authenticate looks the user up with the service account and then binds as
+// the entry that was found using the supplied password. Users without an
+// email address are refused, as the login name can't stand in for one
+// without risking a clash with another account's email.
+func (a *Authenticator) Authenticate(username, password string) (Identity, error) {
+	// An empty password would turn the user bind into an unauthenticated
+	// bind, which most servers accept.
+	if username == "" || password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("directory: user bind failed: %w", err)
+	}
+
+	identity := Identity{
+		DN:     entry.DN,
+		Email:  entry.GetAttributeValue(a.config.EmailAttribute),
+		Groups: entry.GetAttributeValues(a.config.GroupAttribute),
+	}
+
+	if identity.Email == "" {
+		return Identity{}, ErrEmailMissing
+	}
+
+	if a.config.GroupFilter != "" {
+		groups, err := a.searchGroups(conn, entry.DN)
+		if err != nil {
+			return Identity{}, err
+		}
+		identity.Groups = append(identity.Groups, groups...)
+	}
+
+	var ok bool
+	identity.Role, ok = a.role(identity.Groups)
+	if !ok {
+		return Identity{}, ErrNoMatchingRole
+	}
+
+	return identity, nil
+}
+
+// LookUp returns the DN of the entry that username logs in as, without
+// checking a password. Every name the user filter matches for an entry
+// resolves to the same DN.
+func (a *Authenticator) LookUp(username string) (string, error) {
+	if username == "" {
+		return "", ErrUserNotFound
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return "", err
+	}
+
+	return entry.DN, nil
+}
+
+// findUser searches for the single entry username matches, with the service
+// account's privileges.
+func (a *Authenticator) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	err := a.bindServiceAccount(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := strings.ReplaceAll(a.config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	attributes := []string{a.config.EmailAttribute, a.config.GroupAttribute}
+
+	searchRequest := ldap.NewSearchRequest(a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(defaultTimeout.Seconds()), false, filter, attributes, nil)
+
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("directory: user search failed: %w", err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("directory: user filter matched more than one entry for %q", username)
+	}
+}
+
+func (a *Authenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithTLSConfig(a.tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: defaultTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("directory: connection failed: %w", err)
+	}
+
+	conn.SetTimeout(defaultTimeout)
+
+	if a.config.StartTLS {
+		err = conn.StartTLS(a.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("directory: StartTLS failed: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (a *Authenticator) bindServiceAccount(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+
+	err := conn.Bind(a.config.BindDN, a.config.BindPassword)
+	if err != nil {
+		return fmt.Errorf("directory: service account bind failed: %w", err)
+	}
+
+	return nil
+}
+
+// searchGroups finds groups that list the user as a member, for servers that
+// don't maintain a memberOf attribute on user entries. The lookup runs with
+// the service account's privileges.
+func (a *Authenticator) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	err := a.bindServiceAccount(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	baseDN := a.config.GroupBaseDN
+	if baseDN == "" {
+		baseDN = a.config.BaseDN
+	}
+
+	filter := strings.ReplaceAll(a.config.GroupFilter, "{dn}", ldap.EscapeFilter(userDN))
+	searchRequest := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(defaultTimeout.Seconds()), false, filter, []string{"dn"}, nil)
+
+	result, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, fmt.Errorf("directory: group search failed: %w", err)
+	}
+
+	groups := make([]string, len(result.Entries))
+	for i, entry := range result.Entries {
+		groups[i] = entry.DN
+	}
+
+	return groups, nil
+}
+
+func (a *Authenticator) role(groups []string) (string, bool) {
+	if containsFold(a.config.AdminGroups, groups) {
+		return database.RoleAdmin, true
+	}
+
+	if len(a.config.AnalystGroups) == 0 || containsFold(a.config.AnalystGroups, groups) {
+		return database.RoleAnalyst, true
+	}
+
+	return "", false
+}
+
+// containsFold reports whether any of the groups appears in the allowed list.
+// DNs are compared case-insensitively as directories don't preserve case
+// consistently.
+func containsFold(allowed, groups []string) bool {
+	for _, group := range groups {
+		for _, a := range allowed {
+			if strings.EqualFold(strings.TrimSpace(group), strings.TrimSpace(a)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,317 @@
+package directory
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testBindDN       = "cn=svc,dc=example,dc=test"
+	testBindPassword = "bind-secret"
+	testAdminGroup   = "cn=admins,ou=groups,dc=example,dc=test"
+	testAnalystGroup = "cn=analysts,ou=groups,dc=example,dc=test"
+)
+
+type fakeEntry struct {
+	dn       string
+	uid      string
+	mail     string
+	password string
+	memberOf []string
+}
+
+// fakeDirectory is a minimal LDAP server that answers simple binds and the
+// searches the authenticator makes: a user filter matching uid or mail, and a
+// group filter matching member.
+type fakeDirectory struct {
+	users  []fakeEntry
+	groups map[string][]string
+}
+
+func newFakeDirectory(t *testing.T) (*fakeDirectory, string) {
+	t.Helper()
+
+	d := &fakeDirectory{
+		users: []fakeEntry{
+			{dn: "uid=alice,ou=people,dc=example,dc=test", uid: "alice", mail: "alice@example.test", password: "alice-secret", memberOf: []string{"CN=Admins,OU=Groups,DC=example,DC=test"}},
+			{dn: "uid=bob,ou=people,dc=example,dc=test", uid: "bob", mail: "bob@example.test", password: "bob-secret", memberOf: []string{testAnalystGroup}},
+			{dn: "uid=carol,ou=people,dc=example,dc=test", uid: "carol", mail: "carol@example.test", password: "carol-secret"},
+			{dn: "uid=dave,ou=people,dc=example,dc=test", uid: "dave", password: "dave-secret", memberOf: []string{testAnalystGroup}},
+		},
+		groups: map[string][]string{
+			testAnalystGroup: {"uid=carol,ou=people,dc=example,dc=test"},
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	return d, "ldap://" + listener.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			responses = append(responses, result(ldap.ApplicationBindResponse, d.bind(name, password)))
+
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			responses = append(responses, d.search(filter)...)
+			responses = append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+			envelope.AppendChild(response)
+
+			_, err = conn.Write(envelope.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(name, password string) int64 {
+	if name == testBindDN && password == testBindPassword {
+		return ldap.LDAPResultSuccess
+	}
+
+	for _, user := range d.users {
+		if user.dn == name && user.password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *fakeDirectory) search(filter string) []*ber.Packet {
+	var entries []*ber.Packet
+
+	for _, user := range d.users {
+		if strings.Contains(filter, "(uid="+user.uid+")") || (user.mail != "" && strings.Contains(filter, "(mail="+user.mail+")")) {
+			attributes := map[string][]string{"memberOf": user.memberOf}
+			if user.mail != "" {
+				attributes["mail"] = []string{user.mail}
+			}
+			entries = append(entries, entry(user.dn, attributes))
+		}
+	}
+
+	for group, members := range d.groups {
+		for _, member := range members {
+			if strings.Contains(filter, "(member="+member+")") {
+				entries = append(entries, entry(group, nil))
+			}
+		}
+	}
+
+	return entries
+}
+
+func result(tag ber.Tag, code int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return packet
+}
+
+func entry(dn string, attributes map[string][]string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+
+		list.AppendChild(attribute)
+	}
+	packet.AppendChild(list)
+
+	return packet
+}
+
+func newTestAuthenticator(t *testing.T, url string, groupFilter string) *Authenticator {
+	t.Helper()
+
+	a, err := NewAuthenticator(Config{
+		URL:            url,
+		BindDN:         testBindDN,
+		BindPassword:   testBindPassword,
+		BaseDN:         "dc=example,dc=test",
+		UserFilter:     "(|(uid={username})(mail={username}))",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		GroupFilter:    groupFilter,
+		AdminGroups:    []string{testAdminGroup},
+		AnalystGroups:  []string{testAnalystGroup},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, url := newFakeDirectory(t)
+
+	tests := []struct {
+		name        string
+		groupFilter string
+		username    string
+		password    string
+		wantDN      string
+		wantEmail   string
+		wantRole    string
+		wantErr     error
+	}{
+		{
+			name:      "admin by uid",
+			username:  "alice",
+			password:  "alice-secret",
+			wantDN:    "uid=alice,ou=people,dc=example,dc=test",
+			wantEmail: "alice@example.test",
+			wantRole:  database.RoleAdmin,
+		},
+		{
+			name:      "analyst by mail",
+			username:  "bob@example.test",
+			password:  "bob-secret",
+			wantDN:    "uid=bob,ou=people,dc=example,dc=test",
+			wantEmail: "bob@example.test",
+			wantRole:  database.RoleAnalyst,
+		},
+		{
+			name:        "analyst by group search",
+			groupFilter: "(&(objectClass=groupOfNames)(member={dn}))",
+			username:    "carol",
+			password:    "carol-secret",
+			wantDN:      "uid=carol,ou=people,dc=example,dc=test",
+			wantEmail:   "carol@example.test",
+			wantRole:    database.RoleAnalyst,
+		},
+		{
+			name:     "no matching group",
+			username: "carol",
+			password: "carol-secret",
+			wantErr:  ErrNoMatchingRole,
+		},
+		{
+			name:     "no email",
+			username: "dave",
+			password: "dave-secret",
+			wantErr:  ErrEmailMissing,
+		},
+		{
+			name:     "wrong password",
+			username: "alice",
+			password: "wrong",
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			name:     "empty password",
+			username: "alice",
+			password: "",
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			name:     "unknown user",
+			username: "mallory",
+			password: "secret",
+			wantErr:  ErrUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, url, tt.groupFilter)
+
+			identity, err := a.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if identity.DN != tt.wantDN || identity.Email != tt.wantEmail || identity.Role != tt.wantRole {
+				t.Errorf("identity = %+v, want DN %s, email %s, role %s", identity, tt.wantDN, tt.wantEmail, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestLookUp(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	a := newTestAuthenticator(t, url, "")
+
+	// Every name a user can log in with resolves to the same account.
+	for _, username := range []string{"alice", "alice@example.test"} {
+		dn, err := a.LookUp(username)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", username, err)
+		}
+
+		if dn != "uid=alice,ou=people,dc=example,dc=test" {
+			t.Errorf("%s: DN = %q, want uid=alice,ou=people,dc=example,dc=test", username, dn)
+		}
+	}
+
+	_, err := a.LookUp("mallory")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user: error = %v, want %v", err, ErrUserNotFound)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func LoadEnv(path *string) error {
@@ -62,3 +64,34 @@ func GetBool(key string, defaultValue bool) bool {
 
 	return boolValue
 }
+
+func GetDuration(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	durationValue, err := time.ParseDuration(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return durationValue
+}
+
+func GetStringSlice(key string, defaultValue []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
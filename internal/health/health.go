@@ -0,0 +1,129 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// Check is a single named dependency check. Fn should return promptly once
+// its context is done. An informational check is reported like any other, but
+// doesn't fail the report.
+type Check struct {
+	Name          string
+	Fn            func(ctx context.Context) error
+	Informational bool
+}
+
+type Result struct {
+	Name      string
+	Status    string
+	LatencyMS float64
+	Error     string `json:",omitempty"`
+}
+
+type Report struct {
+	Status    string
+	CheckedAt time.Time
+	Checks    []Result
+}
+
+func (r Report) Healthy() bool {
+	return r.Status == StatusOK
+}
+
+// Checker runs a fixed set of checks concurrently. Reports are cached for a
+// short while so that frequent probes from several load balancers don't turn
+// into a stream of subprocesses and storage calls.
+type Checker struct {
+	checks   []Check
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu     sync.Mutex
+	report Report
+}
+
+func NewChecker(timeout, cacheTTL time.Duration, checks ...Check) *Checker {
+	return &Checker{
+		checks:   checks,
+		timeout:  timeout,
+		cacheTTL: cacheTTL,
+	}
+}
+
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.report.CheckedAt.IsZero() && time.Since(c.report.CheckedAt) < c.cacheTTL {
+		return c.report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{
+		Status:    StatusOK,
+		CheckedAt: time.Now(),
+		Checks:    make([]Result, len(c.checks)),
+	}
+
+	var wg sync.WaitGroup
+
+	for i, check := range c.checks {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = run(ctx, check)
+		}()
+	}
+
+	wg.Wait()
+
+	for i, result := range report.Checks {
+		if result.Status != StatusOK && !c.checks[i].Informational {
+			report.Status = StatusFailed
+		}
+	}
+
+	c.report = report
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	start := time.Now()
+
+	// Not every client library takes a context, so the deadline is enforced
+	// here as well. A check that overruns is abandoned and reported as failed.
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{
+		Name:      check.Name,
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	if err != nil {
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	}
+
+	return result
+}
@@ -0,0 +1,194 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// KeySet signs tokens with a single active key and verifies them against every
+// key it knows about, so that tokens signed by a retired key stay valid until
+// they expire.
+type KeySet struct {
+	activeKID  string
+	ed25519Key ed25519.PrivateKey
+	rsaKey     *rsa.PrivateKey
+	secret     []byte
+	register   jwt.KeyRegister
+	jwks       []JWK
+}
+
+// JWK is the public half of a verification key as published in a JWKS
+// document (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Modulus   string `json:"n,omitempty"`
+	Exponent  string `json:"e,omitempty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// Load reads every <kid>.pem file in dir. Private keys (Ed25519 or RSA) can
+// sign and verify; public keys can only verify. The key named by activeKID
+// signs new tokens and must be a private key. If secret is non-empty it is
+// accepted for verifying legacy HS256 tokens, but never used for signing.
+func Load(dir, activeKID, secret string) (*KeySet, error) {
+	ks := &KeySet{activeKID: activeKID}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+
+		err := ks.loadFile(path, kid)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %w", kid, err)
+		}
+	}
+
+	if ks.ed25519Key == nil && ks.rsaKey == nil {
+		return nil, fmt.Errorf("no private key with ID %q found in %s", activeKID, dir)
+	}
+
+	if secret != "" {
+		ks.addSecret(secret)
+	}
+
+	return ks, nil
+}
+
+// NewHMAC returns a key set that signs and verifies with a shared HS256
+// secret. It exists for deployments that have not yet provisioned signing
+// keys and publishes an empty JWKS.
+func NewHMAC(secret string) *KeySet {
+	ks := &KeySet{}
+	ks.addSecret(secret)
+
+	return ks
+}
+
+func (ks *KeySet) Sign(claims *jwt.Claims) ([]byte, error) {
+	claims.KeyID = ks.activeKID
+
+	switch {
+	case ks.ed25519Key != nil:
+		return claims.EdDSASign(ks.ed25519Key)
+	case ks.rsaKey != nil:
+		return claims.RSASign(jwt.RS256, ks.rsaKey)
+	default:
+		return claims.HMACSign(jwt.HS256, ks.secret)
+	}
+}
+
+func (ks *KeySet) Check(token []byte) (*jwt.Claims, error) {
+	return ks.register.Check(token)
+}
+
+func (ks *KeySet) JWKS() map[string][]JWK {
+	keys := ks.jwks
+	if keys == nil {
+		keys = []JWK{}
+	}
+
+	return map[string][]JWK{"keys": keys}
+}
+
+func (ks *KeySet) loadFile(path, kid string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM block found")
+	}
+
+	var key any
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if kid == ks.activeKID {
+			ks.ed25519Key = k
+		}
+		ks.addEd25519(k.Public().(ed25519.PublicKey), kid)
+	case ed25519.PublicKey:
+		ks.addEd25519(k, kid)
+	case *rsa.PrivateKey:
+		if kid == ks.activeKID {
+			ks.rsaKey = k
+		}
+		ks.addRSA(&k.PublicKey, kid)
+	case *rsa.PublicKey:
+		ks.addRSA(k, kid)
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return nil
+}
+
+func (ks *KeySet) addEd25519(key ed25519.PublicKey, kid string) {
+	ks.register.EdDSAs = append(ks.register.EdDSAs, key)
+	ks.register.EdDSAIDs = append(ks.register.EdDSAIDs, kid)
+
+	ks.jwks = append(ks.jwks, JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(key),
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: jwt.EdDSA,
+	})
+}
+
+func (ks *KeySet) addRSA(key *rsa.PublicKey, kid string) {
+	ks.register.RSAs = append(ks.register.RSAs, key)
+	ks.register.RSAIDs = append(ks.register.RSAIDs, kid)
+
+	ks.jwks = append(ks.jwks, JWK{
+		KeyType:   "RSA",
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: jwt.RS256,
+	})
+}
+
+func (ks *KeySet) addSecret(secret string) {
+	ks.secret = []byte(secret)
+	ks.register.Secrets = append(ks.register.Secrets, ks.secret)
+}
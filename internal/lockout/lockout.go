@@ -0,0 +1,286 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	baseDelay = time.Second
+	maxDelay  = 30 * time.Second
+
+	// suspiciousAccountCount is the number of distinct accounts a single IP
+	// may fail against within the window before each further account it
+	// tries is flagged as suspicious.
+	suspiciousAccountCount = 5
+)
+
+// counterStore keeps the limiter's failure counters, delays and locks, each
+// of which expires on its own.
+type counterStore interface {
+	// CountFailure counts a failed attempt against email and ip, and adds
+	// email to the accounts ip has tried, all expiring after window.
+	CountFailure(ctx context.Context, email, ip string, window time.Duration) (failureCounts, error)
+	Set(ctx context.Context, key string, value any, ttl time.Duration) error
+	// TTL returns how long key has left, or a non-positive duration if it
+	// doesn't exist.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Del(ctx context.Context, keys ...string) error
+	Close() error
+}
+
+type failureCounts struct {
+	account       int64
+	ip            int64
+	newAccount    bool
+	accountsTried int64
+}
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func (s redisStore) CountFailure(ctx context.Context, email, ip string, window time.Duration) (failureCounts, error) {
+	var (
+		accountCount  *redis.IntCmd
+		ipCount       *redis.IntCmd
+		accountsTried *redis.IntCmd
+		newAccount    *redis.IntCmd
+	)
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		accountCount = pipe.Incr(ctx, accountFailuresKey(email))
+		pipe.Expire(ctx, accountFailuresKey(email), window)
+
+		ipCount = pipe.Incr(ctx, ipFailuresKey(ip))
+		pipe.Expire(ctx, ipFailuresKey(ip), window)
+
+		newAccount = pipe.SAdd(ctx, ipAccountsKey(ip), email)
+		pipe.Expire(ctx, ipAccountsKey(ip), window)
+		accountsTried = pipe.SCard(ctx, ipAccountsKey(ip))
+
+		return nil
+	})
+	if err != nil {
+		return failureCounts{}, err
+	}
+
+	counts := failureCounts{
+		account:       accountCount.Val(),
+		ip:            ipCount.Val(),
+		newAccount:    newAccount.Val() > 0,
+		accountsTried: accountsTried.Val(),
+	}
+
+	return counts, nil
+}
+
+func (s redisStore) Set(ctx context.Context, key string, value any, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s redisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.client.PTTL(ctx, key).Result()
+}
+
+func (s redisStore) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := s.client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (s redisStore) Del(ctx context.Context, keys ...string) error {
+	return s.client.Del(ctx, keys...).Err()
+}
+
+func (s redisStore) Close() error {
+	return s.client.Close()
+}
+
+type Limiter struct {
+	store              counterStore
+	maxAccountAttempts int
+	maxIPAttempts      int
+	window             time.Duration
+	lockoutDuration    time.Duration
+}
+
+// Status describes whether a login attempt may proceed. When it may not,
+// RetryAfter holds the remaining delay or lockout time.
+type Status struct {
+	Allowed       bool
+	AccountLocked bool
+	IPLocked      bool
+	RetryAfter    time.Duration
+}
+
+// Failure describes the consequences of a failed login attempt.
+type Failure struct {
+	AccountFailures int64
+	IPFailures      int64
+	AccountLocked   bool
+	IPLocked        bool
+	Suspicious      bool
+}
+
+func NewLimiter(redisAddr, password string, maxAccountAttempts, maxIPAttempts int, window, lockoutDuration time.Duration) *Limiter {
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddr,
+		Password: password,
+	})
+
+	return newLimiter(redisStore{client: client}, maxAccountAttempts, maxIPAttempts, window, lockoutDuration)
+}
+
+func newLimiter(store counterStore, maxAccountAttempts, maxIPAttempts int, window, lockoutDuration time.Duration) *Limiter {
+	return &Limiter{
+		store:              store,
+		maxAccountAttempts: maxAccountAttempts,
+		maxIPAttempts:      maxIPAttempts,
+		window:             window,
+		lockoutDuration:    lockoutDuration,
+	}
+}
+
+func (l *Limiter) Close() error {
+	return l.store.Close()
+}
+
+func (l *Limiter) Check(ctx context.Context, email, ip string) (Status, error) {
+	email = normalizeEmail(email)
+
+	checks := []struct {
+		key           string
+		accountLocked bool
+		ipLocked      bool
+	}{
+		{key: accountLockKey(email), accountLocked: true},
+		{key: ipLockKey(ip), ipLocked: true},
+		{key: accountDelayKey(email)},
+	}
+
+	for _, check := range checks {
+		ttl, err := l.store.TTL(ctx, check.key)
+		if err != nil {
+			return Status{}, err
+		}
+
+		if ttl > 0 {
+			status := Status{
+				AccountLocked: check.accountLocked,
+				IPLocked:      check.ipLocked,
+				RetryAfter:    ttl,
+			}
+			return status, nil
+		}
+	}
+
+	return Status{Allowed: true}, nil
+}
+
+// RegisterFailure records a failed attempt against both the account and the
+// IP. Each failure imposes an exponentially growing delay before the account
+// may be tried again, and crossing a threshold locks the account or IP out.
+func (l *Limiter) RegisterFailure(ctx context.Context, email, ip string) (Failure, error) {
+	email = normalizeEmail(email)
+
+	counts, err := l.store.CountFailure(ctx, email, ip, l.window)
+	if err != nil {
+		return Failure{}, err
+	}
+
+	failure := Failure{
+		AccountFailures: counts.account,
+		IPFailures:      counts.ip,
+		Suspicious:      counts.newAccount && counts.accountsTried >= suspiciousAccountCount,
+	}
+
+	if failure.AccountFailures >= int64(l.maxAccountAttempts) {
+		failure.AccountLocked = true
+
+		err = l.store.Set(ctx, accountLockKey(email), time.Now().Unix(), l.lockoutDuration)
+		if err != nil {
+			return Failure{}, err
+		}
+	} else {
+		err = l.store.Set(ctx, accountDelayKey(email), 1, delay(failure.AccountFailures))
+		if err != nil {
+			return Failure{}, err
+		}
+	}
+
+	if failure.IPFailures >= int64(l.maxIPAttempts) {
+		failure.IPLocked = true
+
+		err = l.store.Set(ctx, ipLockKey(ip), time.Now().Unix(), l.lockoutDuration)
+		if err != nil {
+			return Failure{}, err
+		}
+	}
+
+	return failure, nil
+}
+
+// RegisterSuccess clears the account's failure history after a successful
+// login. The IP counters are left to expire on their own.
+func (l *Limiter) RegisterSuccess(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+
+	return l.store.Del(ctx, accountFailuresKey(email), accountDelayKey(email))
+}
+
+// Unlock lifts a lockout on the account and resets its failure history.
+func (l *Limiter) Unlock(ctx context.Context, email string) error {
+	email = normalizeEmail(email)
+
+	return l.store.Del(ctx, accountLockKey(email), accountFailuresKey(email), accountDelayKey(email))
+}
+
+func (l *Limiter) AccountLocked(ctx context.Context, email string) (bool, error) {
+	return l.store.Exists(ctx, accountLockKey(normalizeEmail(email)))
+}
+
+func delay(failures int64) time.Duration {
+	d := baseDelay
+	for i := int64(1); i < failures && d < maxDelay; i++ {
+		d *= 2
+	}
+
+	return min(d, maxDelay)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func accountFailuresKey(email string) string {
+	return fmt.Sprintf("login:account:%s:failures", email)
+}
+
+func accountDelayKey(email string) string {
+	return fmt.Sprintf("login:account:%s:delay", email)
+}
+
+func accountLockKey(email string) string {
+	return fmt.Sprintf("login:account:%s:lock", email)
+}
+
+func ipFailuresKey(ip string) string {
+	return fmt.Sprintf("login:ip:%s:failures", ip)
+}
+
+func ipAccountsKey(ip string) string {
+	return fmt.Sprintf("login:ip:%s:accounts", ip)
+}
+
+func ipLockKey(ip string) string {
+	return fmt.Sprintf("login:ip:%s:lock", ip)
+}
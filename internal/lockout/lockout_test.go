@@ -0,0 +1,370 @@
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testWindow          = 15 * time.Minute
+	testLockoutDuration = 10 * time.Minute
+)
+
+type memoryEntry struct {
+	count     int64
+	members   map[string]bool
+	expiresAt time.Time
+}
+
+// memoryStore keeps the limiter's keys in memory in place of Redis, expiring
+// them against a clock the test moves forward.
+type memoryStore struct {
+	mu      sync.Mutex
+	now     time.Time
+	entries map[string]*memoryEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		now:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		entries: map[string]*memoryEntry{},
+	}
+}
+
+func (s *memoryStore) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.now = s.now.Add(d)
+}
+
+// entry returns the live entry for key, creating one if create is set.
+func (s *memoryStore) entry(key string, create bool) *memoryEntry {
+	e, ok := s.entries[key]
+	if ok && !s.now.Before(e.expiresAt) {
+		delete(s.entries, key)
+		ok = false
+	}
+
+	if !ok && create {
+		e = &memoryEntry{members: map[string]bool{}}
+		s.entries[key] = e
+		ok = true
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return e
+}
+
+func (s *memoryStore) CountFailure(ctx context.Context, email, ip string, window time.Duration) (failureCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account := s.entry(accountFailuresKey(email), true)
+	account.count++
+	account.expiresAt = s.now.Add(window)
+
+	ipFailures := s.entry(ipFailuresKey(ip), true)
+	ipFailures.count++
+	ipFailures.expiresAt = s.now.Add(window)
+
+	accounts := s.entry(ipAccountsKey(ip), true)
+	newAccount := !accounts.members[email]
+	accounts.members[email] = true
+	accounts.expiresAt = s.now.Add(window)
+
+	counts := failureCounts{
+		account:       account.count,
+		ip:            ipFailures.count,
+		newAccount:    newAccount,
+		accountsTried: int64(len(accounts.members)),
+	}
+
+	return counts, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, value any, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &memoryEntry{members: map[string]bool{}, expiresAt: s.now.Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entry(key, false)
+	if e == nil {
+		return 0, nil
+	}
+
+	return e.expiresAt.Sub(s.now), nil
+}
+
+func (s *memoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.entry(key, false) != nil, nil
+}
+
+func (s *memoryStore) Del(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func newTestLimiter(maxAccountAttempts, maxIPAttempts int) (*Limiter, *memoryStore) {
+	store := newMemoryStore()
+	return newLimiter(store, maxAccountAttempts, maxIPAttempts, testWindow, testLockoutDuration), store
+}
+
+func mustCheck(t *testing.T, l *Limiter, email, ip string) Status {
+	t.Helper()
+
+	status, err := l.Check(context.Background(), email, ip)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	return status
+}
+
+func mustFail(t *testing.T, l *Limiter, email, ip string) Failure {
+	t.Helper()
+
+	failure, err := l.RegisterFailure(context.Background(), email, ip)
+	if err != nil {
+		t.Fatalf("RegisterFailure: %v", err)
+	}
+
+	return failure
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{failures: 1, want: time.Second},
+		{failures: 2, want: 2 * time.Second},
+		{failures: 3, want: 4 * time.Second},
+		{failures: 5, want: 16 * time.Second},
+		{failures: 6, want: maxDelay},
+		{failures: 100, want: maxDelay},
+	}
+
+	for _, tt := range tests {
+		got := delay(tt.failures)
+		if got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestProgressiveDelay(t *testing.T) {
+	l, store := newTestLimiter(10, 100)
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		failure := mustFail(t, l, "alice@example.com", "192.0.2.1")
+		if failure.AccountLocked || failure.IPLocked {
+			t.Fatalf("failure %d locked out: %+v", failure.AccountFailures, failure)
+		}
+
+		status := mustCheck(t, l, "alice@example.com", "192.0.2.1")
+		if status.Allowed || status.AccountLocked || status.IPLocked || status.RetryAfter != want {
+			t.Fatalf("after %d failures got %+v, want a delay of %v", failure.AccountFailures, status, want)
+		}
+
+		// Another account from the same IP isn't held up.
+		if status := mustCheck(t, l, "bob@example.com", "192.0.2.1"); !status.Allowed {
+			t.Fatalf("other account got %+v, want allowed", status)
+		}
+
+		store.advance(want - time.Millisecond)
+		if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); status.Allowed {
+			t.Fatalf("allowed before the delay of %v was up", want)
+		}
+
+		store.advance(time.Millisecond)
+		if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); !status.Allowed {
+			t.Fatalf("after the delay of %v got %+v, want allowed", want, status)
+		}
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	l, store := newTestLimiter(3, 100)
+
+	for i := 1; i < 3; i++ {
+		failure := mustFail(t, l, "alice@example.com", "192.0.2.1")
+		if failure.AccountLocked {
+			t.Fatalf("locked out after %d failures, want 3", i)
+		}
+		store.advance(maxDelay)
+	}
+
+	// Differently written, the email is the same account.
+	failure := mustFail(t, l, " Alice@Example.com", "192.0.2.1")
+	if !failure.AccountLocked || failure.AccountFailures != 3 {
+		t.Fatalf("got %+v, want the account locked after 3 failures", failure)
+	}
+
+	status := mustCheck(t, l, "alice@example.com", "198.51.100.1")
+	if status.Allowed || !status.AccountLocked || status.RetryAfter != testLockoutDuration {
+		t.Fatalf("got %+v, want the account locked for %v from any IP", status, testLockoutDuration)
+	}
+
+	locked, err := l.AccountLocked(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("AccountLocked = false, want true")
+	}
+
+	store.advance(testLockoutDuration - time.Second)
+	if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); !status.AccountLocked || status.RetryAfter != time.Second {
+		t.Fatalf("got %+v, want the account locked for another second", status)
+	}
+
+	store.advance(time.Second)
+	if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); !status.Allowed {
+		t.Fatalf("after the lockout expired got %+v, want allowed", status)
+	}
+
+	locked, err = l.AccountLocked(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("AccountLocked = true after the lockout expired, want false")
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	l, store := newTestLimiter(100, 3)
+
+	for i := range 3 {
+		failure := mustFail(t, l, fmt.Sprintf("user%d@example.com", i), "192.0.2.1")
+		if failure.IPLocked != (i == 2) {
+			t.Fatalf("after %d failures IPLocked = %v", i+1, failure.IPLocked)
+		}
+	}
+
+	status := mustCheck(t, l, "new@example.com", "192.0.2.1")
+	if status.Allowed || !status.IPLocked || status.AccountLocked || status.RetryAfter != testLockoutDuration {
+		t.Fatalf("got %+v, want the IP locked for %v", status, testLockoutDuration)
+	}
+
+	if status := mustCheck(t, l, "new@example.com", "198.51.100.1"); !status.Allowed {
+		t.Fatalf("another IP got %+v, want allowed", status)
+	}
+
+	store.advance(testLockoutDuration)
+	if status := mustCheck(t, l, "new@example.com", "192.0.2.1"); !status.Allowed {
+		t.Fatalf("after the lockout expired got %+v, want allowed", status)
+	}
+}
+
+func TestFailuresExpire(t *testing.T) {
+	l, store := newTestLimiter(3, 100)
+
+	mustFail(t, l, "alice@example.com", "192.0.2.1")
+	mustFail(t, l, "alice@example.com", "192.0.2.1")
+
+	store.advance(testWindow)
+
+	failure := mustFail(t, l, "alice@example.com", "192.0.2.1")
+	if failure.AccountLocked || failure.AccountFailures != 1 {
+		t.Fatalf("got %+v, want failures outside the window forgotten", failure)
+	}
+}
+
+func TestSuspicious(t *testing.T) {
+	l, _ := newTestLimiter(100, 100)
+
+	for i := range suspiciousAccountCount {
+		failure := mustFail(t, l, fmt.Sprintf("user%d@example.com", i), "192.0.2.1")
+		if failure.Suspicious != (i == suspiciousAccountCount-1) {
+			t.Fatalf("after %d accounts Suspicious = %v", i+1, failure.Suspicious)
+		}
+	}
+
+	// Trying an account again isn't a new pattern.
+	if failure := mustFail(t, l, "user0@example.com", "192.0.2.1"); failure.Suspicious {
+		t.Fatal("retrying an account was flagged as suspicious")
+	}
+
+	if failure := mustFail(t, l, "another@example.com", "192.0.2.1"); !failure.Suspicious {
+		t.Fatal("a further account was not flagged as suspicious")
+	}
+
+	if failure := mustFail(t, l, "another@example.com", "198.51.100.1"); failure.Suspicious {
+		t.Fatal("a different IP was flagged as suspicious")
+	}
+}
+
+func TestRegisterSuccess(t *testing.T) {
+	l, _ := newTestLimiter(3, 100)
+
+	mustFail(t, l, "alice@example.com", "192.0.2.1")
+	mustFail(t, l, "alice@example.com", "192.0.2.1")
+
+	err := l.RegisterSuccess(context.Background(), "Alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); !status.Allowed {
+		t.Fatalf("got %+v, want the delay cleared", status)
+	}
+
+	failure := mustFail(t, l, "alice@example.com", "192.0.2.1")
+	if failure.AccountLocked || failure.AccountFailures != 1 {
+		t.Fatalf("got %+v, want the failures reset", failure)
+	}
+
+	// The IP's failures are left to expire.
+	if failure.IPFailures != 3 {
+		t.Fatalf("IPFailures = %d, want 3", failure.IPFailures)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	l, _ := newTestLimiter(2, 100)
+
+	mustFail(t, l, "alice@example.com", "192.0.2.1")
+	if failure := mustFail(t, l, "alice@example.com", "192.0.2.1"); !failure.AccountLocked {
+		t.Fatalf("got %+v, want the account locked", failure)
+	}
+
+	err := l.Unlock(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := mustCheck(t, l, "alice@example.com", "192.0.2.1"); !status.Allowed {
+		t.Fatalf("got %+v, want the account unlocked", status)
+	}
+
+	if failure := mustFail(t, l, "alice@example.com", "192.0.2.1"); failure.AccountLocked || failure.AccountFailures != 1 {
+		t.Fatalf("got %+v, want the failures reset", failure)
+	}
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ad_miner"
+
+// Registry holds every metric exposed by the application. A dedicated
+// registry is used rather than the global default so that only metrics we
+// register ourselves are exported.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests by route and status.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	TasksProcessed = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_processed_total",
+		Help:      "Total number of queue tasks processed by type and outcome.",
+	}, []string{"type", "outcome"})
+
+	TaskDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "task_duration_seconds",
+		Help:      "Queue task processing time by type and outcome.",
+		Buckets:   []float64{30, 60, 120, 300, 600, 900, 1800, 2700, 3600, 5400, 7200},
+	}, []string{"type", "outcome"})
+
+	PipelineStepDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pipeline_step_duration_seconds",
+		Help:      "Duration of each analysis pipeline step by outcome.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 2400, 3600},
+	}, []string{"step", "outcome"})
+
+	SubprocessFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subprocess_failures_total",
+		Help:      "Total number of failed external command invocations by tool.",
+	}, []string{"tool"})
+
+	ResultsReconciled = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "results_reconciled_total",
+		Help:      "Total number of results and tasks corrected by the reconciler by action.",
+	}, []string{"action"})
+
+	ResultsSLAExceeded = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "results_sla_exceeded_total",
+		Help:      "Total number of analysis runs flagged for running past the SLA.",
+	})
+
+	ArtifactsPurged = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "artifacts_purged_total",
+		Help:      "Total number of result artifacts purged by retention by artifact.",
+	}, []string{"artifact"})
+
+	OutboxDeadLettered = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_dead_lettered_total",
+		Help:      "Total number of outbox messages given up on after repeatedly failing to publish.",
+	})
+
+	MailSends = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mail_sends_total",
+		Help:      "Total number of email send attempts by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Outcome returns the outcome label for an operation that returned err.
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func RegisterDB(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
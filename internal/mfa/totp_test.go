@@ -0,0 +1,129 @@
+package mfa
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+		Period:    period,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1_700_000_010, 0)
+	step := now.Unix() / period
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", codeAt(t, testSecret, now), step, true},
+		{"previous step", codeAt(t, testSecret, now.Add(-period*time.Second)), step - 1, true},
+		{"next step", codeAt(t, testSecret, now.Add(period*time.Second)), step + 1, true},
+		{"surrounding whitespace", " " + codeAt(t, testSecret, now) + "\n", step, true},
+		{"too old", codeAt(t, testSecret, now.Add(-2*period*time.Second)), 0, false},
+		{"too new", codeAt(t, testSecret, now.Add(2*period*time.Second)), 0, false},
+		{"wrong secret", codeAt(t, "KRSXG5CTMVRXEZLU", now), 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := Validate(tt.code, testSecret, now)
+			if gotOK != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("Validate = (%d, %t), want (%d, %t)", gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewEnrollment(t *testing.T) {
+	enrollment, err := NewEnrollment("AD Miner", "alice@example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := otp.NewKeyFromURL(enrollment.ProvisioningURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Secret() != enrollment.Secret || key.Issuer() != "AD Miner" || key.AccountName() != "alice@example.test" {
+		t.Errorf("provisioning URI %q doesn't match the enrollment", enrollment.ProvisioningURI)
+	}
+
+	// The authenticator app generates codes from the URI with its defaults,
+	// which Validate has to accept.
+	now := time.Now()
+	code, err := totp.GenerateCode(key.Secret(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := Validate(code, enrollment.Secret, now); !ok {
+		t.Error("code generated from the provisioning URI was refused")
+	}
+
+	if !regexp.MustCompile(`^data:image/png;base64,`).MatchString(enrollment.QRCode) {
+		t.Errorf("QR code is not a PNG data URI: %.40s", enrollment.QRCode)
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`)
+	seen := map[string]bool{}
+
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q is not in the form xxxx-xxxx-xxxx-xxxx", code)
+		}
+
+		if seen[code] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := HashRecoveryCode("abcd-efgh-ijkl-mnop")
+
+	// Codes are accepted however the user types them.
+	for _, code := range []string{"ABCD-EFGH-IJKL-MNOP", "abcdefghijklmnop", "  abcd-efgh-ijkl-mnop "} {
+		if got := HashRecoveryCode(code); got != want {
+			t.Errorf("HashRecoveryCode(%q) = %s, want %s", code, got, want)
+		}
+	}
+
+	if HashRecoveryCode("abcd-efgh-ijkl-mnoq") == want {
+		t.Error("different codes hash the same")
+	}
+}
@@ -16,6 +16,13 @@ func Hash(plaintextPassword string) (string, error) {
 }
 
 func Matches(plaintextPassword, hashedPassword string) (bool, error) {
+	// Accounts provisioned from an external identity provider have no
+	// local password and can never match one.
+	if hashedPassword == "" {
+		SimulateMatch(plaintextPassword)
+		return false, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plaintextPassword))
 	if err != nil {
 		switch {
@@ -28,3 +35,12 @@ func Matches(plaintextPassword, hashedPassword string) (bool, error) {
 
 	return true, nil
 }
+
+// dummyHash is a bcrypt hash with the same cost as Hash. Comparing against it
+// when no user exists makes failed logins take the same time whether or not
+// the email address is known.
+const dummyHash = "$2a$12$U1OOUl8/K8qN1AuEe/ERyu2LXe34lZWWZ3gCBUzCph5lQGkAqLYXi"
+
+func SimulateMatch(plaintextPassword string) {
+	_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(plaintextPassword))
+}
@@ -1,14 +1,24 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
+	"com.activehacks.ad-miner-backend/internal/database"
 	"com.activehacks.ad-miner-backend/internal/env"
 	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("com.activehacks.ad-miner-backend/internal/queue")
+
 type Client struct {
 	client *asynq.Client
 }
@@ -28,21 +38,81 @@ func (c *Client) Close() error {
 	return c.client.Close()
 }
 
-func (c *Client) EnqueueBloodhoundAnalysis(payload BloodhoundTaskPayload) (*asynq.TaskInfo, error) {
+func (c *Client) Ping() error {
+	return c.client.Ping()
+}
+
+func (c *Client) EnqueueBloodhoundAnalysis(ctx context.Context, payload BloodhoundTaskPayload) (*asynq.TaskInfo, error) {
+	ctx, span := tracer.Start(ctx, "enqueue "+TypeBloodhoundAnalysis, trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	payloadBytes, err := MarshalBloodhoundAnalysis(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	task := asynq.NewTask(TypeBloodhoundAnalysis, payloadBytes)
+
+	info, err := c.client.EnqueueContext(ctx, task, bloodhoundAnalysisOptions()...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("messaging.message.id", info.ID))
+	return info, nil
+}
+
+// EnqueueOutboxMessage publishes a task written to the outbox. The task keeps
+// the ID it was given when it was written, so publishing the same message
+// again is a no-op.
+func (c *Client) EnqueueOutboxMessage(ctx context.Context, message database.OutboxMessage) error {
+	ctx, span := tracer.Start(ctx, "enqueue "+message.TaskType, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.message.id", message.TaskID),
+	))
+	defer span.End()
+
+	var opts []asynq.Option
+	if message.TaskType == TypeBloodhoundAnalysis {
+		opts = bloodhoundAnalysisOptions()
+	}
+	opts = append(opts, asynq.TaskID(message.TaskID))
+
+	_, err := c.client.EnqueueContext(ctx, asynq.NewTask(message.TaskType, message.Payload), opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// MarshalBloodhoundAnalysis encodes a payload for a bloodhound:analysis task,
+// carrying the trace in ctx so that the worker's spans continue it.
+func MarshalBloodhoundAnalysis(ctx context.Context, payload BloodhoundTaskPayload) ([]byte, error) {
+	payload.TraceContext = map[string]string{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(payload.TraceContext))
+
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	task := asynq.NewTask(TypeBloodhoundAnalysis, payloadBytes)
+	return payloadBytes, nil
+}
 
+func bloodhoundAnalysisOptions() []asynq.Option {
 	maxRetry := env.GetInt("WORKER_MAX_RETRIES", 3)
 	maxTimeout := env.GetInt("WORKER_MAX_TIMEOUT", 60)
-	opts := []asynq.Option{
+
+	return []asynq.Option{
 		asynq.MaxRetry(maxRetry),
 		asynq.Timeout(time.Duration(maxTimeout) * time.Minute),
-		asynq.Queue("bloodhound"),
+		asynq.Queue(QueueBloodhound),
 	}
-
-	return c.client.Enqueue(task, opts...)
 }
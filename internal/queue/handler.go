@@ -3,112 +3,443 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/logging"
+	"com.activehacks.ad-miner-backend/internal/metrics"
 	"com.activehacks.ad-miner-backend/internal/services"
 	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ResultStore is the part of the database the task handler uses to follow a
+// result through its run.
+type ResultStore interface {
+	GetResult(ctx context.Context, id int) (database.Result, bool, error)
+	TransitionResultStatus(ctx context.Context, id int, from, to, actor, reason string) error
+	FailResultStatus(ctx context.Context, id int, from, to, actor string, failure database.ResultFailure) error
+	SetResultEvolutionData(ctx context.Context, id int, path string) error
+	GetEvolutionArchives(ctx context.Context, orgName string, resultID, limit int) ([]database.EvolutionArchive, error)
+	InsertAuditEvent(ctx context.Context, event database.AuditEvent) error
+}
+
+var _ ResultStore = (*database.DB)(nil)
+
 type TaskHandler struct {
-	db            *database.DB
-	s3Svc         *services.S3Service
-	bloodhoundSvc *services.BloodhoundService
-	adminerSvc    *services.ADMinerService
+	db            ResultStore
+	logger        *slog.Logger
+	s3Svc         services.Storage
+	bloodhoundSvc services.BloodhoundRunner
+	adminerSvc    services.ADMinerRunner
+
+	// inflight tracks running tasks so that shutdown can wait for them to
+	// clean up, and interrupting is set once shutdown has begun so that a
+	// cancelled task is recorded as interrupted rather than failed.
+	inflight     sync.WaitGroup
+	interrupting atomic.Bool
 }
 
-func NewTaskHandler(db *database.DB) *TaskHandler {
+func NewTaskHandler(db ResultStore, storage services.Storage, bloodhound services.BloodhoundRunner, adminer services.ADMinerRunner, logger *slog.Logger) *TaskHandler {
 	return &TaskHandler{
 		db:            db,
-		s3Svc:         services.NewS3Service(),
-		bloodhoundSvc: services.NewBloodhoundService(),
-		adminerSvc:    services.NewADMinerService(),
+		logger:        logger,
+		s3Svc:         storage,
+		bloodhoundSvc: bloodhound,
+		adminerSvc:    adminer,
 	}
 }
 
+// Check verifies that the tools the pipeline depends on are available on this
+// host.
+func (h *TaskHandler) Check(ctx context.Context) error {
+	err := h.bloodhoundSvc.Check(ctx)
+	if err != nil {
+		return err
+	}
+
+	return h.adminerSvc.Check(ctx)
+}
+
 func (h *TaskHandler) ProcessBloodhoundAnalysis(ctx context.Context, t *asynq.Task) error {
+	h.inflight.Add(1)
+	defer h.inflight.Done()
+
 	var payload BloodhoundTaskPayload
 	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %v", err)
+		return fmt.Errorf("failed to unmarshal payload: %v: %w", err, asynq.SkipRetry)
 	}
 
-	log.Printf("Starting Bloodhound analysis for simulation: %s", payload.SimulationID)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(payload.TraceContext))
+	ctx, span := tracer.Start(ctx, "process "+t.Type(), trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.Int("result.id", payload.ResultID),
+		attribute.String("result.simulation_id", payload.SimulationID),
+		attribute.String("result.org_name", payload.OrgName),
+	))
+	defer span.End()
+
+	taskID, _ := asynq.GetTaskID(ctx)
+	ctx = logging.With(ctx, "request_id", payload.RequestID, "task_id", taskID, "result_id", payload.ResultID, "simulation_id", payload.SimulationID, "org", payload.OrgName)
 
-	// Update status to processing
-	if err := h.updateResultStatus(payload.ResultID, database.StatusProcessing, true, false); err != nil {
-		log.Printf("Failed to update status to processing: %v", err)
+	h.logger.InfoContext(ctx, "starting bloodhound analysis")
+
+	if retryCount, ok := asynq.GetRetryCount(ctx); ok && retryCount > 0 {
+		span.SetAttributes(attribute.Int("task.retry_count", retryCount))
+		h.recordRetry(ctx, payload, retryCount)
 	}
 
-	// Execute the workflow
-	if err := h.executeBloodhoundWorkflow(ctx, payload); err != nil {
-		log.Printf("Workflow failed: %v", err)
-		h.updateResultStatus(payload.ResultID, database.StatusFailed, false, true)
+	result, found, err := h.db.GetResult(ctx, payload.ResultID)
+	if err != nil {
 		return err
 	}
 
-	// Update status to success
-	if err := h.updateResultStatus(payload.ResultID, database.StatusSuccess, false, true); err != nil {
-		log.Printf("Failed to update status to success: %v", err)
+	if !found {
+		return fmt.Errorf("result %d no longer exists: %w", payload.ResultID, asynq.SkipRetry)
 	}
 
-	log.Printf("Completed Bloodhound analysis for simulation: %s", payload.SimulationID)
-	return nil
-}
+	// A result cancelled or expired while its task was queued is left alone.
+	if database.ResultStatusFinal(result.Status) {
+		h.logger.InfoContext(ctx, "result has already finished, not running analysis", "status", result.Status)
+		return nil
+	}
+
+	// A result still marked running belongs to a run whose worker died
+	// before the reconciler caught up; this run takes over from it.
+	if result.Status != database.StatusRunning {
+		err = h.transitionResult(ctx, payload.ResultID, result.Status, database.StatusRunning, "")
+		if errors.Is(err, database.ErrTransitionConflict) && h.resultFinished(ctx, payload.ResultID) {
+			h.logger.InfoContext(ctx, "result finished before analysis started, not running analysis")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to start result: %w", err)
+		}
+	}
 
-func (h *TaskHandler) executeBloodhoundWorkflow(ctx context.Context, payload BloodhoundTaskPayload) error {
-	// cleanup artifacts
-	defer h.adminerSvc.Cleanup(payload.OrgName)
-	defer h.bloodhoundSvc.DeleteInstance(payload.OrgName)
+	history := h.evolutionHistory(ctx, payload)
 
-	log.Printf("Downloading sharphound.zip from S3 bucket: %s", payload.S3BucketPath)
-	if err := h.s3Svc.DownloadFile(payload.OrgName, payload.S3BucketPath, "sharphound.zip"); err != nil {
-		return fmt.Errorf("failed to download sharphound.zip: %v", err)
+	// Execute the workflow
+	start := time.Now()
+	archive, err := h.executeBloodhoundWorkflow(ctx, payload, history)
+
+	metrics.TasksProcessed.WithLabelValues(t.Type(), metrics.Outcome(err)).Inc()
+	metrics.TaskDuration.WithLabelValues(t.Type(), metrics.Outcome(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil && h.interrupting.Load() && errors.Is(ctx.Err(), context.Canceled) {
+		h.logger.WarnContext(ctx, "bloodhound analysis interrupted by shutdown, task has been requeued", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "interrupted by shutdown")
+		h.recordInterruption(context.WithoutCancel(ctx), payload)
+		return err
 	}
 
-	log.Printf("Starting Bloodhound instance for org: %s", payload.OrgName)
-	_, err := h.bloodhoundSvc.StartInstance(payload.OrgName)
 	if err != nil {
-		return fmt.Errorf("failed to start bloodhound instance: %v", err)
-	}
+		failure := classifyFailure(ctx, err)
+
+		h.logger.ErrorContext(ctx, "bloodhound analysis failed", "error_code", failure.Code, "error_step", failure.Step, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.type", failure.Code))
 
-	log.Printf("Loading data to Bloodhound instance: %s", payload.OrgName)
-	if err := h.bloodhoundSvc.LoadData(payload.OrgName, "sharphound.zip"); err != nil {
-		return fmt.Errorf("failed to load data: %v", err)
+		// The task context is cancelled once the task times out, which is
+		// exactly when the failure most needs recording.
+		dbErr := h.db.FailResultStatus(context.WithoutCancel(ctx), payload.ResultID, database.StatusRunning, failureStatus(ctx, err), "system", failure)
+		if errors.Is(dbErr, database.ErrTransitionConflict) {
+			// The result was cancelled while it ran, which is what stopped
+			// the run.
+			h.logger.InfoContext(ctx, "result was cancelled during analysis, not retrying")
+			return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+		}
+		if dbErr != nil {
+			h.logger.ErrorContext(ctx, "failed to record result failure", "error", dbErr)
+		}
+
+		// Retrying a permanent failure would only fail the same way again.
+		if services.IsPermanent(err) {
+			return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+		}
+		return err
 	}
 
-	log.Printf("Running ADMiner analysis for org: %s", payload.OrgName)
-	if err := h.adminerSvc.RunAnalysis(payload.OrgName); err != nil {
-		return fmt.Errorf("failed to run ADMiner: %v", err)
+	// The archive is recorded before the result succeeds, so that the next
+	// run for the organization finds it. An archive that can't be recorded
+	// would never be read or purged, so it is deleted.
+	if archive != "" {
+		err = h.db.SetResultEvolutionData(ctx, payload.ResultID, archive)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "failed to record evolution data archive, deleting it", "path", archive, "error", err)
+
+			bucketPath, filename := services.SplitStoragePath(archive)
+			err = h.s3Svc.DeleteFile(context.WithoutCancel(ctx), bucketPath, filename)
+			if err != nil {
+				h.logger.ErrorContext(ctx, "failed to delete unrecorded evolution data archive", "path", archive, "error", err)
+			}
+		}
 	}
 
-	log.Printf("Processing and uploading results to S3")
-	if err := h.s3Svc.UploadResults(payload.S3BucketPath, payload.OrgName); err != nil {
-		return fmt.Errorf("failed to upload results: %v", err)
+	// Like a failure, success has to be recorded even if the task context
+	// has just been cancelled. If it can't be, the task is retried rather
+	// than leaving the result running until the reconciler gives up on it.
+	err = h.transitionResult(context.WithoutCancel(ctx), payload.ResultID, database.StatusRunning, database.StatusSucceeded, "")
+	if err != nil {
+		return fmt.Errorf("failed to record result success: %w", err)
 	}
 
+	h.logger.InfoContext(ctx, "completed bloodhound analysis", "duration", time.Since(start).String())
 	return nil
 }
 
-func (h *TaskHandler) updateResultStatus(resultID int, status string, setStartTime, setEndTime bool) error {
-	err := h.db.UpdateResultStatus(resultID, status)
+// evolutionHistory returns the archived data files of the organization's
+// previous runs that this run's report shows its evolution over.
+func (h *TaskHandler) evolutionHistory(ctx context.Context, payload BloodhoundTaskPayload) []database.EvolutionArchive {
+	runs := payload.analysisOptions().EvolutionRuns
+	if runs == nil || *runs <= 0 {
+		return nil
+	}
+
+	history, err := h.db.GetEvolutionArchives(ctx, payload.OrgName, payload.ResultID, *runs)
 	if err != nil {
-		return err
+		h.logger.WarnContext(ctx, "failed to look up previous runs, continuing without evolution", "error", err)
+		return nil
 	}
 
-	if setStartTime {
-		err = h.db.UpdateResultStartTime(resultID, time.Now())
+	return history
+}
+
+// executeBloodhoundWorkflow analyses the collection and uploads the report.
+// The data files in history are fetched for AD-miner's evolution view, each
+// prefixed with its result's ID since runs' data files can share a name, and
+// the run's own data file is archived for later runs; it returns where. The
+// evolution view is an extra, so failing to fetch or archive data files
+// doesn't fail the run.
+func (h *TaskHandler) executeBloodhoundWorkflow(ctx context.Context, payload BloodhoundTaskPayload, history []database.EvolutionArchive) (string, error) {
+	// cleanup artifacts. This has to happen even if the task was cancelled,
+	// otherwise an interrupted run leaves its BloodHound instance behind.
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer h.adminerSvc.Cleanup(cleanupCtx, payload.OrgName)
+	defer h.bloodhoundSvc.DeleteInstance(cleanupCtx, payload.OrgName)
+
+	err := h.runStep(ctx, "download", func(ctx context.Context) error {
+		return h.s3Svc.DownloadFile(ctx, payload.OrgName, payload.inputPath(), "sharphound.zip")
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to download sharphound.zip: %w", err)
+	}
+
+	if len(history) > 0 {
+		err = h.runStep(ctx, "fetch_evolution", func(ctx context.Context) error {
+			var errs []error
+			for _, archive := range history {
+				filename := fmt.Sprintf("%d_%s", archive.ResultID, path.Base(archive.Path))
+				errs = append(errs, h.s3Svc.FetchFile(ctx, payload.OrgName, archive.Path, path.Join(services.EvolutionDir, filename)))
+			}
+			return errors.Join(errs...)
+		})
 		if err != nil {
-			return err
+			h.logger.WarnContext(ctx, "continuing without some of the previous runs' data", "error", err)
 		}
 	}
 
-	if setEndTime {
-		err = h.db.UpdateResultEndTime(resultID, time.Now())
-		if err != nil {
-			return err
+	err = h.runStep(ctx, "start_bloodhound", func(ctx context.Context) error {
+		_, err := h.bloodhoundSvc.StartInstance(ctx, payload.OrgName)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to start bloodhound instance: %w", err)
+	}
+
+	err = h.runStep(ctx, "load_data", func(ctx context.Context) error {
+		return h.bloodhoundSvc.LoadData(ctx, payload.OrgName, "sharphound.zip")
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to load data: %w", err)
+	}
+
+	err = h.runStep(ctx, "adminer", func(ctx context.Context) error {
+		return h.adminerSvc.RunAnalysis(ctx, payload.OrgName, payload.analysisOptions())
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to run ADMiner: %w", err)
+	}
+
+	// The report is renamed when it is uploaded, so its data file has to be
+	// found first.
+	dataFile, dataErr := h.adminerSvc.DataFile(ctx, payload.OrgName)
+
+	err = h.runStep(ctx, "upload", func(ctx context.Context) error {
+		return h.s3Svc.UploadResults(ctx, payload.S3BucketPath, payload.OrgName)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload results: %w", err)
+	}
+
+	// Archiving copies the data file from the uploaded report, so a run that
+	// fails to upload leaves no archive behind.
+	archive := services.EvolutionArchivePath(payload.ResultID, dataFile)
+
+	err = h.runStep(ctx, "archive_evolution", func(ctx context.Context) error {
+		if dataErr != nil {
+			return dataErr
 		}
+		return h.s3Svc.CopyFile(ctx, fmt.Sprintf("%s/extracted/%s", payload.S3BucketPath, dataFile), archive)
+	})
+	if err != nil {
+		h.logger.WarnContext(ctx, "report uploaded without archiving its data for evolution", "error", err)
+		return "", nil
+	}
+
+	return archive, nil
+}
+
+// runStep runs a single pipeline step in its own span and records how long it
+// took. Anything logged during the step is tagged with its name.
+func (h *TaskHandler) runStep(ctx context.Context, step string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "step "+step)
+	defer span.End()
+
+	ctx = logging.With(ctx, "step", step)
+	h.logger.InfoContext(ctx, "starting pipeline step")
+
+	start := time.Now()
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		h.logger.ErrorContext(ctx, "pipeline step failed", "duration", time.Since(start).String(), "error", err)
+	} else {
+		h.logger.InfoContext(ctx, "completed pipeline step", "duration", time.Since(start).String())
+	}
+
+	metrics.PipelineStepDuration.WithLabelValues(step, metrics.Outcome(err)).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		return &stepError{step: step, err: err}
 	}
 	return nil
 }
+
+// stepError records which pipeline step an error came from.
+type stepError struct {
+	step string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// maxErrorMessageLength bounds the failure message stored on a result. Tool
+// output is included in errors and can run to megabytes.
+const maxErrorMessageLength = 4096
+
+// classifyFailure describes a failed run for the result record.
+func classifyFailure(ctx context.Context, err error) database.ResultFailure {
+	failure := database.ResultFailure{
+		Code:    services.ErrorCode(err),
+		Message: err.Error(),
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		failure.Code = services.CodeTimeout
+	}
+
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
+		failure.Step = stepErr.step
+	}
+
+	if len(failure.Message) > maxErrorMessageLength {
+		// Cutting a multi-byte character in half would leave invalid UTF-8,
+		// which Postgres refuses to store.
+		failure.Message = strings.ToValidUTF8(failure.Message[:maxErrorMessageLength], "") + "..."
+	}
+
+	return failure
+}
+
+func (h *TaskHandler) transitionResult(ctx context.Context, resultID int, from, to, reason string) error {
+	err := h.db.TransitionResultStatus(ctx, resultID, from, to, "system", reason)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "failed to update result status", "from", from, "to", to, "error", err)
+	}
+	return err
+}
+
+// resultFinished reports whether the result has been deleted or has reached a
+// final status, typically because it was cancelled while its task started.
+func (h *TaskHandler) resultFinished(ctx context.Context, resultID int) bool {
+	result, found, err := h.db.GetResult(ctx, resultID)
+	if err != nil {
+		return false
+	}
+
+	return !found || database.ResultStatusFinal(result.Status)
+}
+
+// failureStatus returns the status of a result whose run has just failed with
+// err: it is retrying if asynq will run the task again, and failed otherwise.
+func failureStatus(ctx context.Context, err error) string {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+
+	if retried < maxRetry && !services.IsPermanent(err) {
+		return database.StatusRetrying
+	}
+
+	return database.StatusFailed
+}
+
+func (h *TaskHandler) recordRetry(ctx context.Context, payload BloodhoundTaskPayload, retryCount int) {
+	event := database.AuditEvent{
+		Actor:      "system",
+		Action:     database.AuditResultRetried,
+		TargetType: database.NullString{String: "result", Valid: true},
+		TargetID:   database.NullString{String: strconv.Itoa(payload.ResultID), Valid: true},
+		Metadata: database.AuditMetadata{
+			"SimulationID": payload.SimulationID,
+			"RetryCount":   retryCount,
+		},
+	}
+
+	if err := h.db.InsertAuditEvent(ctx, event); err != nil {
+		h.logger.ErrorContext(ctx, "failed to record retry audit event", "error", err)
+	}
+}
+
+// recordInterruption puts a result interrupted by shutdown back to queued.
+// asynq has already returned the task to the queue, so it is picked up again
+// on the next start without counting as a retry.
+func (h *TaskHandler) recordInterruption(ctx context.Context, payload BloodhoundTaskPayload) {
+	h.transitionResult(ctx, payload.ResultID, database.StatusRunning, database.StatusQueued, "interrupted by shutdown")
+
+	event := database.AuditEvent{
+		Actor:      "system",
+		Action:     database.AuditResultInterrupted,
+		TargetType: database.NullString{String: "result", Valid: true},
+		TargetID:   database.NullString{String: strconv.Itoa(payload.ResultID), Valid: true},
+		Metadata: database.AuditMetadata{
+			"SimulationID": payload.SimulationID,
+			"Reason":       "shutdown",
+		},
+	}
+
+	if err := h.db.InsertAuditEvent(ctx, event); err != nil {
+		h.logger.ErrorContext(ctx, "failed to record interruption audit event", "error", err)
+	}
+}
@@ -0,0 +1,880 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/services"
+	"com.activehacks.ad-miner-backend/internal/services/fake"
+	"github.com/hibiken/asynq"
+)
+
+const (
+	testOrg        = "acme"
+	testBucketPath = "s3://active-hacks/results/sim-1"
+)
+
+// fakeResults is an in-memory ResultStore that moves results between
+// statuses the way the database does, refusing illegal moves and moves from a
+// status the result is no longer in.
+type fakeResults struct {
+	mu       sync.Mutex
+	results  map[int]database.Result
+	changes  []string
+	failures map[int]database.ResultFailure
+	events   []string
+	archives []database.EvolutionArchive
+
+	// evolutionErr is returned by SetResultEvolutionData.
+	evolutionErr error
+	// beforeTransition, if set, runs before each status change and can
+	// fail it by returning an error.
+	beforeTransition func(from, to string) error
+}
+
+func newFakeResults() *fakeResults {
+	return &fakeResults{
+		results:  map[int]database.Result{},
+		failures: map[int]database.ResultFailure{},
+	}
+}
+
+func (f *fakeResults) put(result database.Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.results[result.ID] = result
+}
+
+func (f *fakeResults) get(id int) database.Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.results[id]
+}
+
+// setStatus changes a result's status behind the handler's back, as the API
+// does when a result is cancelled.
+func (f *fakeResults) setStatus(id int, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := f.results[id]
+	result.Status = status
+	f.results[id] = result
+}
+
+func (f *fakeResults) GetResult(ctx context.Context, id int) (database.Result, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result, ok := f.results[id]
+	return result, ok, nil
+}
+
+func (f *fakeResults) TransitionResultStatus(ctx context.Context, id int, from, to, actor, reason string) error {
+	return f.transition(id, from, to, nil)
+}
+
+func (f *fakeResults) FailResultStatus(ctx context.Context, id int, from, to, actor string, failure database.ResultFailure) error {
+	return f.transition(id, from, to, &failure)
+}
+
+func (f *fakeResults) transition(id int, from, to string, failure *database.ResultFailure) error {
+	if !database.CanTransitionResult(from, to) {
+		return fmt.Errorf("%w: %s to %s", database.ErrIllegalTransition, from, to)
+	}
+
+	if f.beforeTransition != nil {
+		if err := f.beforeTransition(from, to); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result, ok := f.results[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	if result.Status != from {
+		return database.ErrTransitionConflict
+	}
+
+	result.Status = to
+	f.results[id] = result
+	f.changes = append(f.changes, from+" -> "+to)
+
+	if failure != nil {
+		f.failures[id] = *failure
+	}
+
+	return nil
+}
+
+func (f *fakeResults) SetResultEvolutionData(ctx context.Context, id int, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.evolutionErr != nil {
+		return f.evolutionErr
+	}
+
+	result := f.results[id]
+	result.EvolutionDataPath = database.NullString{String: path, Valid: true}
+	f.results[id] = result
+	return nil
+}
+
+func (f *fakeResults) GetEvolutionArchives(ctx context.Context, orgName string, resultID, limit int) ([]database.EvolutionArchive, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.archives), nil
+}
+
+func (f *fakeResults) InsertAuditEvent(ctx context.Context, event database.AuditEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, event.Action)
+	return nil
+}
+
+func (f *fakeResults) statusChanges() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.changes)
+}
+
+func (f *fakeResults) auditEvents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.events)
+}
+
+func newTestHandler(t *testing.T) (*TaskHandler, *fake.Services, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	fakes := fake.New(dir)
+	fakes.Storage.Put(testBucketPath+"/sharphound.zip", fake.SharpHoundZip("ACME.LOCAL"))
+
+	handler := NewTaskHandler(newFakeResults(), fakes.Storage, fakes.Bloodhound, fakes.ADMiner, slog.New(slog.DiscardHandler))
+	return handler, fakes, dir
+}
+
+// testResults returns the store of a handler made by newTestHandler.
+func testResults(handler *TaskHandler) *fakeResults {
+	return handler.db.(*fakeResults)
+}
+
+func testPayload() BloodhoundTaskPayload {
+	return BloodhoundTaskPayload{
+		ResultID:     1,
+		SimulationID: "sim-1",
+		OrgName:      testOrg,
+		S3BucketPath: testBucketPath,
+	}
+}
+
+// assertCleanedUp checks that the run left nothing behind on the host.
+func assertCleanedUp(t *testing.T, fakes *fake.Services, dir string) {
+	t.Helper()
+
+	if fakes.Bloodhound.Running(testOrg) {
+		t.Error("bloodhound instance is still running")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, testOrg)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("working directory still exists: %v", err)
+	}
+}
+
+func TestExecuteBloodhoundWorkflow(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+
+	archive, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantCalls := []string{
+		"Storage.DownloadFile",
+		"Bloodhound.StartInstance",
+		"Bloodhound.LoadData",
+		"ADMiner.RunAnalysis",
+		"ADMiner.DataFile",
+		"Storage.UploadResults",
+		"Storage.CopyFile",
+		"Bloodhound.DeleteInstance",
+		"ADMiner.Cleanup",
+	}
+	if got := fakes.Calls.List(); !slices.Equal(got, wantCalls) {
+		t.Errorf("calls = %v, want %v", got, wantCalls)
+	}
+
+	for _, name := range []string{"index.html", "js/data.js", "html/users_admin.html"} {
+		if _, ok := fakes.Storage.Get(testBucketPath + "/extracted/" + name); !ok {
+			t.Errorf("%s was not uploaded; bucket has %v", name, fakes.Storage.Paths())
+		}
+	}
+
+	if _, ok := fakes.Storage.Get(archive); !ok {
+		t.Errorf("data file was not archived to %q; bucket has %v", archive, fakes.Storage.Paths())
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestExecuteBloodhoundWorkflowStepFailure(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		step      string
+		method    string
+		wantCalls int
+	}{
+		{step: "download", method: "Storage.DownloadFile", wantCalls: 1},
+		{step: "start_bloodhound", method: "Bloodhound.StartInstance", wantCalls: 2},
+		{step: "load_data", method: "Bloodhound.LoadData", wantCalls: 3},
+		{step: "adminer", method: "ADMiner.RunAnalysis", wantCalls: 4},
+		{step: "upload", method: "Storage.UploadResults", wantCalls: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			handler, fakes, dir := newTestHandler(t)
+			fakes.Calls.Fail(tt.method, &services.Error{Code: "test_failure", Err: errBoom}, 0)
+
+			_, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+			if !errors.Is(err, errBoom) {
+				t.Fatalf("error = %v, want %v", err, errBoom)
+			}
+
+			failure := classifyFailure(context.Background(), err)
+			if failure.Step != tt.step {
+				t.Errorf("step = %q, want %q", failure.Step, tt.step)
+			}
+			if failure.Code != "test_failure" {
+				t.Errorf("code = %q, want %q", failure.Code, "test_failure")
+			}
+
+			// The steps after the failed one don't run, but cleanup does.
+			calls := fakes.Calls.List()
+			if got := len(calls) - 2; got != tt.wantCalls {
+				t.Errorf("%d pipeline calls, want %d: %v", got, tt.wantCalls, calls)
+			}
+			if calls[len(calls)-2] != "Bloodhound.DeleteInstance" || calls[len(calls)-1] != "ADMiner.Cleanup" {
+				t.Errorf("cleanup didn't run last: %v", calls)
+			}
+
+			assertCleanedUp(t, fakes, dir)
+		})
+	}
+}
+
+func TestExecuteBloodhoundWorkflowPermanentFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		wantCode string
+	}{
+		{name: "missing input", input: nil, wantCode: services.CodeInputNotFound},
+		{name: "invalid zip", input: []byte("not a zip"), wantCode: services.CodeInvalidInput},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, fakes, dir := newTestHandler(t)
+			if tt.input != nil {
+				fakes.Storage.Put(testBucketPath+"/sharphound.zip", tt.input)
+			} else {
+				fakes.Storage.DeleteFile(context.Background(), testBucketPath, "sharphound.zip")
+			}
+
+			_, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !services.IsPermanent(err) {
+				t.Errorf("error is not permanent, so the task would be retried: %v", err)
+			}
+			if got := failureStatus(context.Background(), err); got != database.StatusFailed {
+				t.Errorf("status = %q, want %q", got, database.StatusFailed)
+			}
+
+			failure := classifyFailure(context.Background(), err)
+			if failure.Code != tt.wantCode || failure.Step != "download" {
+				t.Errorf("failure = %+v, want code %q at download", failure, tt.wantCode)
+			}
+
+			if n := fakes.Calls.Count("Bloodhound.StartInstance"); n != 0 {
+				t.Errorf("bloodhound was started %d times after the download failed", n)
+			}
+
+			assertCleanedUp(t, fakes, dir)
+		})
+	}
+}
+
+func TestExecuteBloodhoundWorkflowCancelled(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel mid-analysis, as a worker shutting down or an admin deleting the
+	// result would, and fail the way a killed AD-miner does.
+	fakes.Calls.On("ADMiner.RunAnalysis", func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	_, err := handler.executeBloodhoundWorkflow(ctx, testPayload(), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want %v", err, context.Canceled)
+	}
+
+	if n := fakes.Calls.Count("Storage.UploadResults"); n != 0 {
+		t.Errorf("results were uploaded %d times after cancellation", n)
+	}
+
+	// Cleanup gets a context that isn't cancelled with the run's, so the
+	// instance is still torn down.
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestExecuteBloodhoundWorkflowTimeout(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	fakes.Calls.On("Bloodhound.LoadData", func(ctx context.Context) error {
+		<-ctx.Done()
+		return &services.Error{Code: services.CodeDataLoadFailed, Err: ctx.Err()}
+	})
+
+	_, err := handler.executeBloodhoundWorkflow(ctx, testPayload(), nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// A timed out run is recorded as a timeout whatever the step reported.
+	failure := classifyFailure(ctx, err)
+	if failure.Code != services.CodeTimeout || failure.Step != "load_data" {
+		t.Errorf("failure = %+v, want code %q at load_data", failure, services.CodeTimeout)
+	}
+
+	if services.IsPermanent(err) {
+		t.Error("a timeout shouldn't be permanent")
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestExecuteBloodhoundWorkflowRetry(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+
+	// The first attempt fails to load the data; asynq retries a transient
+	// failure with the same payload.
+	fakes.Calls.Fail("Bloodhound.LoadData", &services.Error{Code: services.CodeDataLoadFailed, Err: errors.New("neo4j is not ready")}, 1)
+
+	_, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+	if err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+	if services.IsPermanent(err) {
+		t.Fatalf("transient error is permanent, so the task wouldn't be retried: %v", err)
+	}
+
+	assertCleanedUp(t, fakes, dir)
+
+	// The retry starts from scratch: the first attempt's instance and
+	// download are gone, so it would fail if they weren't redone.
+	_, err = handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+
+	for method, want := range map[string]int{
+		"Storage.DownloadFile":      2,
+		"Bloodhound.StartInstance":  2,
+		"Bloodhound.DeleteInstance": 2,
+		"ADMiner.RunAnalysis":       1,
+		"Storage.UploadResults":     1,
+	} {
+		if got := fakes.Calls.Count(method); got != want {
+			t.Errorf("%s called %d times, want %d", method, got, want)
+		}
+	}
+
+	if _, ok := fakes.Storage.Get(testBucketPath + "/extracted/index.html"); !ok {
+		t.Errorf("report was not uploaded; bucket has %v", fakes.Storage.Paths())
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestExecuteBloodhoundWorkflowAnalysisOptions(t *testing.T) {
+	level, rdp, gpoLow := 3, false, true
+
+	tests := []struct {
+		name     string
+		opts     analysis.Options
+		wantArgs []string
+	}{
+		{
+			// Tasks queued before options existed keep running with --rdp.
+			name:     "none",
+			wantArgs: []string{"--rdp"},
+		},
+		{
+			name:     "set",
+			opts:     analysis.Options{Level: &level, RDP: &rdp, GPOLow: &gpoLow},
+			wantArgs: []string{"--level", "3", "--gpo_low"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, fakes, _ := newTestHandler(t)
+
+			payload := testPayload()
+			payload.AnalysisOptions = tt.opts
+
+			_, err := handler.executeBloodhoundWorkflow(context.Background(), payload, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := fakes.ADMiner.Args(testOrg); !slices.Equal(got, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", got, tt.wantArgs)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		handler, fakes, dir := newTestHandler(t)
+
+		// Options are validated by the API, but a bad payload must still
+		// not reach AD-miner's command line.
+		level := 1000
+		payload := testPayload()
+		payload.AnalysisOptions = analysis.Options{Level: &level}
+
+		_, err := handler.executeBloodhoundWorkflow(context.Background(), payload, nil)
+		if !services.IsPermanent(err) {
+			t.Fatalf("error = %v, want a permanent error", err)
+		}
+
+		if n := fakes.Calls.Count("Storage.UploadResults"); n != 0 {
+			t.Errorf("results were uploaded %d times", n)
+		}
+
+		assertCleanedUp(t, fakes, dir)
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		handler, fakes, _ := newTestHandler(t)
+
+		// Tasks queued while submissions could set a cluster must not send
+		// the worker's Neo4j credentials to it.
+		var payload BloodhoundTaskPayload
+		err := json.Unmarshal([]byte(`{"result_id":1,"org_name":"acme","s3_bucket_path":"`+testBucketPath+`","analysis_options":{"Cluster":"attacker:7687:8"}}`), &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = handler.executeBloodhoundWorkflow(context.Background(), payload, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if args := fakes.ADMiner.Args(testOrg); slices.Contains(args, "--cluster") {
+			t.Errorf("args = %v, want no --cluster", args)
+		}
+	})
+}
+
+func TestExecuteBloodhoundWorkflowEvolution(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+
+	first, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+	if err != nil {
+		t.Fatalf("first run failed: %v", err)
+	}
+
+	// The second run is given the first run's archive, an older one with the
+	// same file name, and one that has gone missing since, which it does
+	// without.
+	data, _ := fakes.Storage.Get(first)
+	older := services.EvolutionArchivePath(0, path.Base(first))
+	fakes.Storage.Put(older, data)
+
+	payload := testPayload()
+	payload.ResultID = 2
+	history := []database.EvolutionArchive{
+		{ResultID: 1, Path: first},
+		{ResultID: 0, Path: older},
+		{ResultID: -1, Path: services.EvolutionArchivePath(-1, "data_acme_20230101.json")},
+	}
+
+	second, err := handler.executeBloodhoundWorkflow(context.Background(), payload, history)
+	if err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+
+	if second == "" || second == first {
+		t.Errorf("second run archived to %q, want a path of its own (first run archived to %q)", second, first)
+	}
+
+	if n := fakes.Calls.Count("Storage.FetchFile"); n != len(history) {
+		t.Errorf("fetched %d archives, want %d", n, len(history))
+	}
+
+	if args := fakes.ADMiner.Args(testOrg); !slices.Contains(args, "--evolution") {
+		t.Errorf("AD-miner wasn't run with --evolution: %v", args)
+	}
+
+	data, _ = fakes.Storage.Get(testBucketPath + "/extracted/js/data.js")
+	if !strings.Contains(string(data), `"evolution": 2`) {
+		t.Errorf("report doesn't show both previous runs: %s", data)
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestExecuteBloodhoundWorkflowArchiveFailure(t *testing.T) {
+	handler, fakes, dir := newTestHandler(t)
+	fakes.Calls.Fail("Storage.CopyFile", &services.Error{Code: services.CodeStorageUnavailable, Err: errors.New("slow down")}, 0)
+
+	// Failing to archive only costs later runs their evolution view.
+	archive, err := handler.executeBloodhoundWorkflow(context.Background(), testPayload(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if archive != "" {
+		t.Errorf("archive = %q, want none", archive)
+	}
+
+	if _, ok := fakes.Storage.Get(testBucketPath + "/extracted/index.html"); !ok {
+		t.Errorf("report was not uploaded; bucket has %v", fakes.Storage.Paths())
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func testTask(t *testing.T) *asynq.Task {
+	t.Helper()
+
+	data, err := MarshalBloodhoundAnalysis(context.Background(), testPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return asynq.NewTask(TypeBloodhoundAnalysis, data)
+}
+
+// newTestProcessHandler returns a handler whose store holds the result of
+// testPayload, in status.
+func newTestProcessHandler(t *testing.T, status string) (*TaskHandler, *fake.Services, *fakeResults, string) {
+	t.Helper()
+
+	handler, fakes, dir := newTestHandler(t)
+	results := testResults(handler)
+	results.put(database.Result{
+		ID:           1,
+		SimulationID: "sim-1",
+		OrgName:      testOrg,
+		Status:       status,
+		S3BucketPath: database.NullString{String: testBucketPath, Valid: true},
+	})
+
+	return handler, fakes, results, dir
+}
+
+func TestProcessBloodhoundAnalysis(t *testing.T) {
+	handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+
+	err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"queued -> running", "running -> succeeded"}
+	if got := results.statusChanges(); !slices.Equal(got, want) {
+		t.Errorf("status changes = %v, want %v", got, want)
+	}
+
+	// The archive is recorded for the organization's next run.
+	archive := results.get(1).EvolutionDataPath
+	if !archive.Valid {
+		t.Fatal("evolution data archive was not recorded")
+	}
+	if _, ok := fakes.Storage.Get(archive.String); !ok {
+		t.Errorf("recorded archive %q doesn't exist; bucket has %v", archive.String, fakes.Storage.Paths())
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestProcessBloodhoundAnalysisFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		err           error
+		wantCode      string
+		wantStep      string
+		wantSkipRetry bool
+	}{
+		{
+			name:     "transient",
+			method:   "Bloodhound.LoadData",
+			err:      &services.Error{Code: services.CodeDataLoadFailed, Err: errors.New("neo4j is not ready")},
+			wantCode: services.CodeDataLoadFailed,
+			wantStep: "load_data",
+		},
+		{
+			name:          "permanent",
+			method:        "Storage.DownloadFile",
+			err:           &services.Error{Code: services.CodeInvalidInput, Permanent: true, Err: errors.New("not a zip")},
+			wantCode:      services.CodeInvalidInput,
+			wantStep:      "download",
+			wantSkipRetry: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+			fakes.Calls.Fail(tt.method, tt.err, 0)
+
+			err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			// Retrying a permanent failure would only fail the same way.
+			if errors.Is(err, asynq.SkipRetry) != tt.wantSkipRetry {
+				t.Errorf("skip retry = %t, want %t: %v", errors.Is(err, asynq.SkipRetry), tt.wantSkipRetry, err)
+			}
+
+			// Outside asynq the task has no retries left, so the result
+			// fails either way.
+			want := []string{"queued -> running", "running -> failed"}
+			if got := results.statusChanges(); !slices.Equal(got, want) {
+				t.Errorf("status changes = %v, want %v", got, want)
+			}
+
+			failure := results.failures[1]
+			if failure.Code != tt.wantCode || failure.Step != tt.wantStep {
+				t.Errorf("failure = %+v, want code %q at %s", failure, tt.wantCode, tt.wantStep)
+			}
+
+			assertCleanedUp(t, fakes, dir)
+		})
+	}
+}
+
+func TestProcessBloodhoundAnalysisCancelledDuringRun(t *testing.T) {
+	handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+
+	// The result is cancelled while AD-miner runs, which stops the run.
+	fakes.Calls.On("ADMiner.RunAnalysis", func(ctx context.Context) error {
+		results.setStatus(1, database.StatusCancelled)
+		return &services.Error{Code: services.CodeAnalysisFailed, Err: errors.New("killed")}
+	})
+
+	err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+	if !errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("error = %v, want the task not to be retried", err)
+	}
+
+	if got := results.get(1).Status; got != database.StatusCancelled {
+		t.Errorf("status = %q, want it left %q", got, database.StatusCancelled)
+	}
+
+	if _, ok := results.failures[1]; ok {
+		t.Error("failure was recorded on a cancelled result")
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestProcessBloodhoundAnalysisNotStarted(t *testing.T) {
+	t.Run("cancelled while starting", func(t *testing.T) {
+		handler, fakes, results, _ := newTestProcessHandler(t, database.StatusQueued)
+
+		// The result is cancelled between being read and being started.
+		results.beforeTransition = func(from, to string) error {
+			results.setStatus(1, database.StatusCancelled)
+			return nil
+		}
+
+		err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if calls := fakes.Calls.List(); len(calls) != 0 {
+			t.Errorf("pipeline ran for a cancelled result: %v", calls)
+		}
+
+		if got := results.get(1).Status; got != database.StatusCancelled {
+			t.Errorf("status = %q, want it left %q", got, database.StatusCancelled)
+		}
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		handler, fakes, results, _ := newTestProcessHandler(t, database.StatusQueued)
+
+		results.beforeTransition = func(from, to string) error {
+			return errors.New("connection reset")
+		}
+
+		err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+		if err == nil || errors.Is(err, asynq.SkipRetry) {
+			t.Errorf("error = %v, want an error that leaves the task to be retried", err)
+		}
+
+		if calls := fakes.Calls.List(); len(calls) != 0 {
+			t.Errorf("pipeline ran for a result that wasn't started: %v", calls)
+		}
+
+		if got := results.get(1).Status; got != database.StatusQueued {
+			t.Errorf("status = %q, want it left %q", got, database.StatusQueued)
+		}
+	})
+}
+
+func TestProcessBloodhoundAnalysisSuccessNotRecorded(t *testing.T) {
+	handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+
+	results.beforeTransition = func(from, to string) error {
+		if to == database.StatusSucceeded {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+	if err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("error = %v, want an error that leaves the task to be retried", err)
+	}
+
+	if got := results.get(1).Status; got != database.StatusRunning {
+		t.Errorf("status = %q, want %q for the retry to take over", got, database.StatusRunning)
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestProcessBloodhoundAnalysisInterrupted(t *testing.T) {
+	handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The worker shuts down mid-analysis.
+	fakes.Calls.On("ADMiner.RunAnalysis", func(ctx context.Context) error {
+		handler.interrupting.Store(true)
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	err := handler.ProcessBloodhoundAnalysis(ctx, testTask(t))
+	if err == nil || errors.Is(err, asynq.SkipRetry) {
+		t.Errorf("error = %v, want an error that leaves the task to be run again", err)
+	}
+
+	want := []string{"queued -> running", "running -> queued"}
+	if got := results.statusChanges(); !slices.Equal(got, want) {
+		t.Errorf("status changes = %v, want %v", got, want)
+	}
+
+	if !slices.Contains(results.auditEvents(), database.AuditResultInterrupted) {
+		t.Errorf("audit events = %v, want %s", results.auditEvents(), database.AuditResultInterrupted)
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
+
+func TestProcessBloodhoundAnalysisSkipped(t *testing.T) {
+	t.Run("finished result", func(t *testing.T) {
+		handler, fakes, results, _ := newTestProcessHandler(t, database.StatusCancelled)
+
+		err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if calls := fakes.Calls.List(); len(calls) != 0 {
+			t.Errorf("pipeline ran for a cancelled result: %v", calls)
+		}
+
+		if got := results.statusChanges(); len(got) != 0 {
+			t.Errorf("status changes = %v, want none", got)
+		}
+	})
+
+	t.Run("missing result", func(t *testing.T) {
+		handler, fakes, _ := newTestHandler(t)
+
+		err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+		if !errors.Is(err, asynq.SkipRetry) {
+			t.Errorf("error = %v, want the task not to be retried", err)
+		}
+
+		if calls := fakes.Calls.List(); len(calls) != 0 {
+			t.Errorf("pipeline ran for a missing result: %v", calls)
+		}
+	})
+}
+
+func TestProcessBloodhoundAnalysisArchiveNotRecorded(t *testing.T) {
+	handler, fakes, results, dir := newTestProcessHandler(t, database.StatusQueued)
+	results.evolutionErr = errors.New("connection reset")
+
+	err := handler.ProcessBloodhoundAnalysis(context.Background(), testTask(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := results.get(1).Status; got != database.StatusSucceeded {
+		t.Errorf("status = %q, want %q", got, database.StatusSucceeded)
+	}
+
+	// An archive no result points at would never be read or purged.
+	prefix := services.EvolutionArchivePath(1, "")
+	for _, p := range fakes.Storage.Paths() {
+		if strings.HasPrefix(p, prefix) {
+			t.Errorf("unrecorded archive %q was left in the bucket", p)
+		}
+	}
+
+	assertCleanedUp(t, fakes, dir)
+}
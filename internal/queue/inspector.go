@@ -0,0 +1,293 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// Task states that can be listed through the Inspector.
+const (
+	StatePending   = "pending"
+	StateActive    = "active"
+	StateScheduled = "scheduled"
+	StateRetry     = "retry"
+	StateArchived  = "archived"
+)
+
+var TaskStates = []string{StatePending, StateActive, StateScheduled, StateRetry, StateArchived}
+
+var (
+	ErrTaskNotFound     = errors.New("task not found")
+	ErrTaskStateInvalid = errors.New("task is not in a state that allows this operation")
+)
+
+type QueueSummary struct {
+	Queue          string
+	Paused         bool
+	Size           int
+	Pending        int
+	Active         int
+	Scheduled      int
+	Retry          int
+	Archived       int
+	Completed      int
+	ProcessedToday int
+	FailedToday    int
+	LatencySeconds float64
+}
+
+type TaskSummary struct {
+	ID            string
+	State         string
+	Type          string
+	ResultID      int
+	Payload       BloodhoundTaskPayload
+	Position      int `json:",omitempty"`
+	Retried       int
+	MaxRetry      int
+	LastError     string     `json:",omitempty"`
+	LastFailedAt  *time.Time `json:",omitempty"`
+	NextProcessAt *time.Time `json:",omitempty"`
+}
+
+type Inspector struct {
+	inspector *asynq.Inspector
+}
+
+func NewInspector(redisAddr, password string) *Inspector {
+	redisOpt := asynq.RedisClientOpt{
+		Addr:     redisAddr,
+		Password: password,
+	}
+
+	return &Inspector{
+		inspector: asynq.NewInspector(redisOpt),
+	}
+}
+
+func (i *Inspector) Close() error {
+	return i.inspector.Close()
+}
+
+func (i *Inspector) QueueInfo() (*asynq.QueueInfo, error) {
+	return i.inspector.GetQueueInfo(QueueBloodhound)
+}
+
+// CheckWorkerHeartbeat reports an error unless at least one worker serving the
+// bloodhound queue is active. Asynq expires a worker's registration shortly
+// after it stops sending heartbeats, so a crashed worker drops out on its own.
+func (i *Inspector) CheckWorkerHeartbeat() error {
+	servers, err := i.inspector.Servers()
+	if err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		if _, ok := server.Queues[QueueBloodhound]; ok && server.Status == "active" {
+			return nil
+		}
+	}
+
+	return errors.New("no active worker is serving the bloodhound queue")
+}
+
+// Queue summarises the bloodhound queue. A queue that has never had a task
+// enqueued doesn't exist in Redis yet and is reported as empty.
+func (i *Inspector) Queue() (QueueSummary, error) {
+	info, err := i.inspector.GetQueueInfo(QueueBloodhound)
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return QueueSummary{Queue: QueueBloodhound}, nil
+	}
+	if err != nil {
+		return QueueSummary{}, err
+	}
+
+	return QueueSummary{
+		Queue:          info.Queue,
+		Paused:         info.Paused,
+		Size:           info.Size,
+		Pending:        info.Pending,
+		Active:         info.Active,
+		Scheduled:      info.Scheduled,
+		Retry:          info.Retry,
+		Archived:       info.Archived,
+		Completed:      info.Completed,
+		ProcessedToday: info.Processed,
+		FailedToday:    info.Failed,
+		LatencySeconds: info.Latency.Seconds(),
+	}, nil
+}
+
+// ListTasks returns a page of tasks in the given state. Pending tasks are
+// listed in the order they will be processed, with their 1-based position.
+func (i *Inspector) ListTasks(state string, page, pageSize int) ([]TaskSummary, error) {
+	opts := []asynq.ListOption{asynq.Page(page), asynq.PageSize(pageSize)}
+
+	var tasks []*asynq.TaskInfo
+	var err error
+
+	switch state {
+	case StatePending:
+		tasks, err = i.inspector.ListPendingTasks(QueueBloodhound, opts...)
+	case StateActive:
+		tasks, err = i.inspector.ListActiveTasks(QueueBloodhound, opts...)
+	case StateScheduled:
+		tasks, err = i.inspector.ListScheduledTasks(QueueBloodhound, opts...)
+	case StateRetry:
+		tasks, err = i.inspector.ListRetryTasks(QueueBloodhound, opts...)
+	case StateArchived:
+		tasks, err = i.inspector.ListArchivedTasks(QueueBloodhound, opts...)
+	default:
+		return nil, fmt.Errorf("unknown task state %q", state)
+	}
+
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return []TaskSummary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]TaskSummary, len(tasks))
+	for n, task := range tasks {
+		summaries[n] = summarizeTask(task)
+
+		if state == StatePending {
+			summaries[n].Position = (page-1)*pageSize + n + 1
+		}
+	}
+
+	return summaries, nil
+}
+
+func (i *Inspector) GetTask(id string) (TaskSummary, error) {
+	task, err := i.getTask(id)
+	if err != nil {
+		return TaskSummary{}, err
+	}
+
+	return summarizeTask(task), nil
+}
+
+// DeleteTask removes a task that isn't currently running.
+func (i *Inspector) DeleteTask(id string) (TaskSummary, error) {
+	task, err := i.getTask(id)
+	if err != nil {
+		return TaskSummary{}, err
+	}
+
+	if task.State == asynq.TaskStateActive {
+		return TaskSummary{}, ErrTaskStateInvalid
+	}
+
+	err = i.inspector.DeleteTask(QueueBloodhound, id)
+	if err != nil {
+		return TaskSummary{}, translateTaskError(err)
+	}
+
+	return summarizeTask(task), nil
+}
+
+// CancelTask stops a task: a running task is signalled to cancel, and any
+// other task is removed from the queue.
+func (i *Inspector) CancelTask(id string) error {
+	task, err := i.getTask(id)
+	if err != nil {
+		return err
+	}
+
+	if task.State == asynq.TaskStateActive {
+		return i.inspector.CancelProcessing(id)
+	}
+
+	return translateTaskError(i.inspector.DeleteTask(QueueBloodhound, id))
+}
+
+// RunTask moves a scheduled, retrying or archived task to the front of the
+// pending queue.
+func (i *Inspector) RunTask(id string) (TaskSummary, error) {
+	task, err := i.getTask(id)
+	if err != nil {
+		return TaskSummary{}, err
+	}
+
+	switch task.State {
+	case asynq.TaskStateScheduled, asynq.TaskStateRetry, asynq.TaskStateArchived:
+	default:
+		return TaskSummary{}, ErrTaskStateInvalid
+	}
+
+	err = i.inspector.RunTask(QueueBloodhound, id)
+	if err != nil {
+		return TaskSummary{}, translateTaskError(err)
+	}
+
+	return summarizeTask(task), nil
+}
+
+// RunAllArchivedTasks requeues every archived task and returns how many were
+// moved.
+func (i *Inspector) RunAllArchivedTasks() (int, error) {
+	n, err := i.inspector.RunAllArchivedTasks(QueueBloodhound)
+	if errors.Is(err, asynq.ErrQueueNotFound) {
+		return 0, nil
+	}
+
+	return n, err
+}
+
+func (i *Inspector) Pause() error {
+	return i.inspector.PauseQueue(QueueBloodhound)
+}
+
+func (i *Inspector) Unpause() error {
+	return i.inspector.UnpauseQueue(QueueBloodhound)
+}
+
+func (i *Inspector) getTask(id string) (*asynq.TaskInfo, error) {
+	task, err := i.inspector.GetTaskInfo(QueueBloodhound, id)
+	if err != nil {
+		return nil, translateTaskError(err)
+	}
+
+	return task, nil
+}
+
+func translateTaskError(err error) error {
+	if errors.Is(err, asynq.ErrTaskNotFound) || errors.Is(err, asynq.ErrQueueNotFound) {
+		return ErrTaskNotFound
+	}
+
+	return err
+}
+
+func summarizeTask(task *asynq.TaskInfo) TaskSummary {
+	summary := TaskSummary{
+		ID:        task.ID,
+		State:     task.State.String(),
+		Type:      task.Type,
+		Retried:   task.Retried,
+		MaxRetry:  task.MaxRetry,
+		LastError: task.LastErr,
+	}
+
+	// A payload that can't be decoded is still listed, just without its
+	// details, so that an operator can find and delete it.
+	if err := json.Unmarshal(task.Payload, &summary.Payload); err == nil {
+		summary.ResultID = summary.Payload.ResultID
+	}
+
+	if !task.LastFailedAt.IsZero() {
+		summary.LastFailedAt = &task.LastFailedAt
+	}
+
+	if !task.NextProcessAt.IsZero() {
+		summary.NextProcessAt = &task.NextProcessAt
+	}
+
+	return summary
+}
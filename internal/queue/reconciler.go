@@ -0,0 +1,291 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/metrics"
+	"com.activehacks.ad-miner-backend/internal/services"
+	"github.com/hibiken/asynq"
+)
+
+// enqueueGracePeriod is how long a result may go without a task ID before the
+// reconciler assumes the request that created it failed to enqueue its task.
+const enqueueGracePeriod = 5 * time.Minute
+
+// Reconciler actions, recorded in audit events and metrics.
+const (
+	reconcileRequeued  = "requeued"
+	reconcileReset     = "reset"
+	reconcileSucceeded = "succeeded"
+	reconcileFailed    = "failed"
+	reconcileArchived  = "archived"
+)
+
+// Reconciler brings the results table back in line with the queue after
+// crashes and partial failures. It runs as a periodic maintenance task, so
+// that only one worker reconciles at a time, and once when a worker starts.
+//
+// For every unfinished result it looks up the result's task:
+//   - a result that was never enqueued is enqueued again, or failed if it
+//     predates the input path being recorded;
+//   - a running result whose task is back in the queue, because the worker
+//     running it died, is reset to queued;
+//   - a result whose task is archived or gone is failed.
+//
+// Queued tasks whose result no longer exists are archived, and results that
+// have been running for longer than the SLA are flagged.
+type Reconciler struct {
+	db        *database.DB
+	client    *Client
+	inspector *Inspector
+	sla       time.Duration
+	logger    *slog.Logger
+}
+
+func NewReconciler(db *database.DB, client *Client, inspector *Inspector, sla time.Duration, logger *slog.Logger) *Reconciler {
+	return &Reconciler{
+		db:        db,
+		client:    client,
+		inspector: inspector,
+		sla:       sla,
+		logger:    logger,
+	}
+}
+
+func (r *Reconciler) ProcessReconcile(ctx context.Context, t *asynq.Task) error {
+	results, err := r.db.GetUnfinishedResults(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, result := range results {
+		err := r.reconcileResult(ctx, result)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("result %d: %w", result.ID, err))
+		}
+	}
+
+	err = r.archiveOrphanedTasks(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *Reconciler) reconcileResult(ctx context.Context, result database.Result) error {
+	if result.Status == database.StatusRunning {
+		r.checkSLA(ctx, result)
+	}
+
+	if result.TaskID == "" {
+		if time.Since(result.CreatedAt) < enqueueGracePeriod {
+			return nil
+		}
+
+		if !result.S3BucketPath.Valid {
+			return r.transition(ctx, result, database.StatusFailed, reconcileFailed, "task was never enqueued")
+		}
+
+		return r.requeue(ctx, result)
+	}
+
+	task, err := r.inspector.getTask(result.TaskID)
+	if errors.Is(err, ErrTaskNotFound) {
+		// Tasks are removed once their handler returns, and the handler
+		// records the outcome before that, so the result can't be updated
+		// by anything else any more.
+		return r.transition(ctx, result, database.StatusFailed, reconcileFailed, "task no longer exists in the queue")
+	}
+	if err != nil {
+		return err
+	}
+
+	switch task.State {
+	case asynq.TaskStateArchived:
+		return r.transition(ctx, result, database.StatusFailed, reconcileFailed, "task was archived: "+task.LastErr)
+	case asynq.TaskStateCompleted:
+		return r.transition(ctx, result, database.StatusSucceeded, reconcileSucceeded, "task completed")
+	case asynq.TaskStatePending, asynq.TaskStateScheduled, asynq.TaskStateRetry:
+		if result.Status == database.StatusRunning {
+			return r.transition(ctx, result, database.StatusQueued, reconcileReset, "worker stopped mid-run, task was requeued")
+		}
+	}
+
+	return nil
+}
+
+func (r *Reconciler) checkSLA(ctx context.Context, result database.Result) {
+	if r.sla <= 0 || !result.StartTime.Valid || time.Since(result.StartTime.Time) <= r.sla {
+		return
+	}
+
+	flagged, err := r.db.FlagResultSLAExceeded(ctx, result.ID)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "failed to flag result over SLA", "result_id", result.ID, "error", err)
+		return
+	}
+
+	if !flagged {
+		return
+	}
+
+	runningFor := time.Since(result.StartTime.Time).Round(time.Second)
+
+	metrics.ResultsSLAExceeded.Inc()
+	r.logger.WarnContext(ctx, "analysis has been running longer than the SLA", "result_id", result.ID, "running_for", runningFor.String(), "sla", r.sla.String())
+	r.recordEvent(ctx, database.AuditResultSLAExceeded, "result", strconv.Itoa(result.ID), database.AuditMetadata{
+		"SimulationID": result.SimulationID,
+		"RunningFor":   runningFor.String(),
+		"SLA":          r.sla.String(),
+	})
+}
+
+func (r *Reconciler) requeue(ctx context.Context, result database.Result) error {
+	payload := BloodhoundTaskPayload{
+		ResultID:        result.ID,
+		SimulationID:    result.SimulationID,
+		OrgName:         result.OrgName,
+		S3BucketPath:    result.S3BucketPath.String,
+		InputPath:       result.InputPath.String,
+		AnalysisOptions: result.AnalysisOptions,
+	}
+
+	taskInfo, err := r.client.EnqueueBloodhoundAnalysis(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	err = r.db.UpdateResultTaskID(ctx, result.ID, taskInfo.ID)
+	if err != nil {
+		return err
+	}
+
+	r.recordReconciliation(ctx, result, result.Status, reconcileRequeued, "task was never enqueued")
+	return nil
+}
+
+func (r *Reconciler) transition(ctx context.Context, result database.Result, status, action, reason string) error {
+	var err error
+	if status == database.StatusFailed {
+		err = r.db.FailResultStatus(ctx, result.ID, result.Status, status, "system", database.ResultFailure{
+			Code:    services.CodeTaskLost,
+			Message: reason,
+		})
+	} else {
+		err = r.db.TransitionResultStatus(ctx, result.ID, result.Status, status, "system", reason)
+	}
+	if errors.Is(err, database.ErrTransitionConflict) {
+		// Something else moved the result on since it was read.
+		return nil
+	}
+	if errors.Is(err, database.ErrIllegalTransition) {
+		r.logger.WarnContext(ctx, "result can't be reconciled", "result_id", result.ID, "from", result.Status, "to", status, "reason", reason)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r.recordReconciliation(ctx, result, status, action, reason)
+	return nil
+}
+
+func (r *Reconciler) recordReconciliation(ctx context.Context, result database.Result, status, action, reason string) {
+	metrics.ResultsReconciled.WithLabelValues(action).Inc()
+	r.logger.WarnContext(ctx, "reconciled result", "result_id", result.ID, "action", action, "from", result.Status, "to", status, "reason", reason)
+	r.recordEvent(ctx, database.AuditResultReconciled, "result", strconv.Itoa(result.ID), database.AuditMetadata{
+		"SimulationID": result.SimulationID,
+		"TaskID":       result.TaskID,
+		"Action":       action,
+		"From":         result.Status,
+		"To":           status,
+		"Reason":       reason,
+	})
+}
+
+// archiveOrphanedTasks archives queued tasks whose result has been deleted,
+// so that they don't run an analysis nobody can see.
+func (r *Reconciler) archiveOrphanedTasks(ctx context.Context) error {
+	for _, list := range []func(string, ...asynq.ListOption) ([]*asynq.TaskInfo, error){
+		r.inspector.inspector.ListPendingTasks,
+		r.inspector.inspector.ListScheduledTasks,
+		r.inspector.inspector.ListRetryTasks,
+	} {
+		for page := 1; ; page++ {
+			tasks, err := list(QueueBloodhound, asynq.Page(page), asynq.PageSize(100))
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, task := range tasks {
+				err := r.archiveIfOrphaned(ctx, task)
+				if err != nil {
+					return err
+				}
+			}
+
+			if len(tasks) < 100 {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Reconciler) archiveIfOrphaned(ctx context.Context, task *asynq.TaskInfo) error {
+	if task.Type != TypeBloodhoundAnalysis {
+		return nil
+	}
+
+	var payload BloodhoundTaskPayload
+	if err := json.Unmarshal(task.Payload, &payload); err != nil {
+		return nil
+	}
+
+	_, found, err := r.db.GetResult(ctx, payload.ResultID)
+	if err != nil || found {
+		return err
+	}
+
+	err = r.inspector.inspector.ArchiveTask(QueueBloodhound, task.ID)
+	if err != nil {
+		return translateTaskError(err)
+	}
+
+	metrics.ResultsReconciled.WithLabelValues(reconcileArchived).Inc()
+	r.logger.WarnContext(ctx, "archived task for missing result", "task_id", task.ID, "result_id", payload.ResultID)
+	r.recordEvent(ctx, database.AuditQueueTaskArchived, "task", task.ID, database.AuditMetadata{
+		"ResultID": payload.ResultID,
+		"Reason":   "result no longer exists",
+	})
+
+	return nil
+}
+
+func (r *Reconciler) recordEvent(ctx context.Context, action, targetType, targetID string, metadata database.AuditMetadata) {
+	event := database.AuditEvent{
+		Actor:      "system",
+		Action:     action,
+		TargetType: database.NullString{String: targetType, Valid: true},
+		TargetID:   database.NullString{String: targetID, Valid: true},
+		Metadata:   metadata,
+	}
+
+	if err := r.db.InsertAuditEvent(ctx, event); err != nil {
+		r.logger.ErrorContext(ctx, "failed to record reconciliation audit event", "error", err)
+	}
+}
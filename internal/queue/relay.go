@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/metrics"
+)
+
+const (
+	// relayInterval is how often the outbox is polled when nothing has
+	// called Notify.
+	relayInterval = 5 * time.Second
+
+	relayBatchSize = 50
+
+	// relayLease is how long a claimed message is left to its relay before
+	// another may publish it. It is well above the time a batch takes to
+	// publish.
+	relayLease = 5 * time.Minute
+
+	// A message that fails to publish is retried with exponential backoff,
+	// starting at relayRetryBaseDelay and doubling up to relayRetryMaxDelay,
+	// and dead-lettered after relayMaxAttempts.
+	relayRetryBaseDelay = 5 * time.Second
+	relayRetryMaxDelay  = 10 * time.Minute
+	relayMaxAttempts    = 20
+
+	// outboxRetention is how long published and dead-lettered messages are
+	// kept for troubleshooting before they are deleted.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// Relay publishes tasks from the outbox to the queue. Every process runs one;
+// messages are claimed before they are published, so relays don't step on
+// each other.
+type Relay struct {
+	db     *database.DB
+	client *Client
+	logger *slog.Logger
+
+	notify chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewRelay(redisAddr, password string, db *database.DB, logger *slog.Logger) *Relay {
+	return &Relay{
+		db:     db,
+		client: NewClient(redisAddr, password),
+		logger: logger,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *Relay) Start() {
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(relayInterval)
+		defer ticker.Stop()
+
+		lastCleanup := time.Time{}
+
+		for {
+			r.publish()
+
+			if time.Since(lastCleanup) > time.Hour {
+				err := r.db.DeleteExpiredOutboxData(context.Background(), time.Now().Add(-outboxRetention))
+				if err != nil {
+					r.logger.Error("failed to clean up outbox", "error", err)
+				}
+				lastCleanup = time.Now()
+			}
+
+			select {
+			case <-r.done:
+				return
+			case <-r.notify:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Notify asks the relay to publish straight away rather than at the next
+// poll. It never blocks.
+func (r *Relay) Notify() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops the relay after any publish in progress has finished.
+// Anything left in the outbox is published by the next process to start.
+func (r *Relay) Shutdown() {
+	close(r.done)
+	r.wg.Wait()
+	r.client.Close()
+}
+
+func (r *Relay) publish() {
+	ctx := context.Background()
+
+	for {
+		messages, err := r.db.ClaimOutboxMessages(ctx, relayBatchSize, relayLease)
+		if err != nil {
+			r.logger.Error("failed to claim outbox messages", "error", err)
+			return
+		}
+
+		for _, message := range messages {
+			r.publishMessage(ctx, message)
+		}
+
+		if len(messages) < relayBatchSize {
+			return
+		}
+	}
+}
+
+// publishMessage enqueues a claimed message and records the outcome. If the
+// outcome can't be recorded, the message is published again once its lease
+// runs out; enqueueing is idempotent, as tasks are enqueued under their own
+// ID.
+func (r *Relay) publishMessage(ctx context.Context, message database.OutboxMessage) {
+	publishErr := r.client.EnqueueOutboxMessage(ctx, message)
+	if publishErr == nil {
+		err := r.db.MarkOutboxMessagePublished(ctx, message.ID)
+		if err != nil {
+			r.logger.Error("failed to mark outbox message published", "outbox_id", message.ID, "error", err)
+		}
+		return
+	}
+
+	deadLetter := message.Attempts >= relayMaxAttempts
+	nextAttemptAt := time.Now().Add(relayRetryDelay(message.Attempts))
+
+	if deadLetter {
+		metrics.OutboxDeadLettered.Inc()
+		r.logger.Error("giving up on outbox message", "outbox_id", message.ID, "task_id", message.TaskID, "attempts", message.Attempts, "error", publishErr)
+	} else {
+		r.logger.Warn("failed to publish outbox message", "outbox_id", message.ID, "task_id", message.TaskID, "attempts", message.Attempts, "next_attempt_at", nextAttemptAt, "error", publishErr)
+	}
+
+	err := r.db.MarkOutboxMessageFailed(ctx, message.ID, publishErr.Error(), nextAttemptAt, deadLetter)
+	if err != nil {
+		r.logger.Error("failed to record outbox message failure", "outbox_id", message.ID, "error", err)
+	}
+}
+
+// relayRetryDelay returns how long to wait before publishing a message again
+// after its nth failed attempt.
+func relayRetryDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		return relayRetryMaxDelay
+	}
+
+	return min(relayRetryBaseDelay<<(attempts-1), relayRetryMaxDelay)
+}
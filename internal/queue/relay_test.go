@@ -0,0 +1,27 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{5, 80 * time.Second},
+		{7, 320 * time.Second},
+		{8, relayRetryMaxDelay},
+		{relayMaxAttempts, relayRetryMaxDelay},
+		{100, relayRetryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := relayRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("relayRetryDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/metrics"
+	"com.activehacks.ad-miner-backend/internal/services"
+	"github.com/hibiken/asynq"
+)
+
+const purgeBatchSize = 100
+
+// A result that fails to purge is skipped until it is due to be retried,
+// with exponential backoff starting at purgeRetryBaseDelay and doubling up to
+// purgeRetryMaxDelay, so that it doesn't hold up the results behind it.
+const (
+	purgeRetryBaseDelay = time.Hour
+	purgeRetryMaxDelay  = 7 * 24 * time.Hour
+)
+
+// RetentionConfig holds the global retention settings, which organizations
+// can override with a retention policy. Periods are in days, counted from
+// when a run finished; zero keeps artifacts forever.
+type RetentionConfig struct {
+	// Interval is how often the purge runs. Zero disables it.
+	Interval   time.Duration
+	InputDays  int
+	ReportDays int
+
+	// DeleteResults removes results once both their artifacts have been
+	// purged, rather than leaving them expired.
+	DeleteResults bool
+
+	// RestoreWindow is how long a deleted result can be restored before it
+	// and its artifacts are deleted for good.
+	RestoreWindow time.Duration
+}
+
+// Purger deletes result artifacts from storage once they outlive their
+// retention period. A result whose reports are purged is expired, and, if
+// configured, deleted once its input has gone too. Results and organizations
+// on legal hold are never purged.
+//
+// It also deletes results for good once they have been deleted for longer
+// than the restore window.
+//
+// Scheduled runs read their input from the schedule's path, so a schedule's
+// input is never deleted while the schedule exists.
+type Purger struct {
+	db     PurgeStore
+	s3Svc  services.Storage
+	config RetentionConfig
+	logger *slog.Logger
+}
+
+// PurgeStore is the part of the database the retention purge works with.
+type PurgeStore interface {
+	GetResultsDueForPurge(ctx context.Context, artifact string, defaultDays, limit int) ([]database.Result, error)
+	GetResultsDeletedBefore(ctx context.Context, cutoff time.Time, limit int) ([]database.Result, error)
+	MarkResultArtifactPurged(ctx context.Context, id int, artifact string) error
+	RecordResultPurgeFailure(ctx context.Context, id int, purgeErr string, retryAt time.Time) error
+	OrgHasLaterResult(ctx context.Context, id int, orgName string) (bool, error)
+	TransitionResultStatus(ctx context.Context, id int, from, to, actor, reason string) error
+	DeleteResult(ctx context.Context, id int) error
+	GetSchedules(ctx context.Context) ([]database.Schedule, error)
+	InsertAuditEvent(ctx context.Context, event database.AuditEvent) error
+}
+
+var _ PurgeStore = (*database.DB)(nil)
+
+func NewPurger(db PurgeStore, s3Svc services.Storage, config RetentionConfig, logger *slog.Logger) *Purger {
+	return &Purger{
+		db:     db,
+		s3Svc:  s3Svc,
+		config: config,
+		logger: logger,
+	}
+}
+
+func (p *Purger) ProcessRetentionPurge(ctx context.Context, t *asynq.Task) error {
+	return errors.Join(
+		p.purgeArtifact(ctx, database.ArtifactReport, p.config.ReportDays),
+		p.purgeArtifact(ctx, database.ArtifactInput, p.config.InputDays),
+		p.purgeDeletedResults(ctx),
+	)
+}
+
+func (p *Purger) purgeDeletedResults(ctx context.Context) error {
+	var errs []error
+
+	for {
+		results, err := p.db.GetResultsDeletedBefore(ctx, time.Now().Add(-p.config.RestoreWindow), purgeBatchSize)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+
+		stuck := false
+
+		for _, result := range results {
+			err := p.hardDelete(ctx, result)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("result %d: %w", result.ID, err))
+				stuck = !p.backOff(ctx, result, "deleted result", err) || stuck
+			}
+		}
+
+		// Results that failed to back off would only come back in the next
+		// batch.
+		if stuck || len(results) < purgeBatchSize {
+			return errors.Join(errs...)
+		}
+	}
+}
+
+func (p *Purger) hardDelete(ctx context.Context, result database.Result) error {
+	bucketPath := ResultBucketPath(result)
+	inputPath := ResultInputPath(result)
+
+	scheduled, err := p.scheduleUsesPath(ctx, inputPath)
+	if err != nil {
+		return err
+	}
+
+	// Only the result's own artifacts are deleted, never the whole path,
+	// which may hold other results' artifacts.
+	err = p.s3Svc.DeleteDirectory(ctx, bucketPath, "extracted")
+	if err != nil {
+		return err
+	}
+
+	if !scheduled {
+		err = p.s3Svc.DeleteFile(ctx, inputPath, "sharphound.zip")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.deleteEvolutionArchive(ctx, result)
+	if err != nil {
+		return err
+	}
+
+	err = p.db.DeleteResult(ctx, result.ID)
+	if err != nil {
+		return err
+	}
+
+	p.logger.InfoContext(ctx, "purged deleted result", "result_id", result.ID, "path", bucketPath, "input_kept_for_schedule", scheduled)
+	p.recordEvent(ctx, database.AuditResultHardDeleted, result, database.AuditMetadata{
+		"SimulationID":         result.SimulationID,
+		"OrgName":              result.OrgName,
+		"Path":                 bucketPath,
+		"InputKeptForSchedule": scheduled,
+		"Reason":               "restore window elapsed",
+	})
+
+	return nil
+}
+
+func (p *Purger) purgeArtifact(ctx context.Context, artifact string, defaultDays int) error {
+	var errs []error
+
+	for {
+		results, err := p.db.GetResultsDueForPurge(ctx, artifact, defaultDays, purgeBatchSize)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+
+		stuck := false
+
+		for _, result := range results {
+			err := p.purge(ctx, result, artifact)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("result %d: %w", result.ID, err))
+				stuck = !p.backOff(ctx, result, artifact, err) || stuck
+			}
+		}
+
+		// Results that failed to back off would only come back in the next
+		// batch.
+		if stuck || len(results) < purgeBatchSize {
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// backOff logs a failure to purge what of a result and puts off purging it
+// again. It reports false if the failure couldn't be recorded.
+func (p *Purger) backOff(ctx context.Context, result database.Result, what string, purgeErr error) bool {
+	attempts := result.PurgeAttempts + 1
+	retryAt := time.Now().Add(purgeRetryDelay(attempts))
+
+	p.logger.ErrorContext(ctx, "failed to purge result", "result_id", result.ID, "artifact", what, "attempts", attempts, "retry_at", retryAt, "error", purgeErr)
+
+	err := p.db.RecordResultPurgeFailure(ctx, result.ID, purgeErr.Error(), retryAt)
+	if err != nil {
+		p.logger.ErrorContext(ctx, "failed to record purge failure", "result_id", result.ID, "error", err)
+		return false
+	}
+
+	return true
+}
+
+// purgeRetryDelay returns how long to wait before purging a result again
+// after its nth failed attempt.
+func purgeRetryDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		return purgeRetryMaxDelay
+	}
+
+	return min(purgeRetryBaseDelay<<(attempts-1), purgeRetryMaxDelay)
+}
+
+func (p *Purger) purge(ctx context.Context, result database.Result, artifact string) error {
+	bucketPath := ResultBucketPath(result)
+
+	orgReused, err := p.db.OrgHasLaterResult(ctx, result.ID, result.OrgName)
+	if err != nil {
+		return err
+	}
+
+	name := "sharphound.zip"
+	if artifact == database.ArtifactReport {
+		name = "extracted"
+	}
+
+	// A schedule reads its next collection from the same path, so its input
+	// is left for the schedule.
+	scheduled := false
+	if artifact == database.ArtifactInput {
+		bucketPath = ResultInputPath(result)
+
+		scheduled, err = p.scheduleUsesPath(ctx, bucketPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleteFromStorage := !scheduled
+
+	if deleteFromStorage {
+		if artifact == database.ArtifactReport {
+			err = p.s3Svc.DeleteDirectory(ctx, bucketPath, name)
+		} else {
+			err = p.s3Svc.DeleteFile(ctx, bucketPath, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The archived data file is part of the report.
+	if artifact == database.ArtifactReport {
+		err = p.deleteEvolutionArchive(ctx, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The organization's working directory on this host holds a copy of its
+	// latest run's artifacts.
+	if !orgReused {
+		err = p.s3Svc.Cleanup(ctx, result.OrgName, name)
+		if err != nil {
+			p.logger.WarnContext(ctx, "failed to remove local copy of purged artifact", "result_id", result.ID, "artifact", artifact, "error", err)
+		}
+	}
+
+	err = p.db.MarkResultArtifactPurged(ctx, result.ID, artifact)
+	if err != nil {
+		return err
+	}
+
+	metrics.ArtifactsPurged.WithLabelValues(artifact).Inc()
+	p.logger.InfoContext(ctx, "purged result artifact", "result_id", result.ID, "artifact", artifact, "path", bucketPath, "deleted_from_storage", deleteFromStorage)
+	p.recordEvent(ctx, database.AuditResultPurged, result, database.AuditMetadata{
+		"SimulationID":       result.SimulationID,
+		"OrgName":            result.OrgName,
+		"Artifact":           artifact,
+		"Path":               bucketPath,
+		"DeletedFromStorage": deleteFromStorage,
+	})
+
+	if artifact == database.ArtifactReport {
+		err = p.db.TransitionResultStatus(ctx, result.ID, result.Status, database.StatusExpired, "system", "report retention period elapsed")
+		if err != nil && !errors.Is(err, database.ErrTransitionConflict) {
+			return err
+		}
+	}
+
+	bothPurged := result.InputPurgedAt.Valid || artifact == database.ArtifactInput
+	bothPurged = bothPurged && (result.ReportPurgedAt.Valid || artifact == database.ArtifactReport)
+
+	if p.config.DeleteResults && bothPurged {
+		err = p.db.DeleteResult(ctx, result.ID)
+		if err != nil {
+			return err
+		}
+
+		p.logger.InfoContext(ctx, "deleted result past retention", "result_id", result.ID)
+		p.recordEvent(ctx, database.AuditResultHardDeleted, result, database.AuditMetadata{
+			"SimulationID": result.SimulationID,
+			"OrgName":      result.OrgName,
+			"Reason":       "retention period elapsed",
+		})
+	}
+
+	return nil
+}
+
+// deleteEvolutionArchive deletes the copy of a result's data file that later
+// runs read to show the organization's evolution. Unlike the rest of a
+// result's artifacts it is never shared with another result.
+func (p *Purger) deleteEvolutionArchive(ctx context.Context, result database.Result) error {
+	if !result.EvolutionDataPath.Valid {
+		return nil
+	}
+
+	bucketPath, filename := services.SplitStoragePath(result.EvolutionDataPath.String)
+	return p.s3Svc.DeleteFile(ctx, bucketPath, filename)
+}
+
+// scheduleUsesPath reports whether a schedule reads its collections from
+// bucketPath.
+func (p *Purger) scheduleUsesPath(ctx context.Context, bucketPath string) (bool, error) {
+	schedules, err := p.db.GetSchedules(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, schedule := range schedules {
+		if ScheduleBucketPath(schedule.SimulationID) == bucketPath {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ResultBucketPath returns the storage path of a result's artifacts. Results
+// created before the path was recorded all used the default layout.
+func ResultBucketPath(result database.Result) string {
+	if result.S3BucketPath.Valid {
+		return result.S3BucketPath.String
+	}
+	return ScheduleBucketPath(result.SimulationID)
+}
+
+// ResultInputPath returns the storage path of a result's SharpHound
+// collection, which for scheduled results is their schedule's.
+func ResultInputPath(result database.Result) string {
+	if result.InputPath.Valid {
+		return result.InputPath.String
+	}
+	return ResultBucketPath(result)
+}
+
+func (p *Purger) recordEvent(ctx context.Context, action string, result database.Result, metadata database.AuditMetadata) {
+	event := database.AuditEvent{
+		Actor:      "system",
+		Action:     action,
+		TargetType: database.NullString{String: "result", Valid: true},
+		TargetID:   database.NullString{String: strconv.Itoa(result.ID), Valid: true},
+		Metadata:   metadata,
+	}
+
+	if err := p.db.InsertAuditEvent(ctx, event); err != nil {
+		p.logger.ErrorContext(ctx, "failed to record retention audit event", "error", err)
+	}
+}
@@ -0,0 +1,455 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/services/fake"
+)
+
+// fakePurgeStore is an in-memory PurgeStore that picks results to purge the
+// way the database does: finished, past their organization's retention
+// period, not on legal hold and not backing off after a failed purge.
+type fakePurgeStore struct {
+	mu        sync.Mutex
+	results   map[int]database.Result
+	policies  map[string]database.RetentionPolicy
+	schedules []database.Schedule
+	events    []string
+}
+
+func newFakePurgeStore() *fakePurgeStore {
+	return &fakePurgeStore{
+		results:  map[int]database.Result{},
+		policies: map[string]database.RetentionPolicy{},
+	}
+}
+
+func (f *fakePurgeStore) put(result database.Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.results[result.ID] = result
+}
+
+func (f *fakePurgeStore) get(id int) (database.Result, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result, ok := f.results[id]
+	return result, ok
+}
+
+func (f *fakePurgeStore) GetResultsDueForPurge(ctx context.Context, artifact string, defaultDays, limit int) ([]database.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	statuses := []string{database.StatusSucceeded, database.StatusFailed, database.StatusCancelled}
+	if artifact == database.ArtifactInput {
+		statuses = append(statuses, database.StatusExpired)
+	}
+
+	var due []database.Result
+	for _, result := range f.results {
+		purgedAt := result.InputPurgedAt
+		if artifact == database.ArtifactReport {
+			purgedAt = result.ReportPurgedAt
+		}
+
+		policy := f.policies[result.OrgName]
+
+		days := int64(defaultDays)
+		period := policy.InputRetentionDays
+		if artifact == database.ArtifactReport {
+			period = policy.ReportRetentionDays
+		}
+		if period.Valid {
+			days = period.Int64
+		}
+
+		if !slices.Contains(statuses, result.Status) || purgedAt.Valid || result.DeletedAt.Valid ||
+			result.LegalHold || policy.LegalHold || !f.retryDue(result) || days <= 0 ||
+			time.Since(result.EndTime.Time) < time.Duration(days)*24*time.Hour {
+			continue
+		}
+
+		due = append(due, result)
+	}
+
+	return f.oldest(due, limit), nil
+}
+
+func (f *fakePurgeStore) GetResultsDeletedBefore(ctx context.Context, cutoff time.Time, limit int) ([]database.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var due []database.Result
+	for _, result := range f.results {
+		if !result.DeletedAt.Valid || !result.DeletedAt.Time.Before(cutoff) ||
+			result.LegalHold || f.policies[result.OrgName].LegalHold || !f.retryDue(result) {
+			continue
+		}
+
+		due = append(due, result)
+	}
+
+	return f.oldest(due, limit), nil
+}
+
+func (f *fakePurgeStore) retryDue(result database.Result) bool {
+	return !result.PurgeRetryAt.Valid || !result.PurgeRetryAt.Time.After(time.Now())
+}
+
+func (f *fakePurgeStore) oldest(results []database.Result, limit int) []database.Result {
+	slices.SortFunc(results, func(a, b database.Result) int { return a.ID - b.ID })
+	return results[:min(len(results), limit)]
+}
+
+func (f *fakePurgeStore) MarkResultArtifactPurged(ctx context.Context, id int, artifact string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := f.results[id]
+	if artifact == database.ArtifactReport {
+		result.ReportPurgedAt = database.NullTime{Time: time.Now(), Valid: true}
+	} else {
+		result.InputPurgedAt = database.NullTime{Time: time.Now(), Valid: true}
+	}
+	result.PurgeAttempts = 0
+	result.PurgeRetryAt = sql.NullTime{}
+	result.PurgeLastError = sql.NullString{}
+	f.results[id] = result
+	return nil
+}
+
+func (f *fakePurgeStore) RecordResultPurgeFailure(ctx context.Context, id int, purgeErr string, retryAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := f.results[id]
+	result.PurgeAttempts++
+	result.PurgeRetryAt = sql.NullTime{Time: retryAt, Valid: true}
+	result.PurgeLastError = sql.NullString{String: purgeErr, Valid: true}
+	f.results[id] = result
+	return nil
+}
+
+func (f *fakePurgeStore) OrgHasLaterResult(ctx context.Context, id int, orgName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, result := range f.results {
+		if result.ID > id && result.OrgName == orgName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakePurgeStore) TransitionResultStatus(ctx context.Context, id int, from, to, actor, reason string) error {
+	if !database.CanTransitionResult(from, to) {
+		return fmt.Errorf("%w: %s to %s", database.ErrIllegalTransition, from, to)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := f.results[id]
+	if result.Status != from {
+		return database.ErrTransitionConflict
+	}
+
+	result.Status = to
+	f.results[id] = result
+	return nil
+}
+
+func (f *fakePurgeStore) DeleteResult(ctx context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.results, id)
+	return nil
+}
+
+func (f *fakePurgeStore) GetSchedules(ctx context.Context) ([]database.Schedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.schedules), nil
+}
+
+func (f *fakePurgeStore) InsertAuditEvent(ctx context.Context, event database.AuditEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = append(f.events, event.Action)
+	return nil
+}
+
+func (f *fakePurgeStore) auditEvents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.events)
+}
+
+const testRetentionDays = 30
+
+func newTestPurger(t *testing.T, config RetentionConfig) (*Purger, *fakePurgeStore, *fake.Services) {
+	t.Helper()
+
+	if config.InputDays == 0 && config.ReportDays == 0 {
+		config.InputDays = testRetentionDays
+		config.ReportDays = testRetentionDays
+	}
+
+	fakes := fake.New(t.TempDir())
+	store := newFakePurgeStore()
+
+	return NewPurger(store, fakes.Storage, config, slog.New(slog.DiscardHandler)), store, fakes
+}
+
+// testFinishedResult returns a result that succeeded daysAgo, with its input
+// and report stored under bucketPath.
+func testFinishedResult(fakes *fake.Services, id int, bucketPath string, daysAgo int) database.Result {
+	fakes.Storage.Put(bucketPath+"/sharphound.zip", []byte("collection"))
+	fakes.Storage.Put(bucketPath+"/extracted/index.html", []byte("report"))
+
+	return database.Result{
+		ID:           id,
+		SimulationID: fmt.Sprintf("sim-%d", id),
+		OrgName:      testOrg,
+		Status:       database.StatusSucceeded,
+		EndTime:      sql.NullTime{Time: time.Now().AddDate(0, 0, -daysAgo), Valid: true},
+		S3BucketPath: database.NullString{String: bucketPath, Valid: true},
+	}
+}
+
+func TestRetentionPurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		daysAgo    int
+		legalHold  bool
+		policy     *database.RetentionPolicy
+		retryAt    time.Time
+		wantPurged bool
+	}{
+		{
+			name:       "past retention",
+			daysAgo:    testRetentionDays + 1,
+			wantPurged: true,
+		},
+		{
+			name:    "within retention",
+			daysAgo: testRetentionDays - 1,
+		},
+		{
+			name:      "result on legal hold",
+			daysAgo:   testRetentionDays + 1,
+			legalHold: true,
+		},
+		{
+			name:    "organization on legal hold",
+			daysAgo: testRetentionDays + 1,
+			policy:  &database.RetentionPolicy{OrgName: testOrg, LegalHold: true},
+		},
+		{
+			name:    "organization keeps artifacts longer",
+			daysAgo: testRetentionDays + 1,
+			policy: &database.RetentionPolicy{
+				OrgName:             testOrg,
+				InputRetentionDays:  database.NullInt64{Int64: 90, Valid: true},
+				ReportRetentionDays: database.NullInt64{Int64: 90, Valid: true},
+			},
+		},
+		{
+			name:    "backing off after a failed purge",
+			daysAgo: testRetentionDays + 1,
+			retryAt: time.Now().Add(time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purger, store, fakes := newTestPurger(t, RetentionConfig{})
+
+			result := testFinishedResult(fakes, 1, testBucketPath, tt.daysAgo)
+			result.LegalHold = tt.legalHold
+			if !tt.retryAt.IsZero() {
+				result.PurgeRetryAt = sql.NullTime{Time: tt.retryAt, Valid: true}
+			}
+			store.put(result)
+
+			if tt.policy != nil {
+				store.policies[testOrg] = *tt.policy
+			}
+
+			err := purger.ProcessRetentionPurge(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, inputKept := fakes.Storage.Get(testBucketPath + "/sharphound.zip")
+			_, reportKept := fakes.Storage.Get(testBucketPath + "/extracted/index.html")
+			if inputKept == tt.wantPurged || reportKept == tt.wantPurged {
+				t.Errorf("input kept = %t, report kept = %t, want purged = %t", inputKept, reportKept, tt.wantPurged)
+			}
+
+			got, _ := store.get(1)
+			if purged := got.InputPurgedAt.Valid && got.ReportPurgedAt.Valid; purged != tt.wantPurged {
+				t.Errorf("recorded as purged = %t, want %t", purged, tt.wantPurged)
+			}
+
+			wantStatus := database.StatusSucceeded
+			if tt.wantPurged {
+				wantStatus = database.StatusExpired
+			}
+			if got.Status != wantStatus {
+				t.Errorf("status = %q, want %q", got.Status, wantStatus)
+			}
+		})
+	}
+}
+
+func TestRetentionPurgeScheduledRuns(t *testing.T) {
+	purger, store, fakes := newTestPurger(t, RetentionConfig{})
+
+	inputPath := ScheduleBucketPath("weekly")
+	store.schedules = []database.Schedule{{ID: 1, OrgName: testOrg, SimulationID: "weekly"}}
+
+	// Two runs of the schedule read the same input and wrote their reports
+	// under their own paths; only the older one is past retention.
+	older := testFinishedResult(fakes, 1, ScheduleRunPath("weekly", time.Now().AddDate(0, 0, -40)), testRetentionDays+10)
+	older.InputPath = database.NullString{String: inputPath, Valid: true}
+	store.put(older)
+
+	newer := testFinishedResult(fakes, 2, ScheduleRunPath("weekly", time.Now().AddDate(0, 0, -1)), 1)
+	newer.InputPath = database.NullString{String: inputPath, Valid: true}
+	store.put(newer)
+
+	fakes.Storage.Put(inputPath+"/sharphound.zip", []byte("collection"))
+
+	err := purger.ProcessRetentionPurge(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := fakes.Storage.Get(older.S3BucketPath.String + "/extracted/index.html"); ok {
+		t.Error("older run's report was not purged")
+	}
+
+	if _, ok := fakes.Storage.Get(newer.S3BucketPath.String + "/extracted/index.html"); !ok {
+		t.Error("newer run's report was purged along with the older run's")
+	}
+
+	// The schedule reads its next collection from its input path.
+	if _, ok := fakes.Storage.Get(inputPath + "/sharphound.zip"); !ok {
+		t.Error("schedule's input was deleted")
+	}
+
+	got, _ := store.get(1)
+	if !got.InputPurgedAt.Valid || !got.ReportPurgedAt.Valid {
+		t.Errorf("older run's artifacts weren't recorded as purged: %+v", got)
+	}
+}
+
+func TestRetentionPurgeFailure(t *testing.T) {
+	purger, store, fakes := newTestPurger(t, RetentionConfig{ReportDays: testRetentionDays})
+	store.put(testFinishedResult(fakes, 1, testBucketPath, testRetentionDays+1))
+
+	fakes.Calls.Fail("Storage.DeleteDirectory", errors.New("access denied"), 1)
+
+	err := purger.ProcessRetentionPurge(context.Background(), nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	got, _ := store.get(1)
+	if got.ReportPurgedAt.Valid {
+		t.Error("report was recorded as purged")
+	}
+
+	if got.PurgeAttempts != 1 || !got.PurgeLastError.Valid {
+		t.Errorf("purge attempts = %d, last error = %v, want the failure recorded", got.PurgeAttempts, got.PurgeLastError)
+	}
+
+	if retryIn := time.Until(got.PurgeRetryAt.Time); retryIn <= 0 || retryIn > purgeRetryBaseDelay {
+		t.Errorf("retry in %s, want within %s", retryIn, purgeRetryBaseDelay)
+	}
+
+	// Until the retry is due the result is left alone, even though storage
+	// would work now.
+	err = purger.ProcessRetentionPurge(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls := fakes.Calls.Count("Storage.DeleteDirectory"); calls != 1 {
+		t.Errorf("storage was called %d times, want the result skipped while backing off", calls)
+	}
+}
+
+func TestRetentionPurgeDeleteResults(t *testing.T) {
+	purger, store, fakes := newTestPurger(t, RetentionConfig{DeleteResults: true})
+	store.put(testFinishedResult(fakes, 1, testBucketPath, testRetentionDays+1))
+
+	err := purger.ProcessRetentionPurge(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := store.get(1); ok {
+		t.Error("result was kept after both its artifacts were purged")
+	}
+
+	if !slices.Contains(store.auditEvents(), database.AuditResultHardDeleted) {
+		t.Errorf("audit events = %v, want %s", store.auditEvents(), database.AuditResultHardDeleted)
+	}
+}
+
+func TestRetentionPurgeDeletedResults(t *testing.T) {
+	tests := []struct {
+		name        string
+		deletedAgo  time.Duration
+		legalHold   bool
+		wantDeleted bool
+	}{
+		{name: "restore window elapsed", deletedAgo: 8 * 24 * time.Hour, wantDeleted: true},
+		{name: "within restore window", deletedAgo: 24 * time.Hour},
+		{name: "on legal hold", deletedAgo: 8 * 24 * time.Hour, legalHold: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purger, store, fakes := newTestPurger(t, RetentionConfig{RestoreWindow: 7 * 24 * time.Hour})
+
+			result := testFinishedResult(fakes, 1, testBucketPath, 1)
+			result.Status = database.StatusCancelled
+			result.DeletedAt = database.NullTime{Time: time.Now().Add(-tt.deletedAgo), Valid: true}
+			result.LegalHold = tt.legalHold
+			store.put(result)
+
+			err := purger.ProcessRetentionPurge(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			_, kept := store.get(1)
+			_, reportKept := fakes.Storage.Get(testBucketPath + "/extracted/index.html")
+			_, inputKept := fakes.Storage.Get(testBucketPath + "/sharphound.zip")
+
+			if kept == tt.wantDeleted || reportKept == tt.wantDeleted || inputKept == tt.wantDeleted {
+				t.Errorf("result kept = %t, report kept = %t, input kept = %t, want deleted = %t", kept, reportKept, inputKept, tt.wantDeleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+	"com.activehacks.ad-miner-backend/internal/database"
+	"com.activehacks.ad-miner-backend/internal/env"
+	"com.activehacks.ad-miner-backend/internal/logging"
+	"com.activehacks.ad-miner-backend/internal/services"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleSyncInterval is how often the scheduler reloads schedules from the
+// database, and so how long a new or deleted schedule takes to take effect.
+const scheduleSyncInterval = time.Minute
+
+// scheduleRunFormat formats the time a schedule fired, to tell its runs apart.
+const scheduleRunFormat = "20060102T150405Z"
+
+// Scheduler fires recurring analyses. Each schedule is registered with asynq
+// as a periodic schedule:fire task; when that task runs, the schedule checks
+// its S3 prefix for a SharpHound collection it hasn't analysed yet and, if
+// there is one, creates a result and queues a bloodhound:analysis task
+// through the outbox.
+//
+// Schedules are evaluated in UTC.
+//
+// The scheduler also runs the reconciler every reconcileInterval, and once at
+// start, and the retention purge every retention.Interval.
+type Scheduler struct {
+	manager    *asynq.PeriodicTaskManager
+	client     *Client
+	inspector  *Inspector
+	reconciler *Reconciler
+	purger     *Purger
+	db         *database.DB
+	s3Svc      *services.S3Service
+	logger     *slog.Logger
+}
+
+func NewScheduler(redisAddr, password string, db *database.DB, reconcileInterval, resultSLA time.Duration, retention RetentionConfig, logger *slog.Logger) (*Scheduler, error) {
+	redisOpt := asynq.RedisClientOpt{
+		Addr:     redisAddr,
+		Password: password,
+	}
+
+	manager, err := asynq.NewPeriodicTaskManager(asynq.PeriodicTaskManagerOpts{
+		RedisConnOpt:               redisOpt,
+		PeriodicTaskConfigProvider: &scheduleConfigProvider{db: db, reconcileInterval: reconcileInterval, purgeInterval: retention.Interval},
+		SyncInterval:               scheduleSyncInterval,
+		SchedulerOpts: &asynq.SchedulerOpts{
+			Location: time.UTC,
+			EnqueueErrorHandler: func(task *asynq.Task, opts []asynq.Option, err error) {
+				// Every worker runs a scheduler, so all but one of them are
+				// expected to find the task already queued.
+				if !errors.Is(err, asynq.ErrDuplicateTask) {
+					logger.Error("failed to enqueue scheduled task", "type", task.Type(), "error", err)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(redisAddr, password)
+	inspector := NewInspector(redisAddr, password)
+	s3Svc := services.NewS3Service(logger)
+
+	return &Scheduler{
+		manager:    manager,
+		client:     client,
+		inspector:  inspector,
+		reconciler: NewReconciler(db, client, inspector, resultSLA, logger),
+		purger:     NewPurger(db, s3Svc, retention, logger),
+		db:         db,
+		s3Svc:      s3Svc,
+		logger:     logger,
+	}, nil
+}
+
+func (s *Scheduler) Start() error {
+	s.logger.Info("Starting Asynq Scheduler")
+
+	err := s.manager.Start()
+	if err != nil {
+		return err
+	}
+
+	// Catch up on anything left behind by a crash straight away rather than
+	// at the next interval. Workers starting together share the one task.
+	_, err = s.client.client.Enqueue(asynq.NewTask(TypeReconcile, nil), maintenanceOptions()...)
+	if err != nil && !errors.Is(err, asynq.ErrDuplicateTask) {
+		s.logger.Error("failed to enqueue startup reconciliation", "error", err)
+	}
+
+	return nil
+}
+
+func (s *Scheduler) Shutdown() {
+	s.manager.Shutdown()
+	s.client.Close()
+	s.inspector.Close()
+}
+
+// NextScheduleFire returns the first time after t that a schedule with the
+// given cron expression fires.
+func NextScheduleFire(cronSpec string, t time.Time) (time.Time, error) {
+	schedule, err := cron.ParseStandard(cronSpec)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return schedule.Next(t.UTC()), nil
+}
+
+// scheduleIntervalSamples is how many of a schedule's fires
+// ShortestScheduleInterval looks at. A cron expression can fire at uneven
+// intervals, such as every minute but only during one hour, so a single gap
+// isn't enough.
+const scheduleIntervalSamples = 1000
+
+// ShortestScheduleInterval returns the shortest time between two consecutive
+// fires of a schedule with the given cron expression, over its next fires
+// after t.
+func ShortestScheduleInterval(cronSpec string, t time.Time) (time.Duration, error) {
+	schedule, err := cron.ParseStandard(cronSpec)
+	if err != nil {
+		return 0, err
+	}
+
+	prev := schedule.Next(t.UTC())
+	shortest := time.Duration(math.MaxInt64)
+
+	for range scheduleIntervalSamples {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+
+		shortest = min(shortest, next.Sub(prev))
+		prev = next
+	}
+
+	return shortest, nil
+}
+
+// ScheduleBucketPath returns the S3 prefix a schedule reads SharpHound
+// collections from. Each scheduled result is written under its own prefix
+// below it, see ScheduleRunPath.
+func ScheduleBucketPath(simulationID string) string {
+	prefix := env.GetString("S3_BUCKET_PREFIX", "s3://active-hacks/simulations/active_directory/results")
+	return fmt.Sprintf("%s/%s", prefix, simulationID)
+}
+
+// ScheduleRunPath returns the S3 prefix the result of a schedule's run fired
+// at firedAt is written to, so that runs don't overwrite each other's reports.
+func ScheduleRunPath(simulationID string, firedAt time.Time) string {
+	return fmt.Sprintf("%s/%s", ScheduleBucketPath(simulationID), firedAt.UTC().Format(scheduleRunFormat))
+}
+
+func (s *Scheduler) ProcessScheduleFire(ctx context.Context, t *asynq.Task) error {
+	var payload ScheduleFirePayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %v", err)
+	}
+
+	ctx = logging.With(ctx, "schedule_id", payload.ScheduleID)
+
+	schedule, found, err := s.db.GetSchedule(ctx, payload.ScheduleID)
+	if err != nil {
+		return err
+	}
+
+	// The schedule was deleted after the scheduler last synced.
+	if !found {
+		s.logger.InfoContext(ctx, "schedule no longer exists, not firing")
+		return nil
+	}
+
+	firedAt := time.Now()
+
+	nextFireAt, err := NextScheduleFire(schedule.CronSpec, firedAt)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression %q: %v", schedule.CronSpec, err)
+	}
+
+	err = s.db.UpdateScheduleFired(ctx, schedule.ID, firedAt, nextFireAt)
+	if err != nil {
+		return err
+	}
+
+	bucketPath := ScheduleBucketPath(schedule.SimulationID)
+
+	etag, found, err := s.s3Svc.FileETag(ctx, bucketPath, "sharphound.zip")
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		s.logger.InfoContext(ctx, "no sharphound collection found, skipping", "path", bucketPath)
+		return nil
+	}
+
+	return s.enqueueAnalysis(ctx, schedule, bucketPath, etag, firedAt)
+}
+
+func (s *Scheduler) enqueueAnalysis(ctx context.Context, schedule database.Schedule, bucketPath, etag string, firedAt time.Time) error {
+	simulationID := fmt.Sprintf("%s-%s", schedule.SimulationID, firedAt.UTC().Format(scheduleRunFormat))
+	outputPath := ScheduleRunPath(schedule.SimulationID, firedAt)
+	taskID := uuid.NewString()
+
+	opts, err := s.db.EffectiveAnalysisOptions(ctx, schedule.OrgName, analysis.Options{})
+	if err != nil {
+		return err
+	}
+
+	resultID, err := s.db.InsertResultWithTask(ctx, database.NewResult{
+		SimulationID:    simulationID,
+		OrgName:         schedule.OrgName,
+		S3BucketPath:    outputPath,
+		InputPath:       bucketPath,
+		TaskID:          taskID,
+		TaskType:        TypeBloodhoundAnalysis,
+		AnalysisOptions: opts,
+		Actor:           "system",
+		Payload: func(resultID int) ([]byte, error) {
+			return MarshalBloodhoundAnalysis(ctx, BloodhoundTaskPayload{
+				ResultID:        resultID,
+				SimulationID:    simulationID,
+				OrgName:         schedule.OrgName,
+				S3BucketPath:    outputPath,
+				InputPath:       bucketPath,
+				AnalysisOptions: opts,
+			})
+		},
+		ScheduleInput: &database.ScheduleInput{ScheduleID: schedule.ID, ETag: etag},
+	}, nil)
+	if errors.Is(err, database.ErrScheduleInputClaimed) {
+		s.logger.InfoContext(ctx, "sharphound collection has already been analysed, skipping", "path", bucketPath, "etag", etag)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	event := database.AuditEvent{
+		Actor:      "system",
+		Action:     database.AuditResultCreated,
+		TargetType: database.NullString{String: "result", Valid: true},
+		TargetID:   database.NullString{String: strconv.Itoa(resultID), Valid: true},
+		Metadata: database.AuditMetadata{
+			"SimulationID": simulationID,
+			"OrgName":      schedule.OrgName,
+			"ScheduleID":   schedule.ID,
+		},
+	}
+
+	if err := s.db.InsertAuditEvent(ctx, event); err != nil {
+		s.logger.ErrorContext(ctx, "failed to record result audit event", "error", err)
+	}
+
+	s.logger.InfoContext(ctx, "scheduled analysis enqueued", "task_id", taskID, "result_id", resultID, "simulation_id", simulationID)
+	return nil
+}
+
+// maintenanceOptions are the options for periodic maintenance tasks, which
+// only one worker should run at a time and which make up for a failed run at
+// the next one.
+func maintenanceOptions() []asynq.Option {
+	return []asynq.Option{
+		asynq.Queue(QueueScheduler),
+		asynq.MaxRetry(0),
+		asynq.Unique(time.Minute),
+	}
+}
+
+type scheduleConfigProvider struct {
+	db                *database.DB
+	reconcileInterval time.Duration
+	purgeInterval     time.Duration
+}
+
+func (p *scheduleConfigProvider) GetConfigs() ([]*asynq.PeriodicTaskConfig, error) {
+	schedules, err := p.db.GetSchedules(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*asynq.PeriodicTaskConfig, 0, len(schedules)+2)
+
+	configs = append(configs, &asynq.PeriodicTaskConfig{
+		Cronspec: "@every " + p.reconcileInterval.String(),
+		Task:     asynq.NewTask(TypeReconcile, nil),
+		Opts:     maintenanceOptions(),
+	})
+
+	if p.purgeInterval > 0 {
+		configs = append(configs, &asynq.PeriodicTaskConfig{
+			Cronspec: "@every " + p.purgeInterval.String(),
+			Task:     asynq.NewTask(TypeRetentionPurge, nil),
+			Opts:     maintenanceOptions(),
+		})
+	}
+
+	for _, schedule := range schedules {
+		payload, err := json.Marshal(ScheduleFirePayload{ScheduleID: schedule.ID})
+		if err != nil {
+			return nil, err
+		}
+
+		configs = append(configs, &asynq.PeriodicTaskConfig{
+			Cronspec: schedule.CronSpec,
+			Task:     asynq.NewTask(TypeScheduleFire, payload),
+			Opts: []asynq.Option{
+				asynq.Queue(QueueScheduler),
+				// A missed fire is picked up by the next one, so there is no
+				// point retrying, and only one of the workers' schedulers
+				// should get to enqueue each fire.
+				asynq.MaxRetry(0),
+				asynq.Unique(time.Minute),
+			},
+		})
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShortestScheduleInterval(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		cron string
+		want time.Duration
+	}{
+		{"@every 1s", time.Second},
+		{"@every 6h", 6 * time.Hour},
+		{"0 * * * *", time.Hour},
+		{"0 2 * * *", 24 * time.Hour},
+		{"0 0 * * 0", 7 * 24 * time.Hour},
+		// Every minute, but only between 3am and 4am.
+		{"* 3 * * *", time.Minute},
+		{"0 1,2 * * *", time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cron, func(t *testing.T) {
+			got, err := ShortestScheduleInterval(tt.cron, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	_, err := ShortestScheduleInterval("every day", now)
+	if err == nil {
+		t.Error("expected an error for an invalid cron expression")
+	}
+}
+
+func TestScheduleRunPath(t *testing.T) {
+	t.Setenv("S3_BUCKET_PREFIX", "s3://bucket/results")
+
+	first := ScheduleRunPath("sim-1", time.Date(2026, 3, 10, 2, 0, 0, 0, time.UTC))
+	second := ScheduleRunPath("sim-1", time.Date(2026, 3, 11, 2, 0, 0, 0, time.UTC))
+
+	if want := "s3://bucket/results/sim-1/20260310T020000Z"; first != want {
+		t.Errorf("got %q, want %q", first, want)
+	}
+
+	// Each run's report goes under its own prefix, below the schedule's
+	// input.
+	if first == second {
+		t.Errorf("runs fired at different times share the path %q", first)
+	}
+}
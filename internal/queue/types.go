@@ -1,7 +1,17 @@
 package queue
 
+import "com.activehacks.ad-miner-backend/internal/analysis"
+
 const (
 	TypeBloodhoundAnalysis = "bloodhound:analysis"
+	TypeScheduleFire       = "schedule:fire"
+	TypeReconcile          = "maintenance:reconcile"
+	TypeRetentionPurge     = "maintenance:retention"
+)
+
+const (
+	QueueBloodhound = "bloodhound"
+	QueueScheduler  = "scheduler"
 )
 
 type BloodhoundTaskPayload struct {
@@ -9,4 +19,38 @@ type BloodhoundTaskPayload struct {
 	SimulationID string `json:"simulation_id"`
 	OrgName      string `json:"org_name"`
 	S3BucketPath string `json:"s3_bucket_path"`
+
+	// InputPath is where the SharpHound collection is read from, if not
+	// from S3BucketPath.
+	InputPath string `json:"input_path,omitempty"`
+
+	// AnalysisOptions are the effective AD-miner options, resolved when the
+	// task was queued so that a retry runs with the same ones.
+	AnalysisOptions analysis.Options `json:"analysis_options"`
+
+	// RequestID is the ID of the API request that queued the task, so worker
+	// logs can be matched to it.
+	RequestID string `json:"request_id,omitempty"`
+
+	// TraceContext carries the W3C trace headers of the request that queued
+	// the task, so the worker's spans continue the same trace.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// analysisOptions returns the options the task runs with. Tasks queued before
+// options could be set don't carry any.
+func (p BloodhoundTaskPayload) analysisOptions() analysis.Options {
+	return p.AnalysisOptions.WithDefaults(analysis.Defaults())
+}
+
+// inputPath returns the path the task reads its SharpHound collection from.
+func (p BloodhoundTaskPayload) inputPath() string {
+	if p.InputPath != "" {
+		return p.InputPath
+	}
+	return p.S3BucketPath
+}
+
+type ScheduleFirePayload struct {
+	ScheduleID int `json:"schedule_id"`
 }
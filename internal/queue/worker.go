@@ -4,43 +4,165 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
+	"time"
 
 	"github.com/hibiken/asynq"
 )
 
+// Failed tasks are retried with exponential backoff, starting at
+// retryBaseDelay and doubling up to retryMaxDelay.
+const (
+	retryBaseDelay = time.Minute
+	retryMaxDelay  = 30 * time.Minute
+)
+
+// cleanupTimeout bounds how long Shutdown waits, after the grace period, for
+// interrupted tasks to tear down what they started.
+const cleanupTimeout = 2 * time.Minute
+
+// Maintenance tasks (schedule fires, reconciliation and retention purges) run
+// on a server of their own so that they aren't stuck behind analyses, which
+// run one at a time and can take hours. They are short, so are given less
+// time to finish on shutdown.
+const (
+	maintenanceConcurrency     = 2
+	maintenanceShutdownTimeout = 30 * time.Second
+)
+
 type Worker struct {
-	server *asynq.Server
+	server      *asynq.Server
+	maintenance *asynq.Server
+	handler     *TaskHandler
+	scheduler   *Scheduler
+	logger      *slog.Logger
 }
 
-func NewWorker(redisAddr, password string, logger *slog.Logger) *Worker {
+// NewWorker creates a worker. In-flight tasks get gracePeriod to finish when
+// the worker is shut down before they are interrupted and put back on the
+// queue.
+func NewWorker(redisAddr, password string, gracePeriod time.Duration, logger *slog.Logger) *Worker {
 	redisOpt := asynq.RedisClientOpt{
 		Addr:     redisAddr,
 		Password: password,
 	}
 
+	errorHandler := asynq.ErrorHandlerFunc(func(ctx context.Context, task *asynq.Task, err error) {
+		logger.Error(fmt.Sprintf("Task failed: %s", task.Type()), "Error", err)
+	})
+
 	server := asynq.NewServer(redisOpt, asynq.Config{
-		Concurrency: 1, // Process one task at a time
+		Concurrency: 1, // Process one analysis at a time
+		Queues: map[string]int{
+			QueueBloodhound: 1,
+		},
+		ShutdownTimeout: gracePeriod,
+		RetryDelayFunc:  retryDelay,
+		ErrorHandler:    errorHandler,
+	})
+
+	maintenance := asynq.NewServer(redisOpt, asynq.Config{
+		Concurrency: maintenanceConcurrency,
 		Queues: map[string]int{
-			"bloodhound": 1,
+			QueueScheduler: 1,
 		},
-		ErrorHandler: asynq.ErrorHandlerFunc(func(ctx context.Context, task *asynq.Task, err error) {
-			logger.Error(fmt.Sprintf("Task failed: %s", task.Type()), "Error", err)
-		}),
+		ShutdownTimeout: maintenanceShutdownTimeout,
+		RetryDelayFunc:  retryDelay,
+		ErrorHandler:    errorHandler,
 	})
 
 	return &Worker{
-		server: server,
+		server:      server,
+		maintenance: maintenance,
+		logger:      logger,
 	}
 }
 
-func (w *Worker) Start(handler *TaskHandler, logger *slog.Logger) error {
+// Start begins processing tasks, and firing schedules, in the background. It
+// returns once the worker is running; call Shutdown to stop it.
+func (w *Worker) Start(handler *TaskHandler, scheduler *Scheduler, logger *slog.Logger) error {
 	mux := asynq.NewServeMux()
 	mux.HandleFunc(TypeBloodhoundAnalysis, handler.ProcessBloodhoundAnalysis)
 
+	maintenanceMux := asynq.NewServeMux()
+	maintenanceMux.HandleFunc(TypeScheduleFire, scheduler.ProcessScheduleFire)
+	maintenanceMux.HandleFunc(TypeReconcile, scheduler.reconciler.ProcessReconcile)
+	maintenanceMux.HandleFunc(TypeRetentionPurge, scheduler.purger.ProcessRetentionPurge)
+
+	w.handler = handler
+
 	logger.Info("Starting Asynq Worker")
-	return w.server.Run(mux)
+	err := w.server.Start(mux)
+	if err != nil {
+		return err
+	}
+
+	err = w.maintenance.Start(maintenanceMux)
+	if err != nil {
+		w.server.Shutdown()
+		return err
+	}
+
+	err = scheduler.Start()
+	if err != nil {
+		w.maintenance.Shutdown()
+		w.server.Shutdown()
+		return err
+	}
+
+	w.scheduler = scheduler
+	return nil
+}
+
+// Stop stops fetching new tasks. Tasks already running are left alone.
+func (w *Worker) Stop() {
+	w.maintenance.Stop()
+	w.server.Stop()
 }
 
+// Shutdown stops fetching new tasks and waits up to the grace period for
+// in-flight tasks to finish. Tasks still running after that are interrupted:
+// asynq puts them back on the queue, and Shutdown then waits for their
+// handlers to record the interruption and tear down any BloodHound instance
+// they started.
 func (w *Worker) Shutdown() {
+	if w.scheduler != nil {
+		w.scheduler.Shutdown()
+	}
+
+	w.maintenance.Shutdown()
+
+	if w.handler != nil {
+		w.handler.interrupting.Store(true)
+	}
+
 	w.server.Shutdown()
+
+	if w.handler == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.handler.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(cleanupTimeout):
+		w.logger.Warn("gave up waiting for interrupted tasks to clean up", "timeout", cleanupTimeout.String())
+	}
+}
+
+// retryDelay returns how long to wait before the nth retry of a task. Up to a
+// quarter of the delay is added at random so that tasks that failed together,
+// say while S3 was unavailable, don't all retry at the same moment.
+func retryDelay(n int, err error, task *asynq.Task) time.Duration {
+	delay := retryMaxDelay
+	if n < 10 {
+		delay = min(retryBaseDelay<<n, retryMaxDelay)
+	}
+
+	return delay + rand.N(delay/4+1)
 }
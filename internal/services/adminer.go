@@ -1,21 +1,52 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 
+	"com.activehacks.ad-miner-backend/internal/analysis"
 	"com.activehacks.ad-miner-backend/internal/env"
 )
 
-type ADMinerService struct{}
+// ADMinerRunner renders AD-miner reports from the data loaded into BloodHound.
+type ADMinerRunner interface {
+	// RunAnalysis writes orgName's report to render_<orgName> in the
+	// organization's working directory.
+	RunAnalysis(ctx context.Context, orgName string, opts analysis.Options) error
 
-func NewADMinerService() *ADMinerService {
-	return &ADMinerService{}
+	// DataFile returns the name of the data file in orgName's report, which
+	// is what AD-miner reads previous runs from in evolution mode.
+	DataFile(ctx context.Context, orgName string) (string, error)
+
+	// Cleanup removes the organization's working directory.
+	Cleanup(ctx context.Context, orgName string) error
+
+	// Check verifies that AD-miner can be run on this host.
+	Check(ctx context.Context) error
+}
+
+// EvolutionDir is the directory in an organization's working directory that
+// previous runs' data files are fetched into. If it holds any, AD-miner
+// renders the organization's evolution over those runs.
+const EvolutionDir = "evolution"
+
+type ADMinerService struct {
+	logger *slog.Logger
 }
 
-func (s *ADMinerService) RunAnalysis(orgName string) error {
+func NewADMinerService(logger *slog.Logger) *ADMinerService {
+	return &ADMinerService{
+		logger: logger,
+	}
+}
+
+func (s *ADMinerService) RunAnalysis(ctx context.Context, orgName string, opts analysis.Options) error {
 	localPath := fmt.Sprintf("%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName)
 	neo4jUsername := env.GetString("NEO4J_USERNAME", "neo4j")
 	neo4jPassword := env.GetString("NEO4J_PASSWORD", "neo5j")
@@ -24,26 +55,77 @@ func (s *ADMinerService) RunAnalysis(orgName string) error {
 		return fmt.Errorf("failed to create directory %s: %v", localPath, err)
 	}
 
-	cmd := exec.Command("AD-miner", "-cf", orgName, "--rdp", "-u", neo4jUsername, "-p", neo4jPassword)
+	optionArgs, err := opts.Args()
+	if err != nil {
+		return permanentError(CodeInvalidInput, err)
+	}
+
+	// The cluster is the operator's to configure, since the Neo4j
+	// credentials below are sent to every node in it.
+	if cluster := env.GetString("ADMINER_CLUSTER", ""); cluster != "" {
+		optionArgs = append(optionArgs, "--cluster", cluster)
+	}
+
+	evolutionPath := filepath.Join(localPath, EvolutionDir)
+	if entries, err := os.ReadDir(evolutionPath); err == nil && len(entries) > 0 {
+		optionArgs = append(optionArgs, "--evolution", evolutionPath)
+	}
+
+	args := append([]string{"-cf", orgName, "-u", neo4jUsername, "-p", neo4jPassword}, optionArgs...)
+
+	cmd := exec.CommandContext(ctx, "AD-miner", args...)
 	cmd.Dir = localPath
 
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to run ADMiner: %v, output: %s", err, output)
+		return transientError(CodeAnalysisFailed, fmt.Errorf("failed to run ADMiner: %v, output: %s", err, output))
 	}
-	log.Printf("Completed ADMiner analysis for org: %s", orgName)
+	s.logger.InfoContext(ctx, "completed adminer analysis", "options", optionArgs)
 	return nil
 }
 
-func (s *ADMinerService) Cleanup(orgName string) error {
+// DataFile returns the name of the data file AD-miner wrote to orgName's
+// report, data_<org>_<date>.json.
+func (s *ADMinerService) DataFile(ctx context.Context, orgName string) (string, error) {
+	renderPath := fmt.Sprintf("%s/%s/render_%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName, orgName)
+
+	matches, err := filepath.Glob(filepath.Join(renderPath, "data_*.json"))
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no data file in %s", renderPath)
+	}
+
+	// The names end in the date, so the last is the newest should there be
+	// more than one.
+	slices.Sort(matches)
+	return filepath.Base(matches[len(matches)-1]), nil
+}
+
+func (s *ADMinerService) Cleanup(ctx context.Context, orgName string) error {
 	// NOTE: This will also delete file downloaded from S3 bucket
-	localPath := fmt.Sprintf("%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName)
-	cmd := exec.Command("rm", "-rf", localPath)
+	localPath, err := localWorkPath(orgName)
+	if err != nil {
+		return err
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	cmd := exec.CommandContext(ctx, "rm", "-rf", localPath)
+
+	if output, err := runCommand(ctx, cmd); err != nil {
 		return fmt.Errorf("failed to cleanup: %v, output: %s", err, output)
 	}
 
-	log.Printf("Cleaned up ADMiner artifacts")
+	s.logger.InfoContext(ctx, "cleaned up adminer artifacts", "path", localPath)
+	return nil
+}
+
+// Check verifies that the AD-miner binary is installed.
+func (s *ADMinerService) Check(ctx context.Context) error {
+	if _, err := exec.LookPath("AD-miner"); err != nil {
+		return errors.New("AD-miner not found in PATH")
+	}
+
 	return nil
 }
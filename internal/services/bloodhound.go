@@ -1,16 +1,60 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"os/exec"
 
 	"com.activehacks.ad-miner-backend/internal/env"
 )
 
+// Bloodhound backends, chosen with BLOODHOUND_BACKEND.
+const (
+	BloodhoundBackendScript = "script"
+	BloodhoundBackendCE     = "ce"
+)
+
+// BloodhoundRunner loads a SharpHound collection into a BloodHound database
+// for AD-miner to analyse.
+type BloodhoundRunner interface {
+	// StartInstance prepares an empty database for orgName's run.
+	StartInstance(ctx context.Context, orgName string) (*BloodhoundInstance, error)
+
+	// LoadData ingests the collection zipFileName from orgName's download
+	// directory and returns once it can be queried.
+	LoadData(ctx context.Context, orgName, zipFileName string) error
+
+	// DeleteInstance tears down what StartInstance set up. It is called
+	// after every run, including runs that failed to start.
+	DeleteInstance(ctx context.Context, orgName string) error
+
+	// Check verifies that the backend can be used from this host.
+	Check(ctx context.Context) error
+}
+
+// NewBloodhoundRunner returns the backend selected by BLOODHOUND_BACKEND: the
+// automation script, which starts a BloodHound per run, or the REST API of a
+// running BloodHound CE instance.
+func NewBloodhoundRunner(logger *slog.Logger) (BloodhoundRunner, error) {
+	switch backend := env.GetString("BLOODHOUND_BACKEND", BloodhoundBackendScript); backend {
+	case BloodhoundBackendScript:
+		return NewBloodhoundService(logger), nil
+	case BloodhoundBackendCE:
+		return newBloodhoundCEServiceFromEnv(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown BLOODHOUND_BACKEND %q, must be %s or %s", backend, BloodhoundBackendScript, BloodhoundBackendCE)
+	}
+}
+
+// BloodhoundService runs BloodHound through the bloodhound-automation script,
+// which starts a separate instance for each run.
 type BloodhoundService struct {
 	Path       string
 	ScriptName string
+	logger     *slog.Logger
 }
 
 type BloodhoundInstance struct {
@@ -18,23 +62,24 @@ type BloodhoundInstance struct {
 	Status  string
 }
 
-func NewBloodhoundService() *BloodhoundService {
+func NewBloodhoundService(logger *slog.Logger) *BloodhoundService {
 	return &BloodhoundService{
 		Path:       env.GetString("BLOODHOUND_SCRIPT_PATH", "/tmp/bloodhound-automation/"),
 		ScriptName: env.GetString("BLOODHOUND_SCRIPT_NAME", "bloodhound-automation.py"),
+		logger:     logger,
 	}
 }
 
-func (s *BloodhoundService) StartInstance(orgName string) (*BloodhoundInstance, error) {
-	cmd := exec.Command("python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "start", orgName)
+func (s *BloodhoundService) StartInstance(ctx context.Context, orgName string) (*BloodhoundInstance, error) {
+	cmd := exec.CommandContext(ctx, "python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "start", orgName)
 	cmd.Dir = s.Path
 
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start bloodhound instance: %v, output: %s", err, output)
+		return nil, transientError(CodeBloodhoundStartFailed, fmt.Errorf("failed to start bloodhound instance: %v, output: %s", err, output))
 	}
 
-	log.Printf("Started Bloodhound instance for org: %s", orgName)
+	s.logger.InfoContext(ctx, "started bloodhound instance")
 
 	return &BloodhoundInstance{
 		OrgName: orgName,
@@ -42,27 +87,42 @@ func (s *BloodhoundService) StartInstance(orgName string) (*BloodhoundInstance,
 	}, nil
 }
 
-func (s *BloodhoundService) LoadData(orgName, zipFileName string) error {
+func (s *BloodhoundService) LoadData(ctx context.Context, orgName, zipFileName string) error {
 	filepath := fmt.Sprintf("%s/%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName, zipFileName)
-	cmd := exec.Command("python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "data", "-z", filepath, orgName)
+	cmd := exec.CommandContext(ctx, "python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "data", "-z", filepath, orgName)
 	cmd.Dir = s.Path
 
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to load data: %v, output: %s", err, output)
+		return transientError(CodeDataLoadFailed, fmt.Errorf("failed to load data: %v, output: %s", err, output))
 	}
 
-	log.Printf("Loaded data for org: %s", orgName)
+	s.logger.InfoContext(ctx, "loaded data into bloodhound", "file", filepath)
 	return nil
 }
 
-func (s *BloodhoundService) DeleteInstance(orgName string) error {
-	deleteCmd := exec.Command("python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "delete", orgName)
+func (s *BloodhoundService) DeleteInstance(ctx context.Context, orgName string) error {
+	deleteCmd := exec.CommandContext(ctx, "python3", fmt.Sprintf("%s%s", s.Path, s.ScriptName), "delete", orgName)
 	deleteCmd.Dir = s.Path
-	if output, err := deleteCmd.CombinedOutput(); err != nil {
-		log.Printf("Warning: failed to delete bloodhound instance: %v, output: %s", err, output)
+	if output, err := runCommand(ctx, deleteCmd); err != nil {
+		s.logger.WarnContext(ctx, "failed to delete bloodhound instance", "error", err, "output", string(output))
+		return nil
+	}
+
+	s.logger.InfoContext(ctx, "stopped and deleted bloodhound instance")
+	return nil
+}
+
+// Check verifies that the automation script and its interpreter are present.
+func (s *BloodhoundService) Check(ctx context.Context) error {
+	if _, err := exec.LookPath("python3"); err != nil {
+		return errors.New("python3 not found in PATH")
+	}
+
+	script := fmt.Sprintf("%s%s", s.Path, s.ScriptName)
+	if _, err := os.Stat(script); err != nil {
+		return fmt.Errorf("bloodhound automation script not found at %s", script)
 	}
 
-	log.Printf("Stopped and deleted Bloodhound instance for org: %s", orgName)
 	return nil
 }
@@ -0,0 +1,414 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/env"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// File upload job statuses reported by BloodHound CE.
+const (
+	ceJobInvalid           = -1
+	ceJobComplete          = 2
+	ceJobCanceled          = 3
+	ceJobTimedOut          = 4
+	ceJobFailed            = 5
+	ceJobPartiallyComplete = 8
+)
+
+const (
+	ceLoginPath = "/api/v2/login"
+
+	ceLockTTL           = time.Minute
+	ceLockRetryInterval = 5 * time.Second
+)
+
+// errCEUnauthorized is returned when the API refuses the session token,
+// typically because it has expired.
+var errCEUnauthorized = errors.New("bloodhound ce session is not authorized")
+
+// BloodhoundCEService loads collections into a running BloodHound Community
+// Edition instance through its REST API, rather than starting a BloodHound
+// per run. The instance is shared by every run, so its database is cleared
+// before and after each one, and only one analysis can use it at a time: a
+// run holds lock, which every worker shares, from StartInstance until
+// DeleteInstance.
+type BloodhoundCEService struct {
+	baseURL      string
+	username     string
+	password     string
+	pollInterval time.Duration
+	client       *http.Client
+	lock         Locker
+	logger       *slog.Logger
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewBloodhoundCEService returns a service for the BloodHound CE instance at
+// baseURL, which logs in with username and password and holds lock while a
+// run uses the instance.
+func NewBloodhoundCEService(baseURL, username, password string, pollInterval time.Duration, client *http.Client, lock Locker, logger *slog.Logger) *BloodhoundCEService {
+	return &BloodhoundCEService{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		username:     username,
+		password:     password,
+		pollInterval: pollInterval,
+		client:       client,
+		lock:         lock,
+		logger:       logger,
+	}
+}
+
+func newBloodhoundCEServiceFromEnv(logger *slog.Logger) *BloodhoundCEService {
+	baseURL := env.GetString("BLOODHOUND_CE_URL", "http://localhost:8080")
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     env.GetString("REDIS_ADDR", "localhost:6379"),
+		Password: env.GetString("REDIS_PASSWORD", "SuperSecure@123"),
+	})
+	lock := NewRedisLock(redisClient, "bloodhound-ce:lock:"+baseURL, ceLockTTL, ceLockRetryInterval, logger)
+
+	return NewBloodhoundCEService(
+		baseURL,
+		env.GetString("BLOODHOUND_CE_USERNAME", "admin"),
+		env.GetString("BLOODHOUND_CE_PASSWORD", ""),
+		env.GetDuration("BLOODHOUND_CE_POLL_INTERVAL", 5*time.Second),
+		&http.Client{Timeout: 5 * time.Minute},
+		lock,
+		logger,
+	)
+}
+
+// StartInstance waits for any other run to finish with the instance, logs in
+// and clears whatever a previous run left in the database.
+func (s *BloodhoundCEService) StartInstance(ctx context.Context, orgName string) (*BloodhoundInstance, error) {
+	err := s.lock.Lock(ctx)
+	if err != nil {
+		return nil, transientError(CodeBloodhoundStartFailed, fmt.Errorf("failed to lock bloodhound ce instance: %w", err))
+	}
+
+	err = s.login(ctx)
+	if err != nil {
+		return nil, transientError(CodeBloodhoundStartFailed, err)
+	}
+
+	err = s.clearDatabase(ctx)
+	if err != nil {
+		return nil, transientError(CodeBloodhoundStartFailed, err)
+	}
+
+	s.logger.InfoContext(ctx, "connected to bloodhound ce", "url", s.baseURL)
+
+	return &BloodhoundInstance{
+		OrgName: orgName,
+		Status:  "running",
+	}, nil
+}
+
+// LoadData uploads the collection as a file upload job and waits for
+// BloodHound to finish ingesting and analysing it.
+func (s *BloodhoundCEService) LoadData(ctx context.Context, orgName, zipFileName string) error {
+	path := fmt.Sprintf("%s/%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName, zipFileName)
+
+	jobID, err := s.upload(ctx, path)
+	if err != nil {
+		return transientError(CodeDataLoadFailed, err)
+	}
+
+	s.logger.InfoContext(ctx, "uploaded collection to bloodhound ce", "file", path, "job_id", jobID)
+
+	err = s.waitForJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	s.logger.InfoContext(ctx, "loaded data into bloodhound", "file", path, "job_id", jobID)
+	return nil
+}
+
+// DeleteInstance clears the database so that the next run starts empty, and
+// lets the next run have the instance. As with the script, a failure is
+// logged rather than returned.
+func (s *BloodhoundCEService) DeleteInstance(ctx context.Context, orgName string) error {
+	defer func() {
+		if err := s.lock.Unlock(context.WithoutCancel(ctx)); err != nil {
+			s.logger.WarnContext(ctx, "failed to unlock bloodhound ce instance", "error", err)
+		}
+	}()
+
+	if err := s.clearDatabase(ctx); err != nil {
+		s.logger.WarnContext(ctx, "failed to clear bloodhound ce database", "error", err)
+		return nil
+	}
+
+	s.logger.InfoContext(ctx, "cleared bloodhound ce database")
+	return nil
+}
+
+// Check verifies that the instance is reachable and the credentials work.
+func (s *BloodhoundCEService) Check(ctx context.Context) error {
+	if s.password == "" {
+		return errors.New("BLOODHOUND_CE_PASSWORD is not set")
+	}
+
+	return s.login(ctx)
+}
+
+func (s *BloodhoundCEService) login(ctx context.Context) error {
+	body := map[string]string{
+		"login_method": "secret",
+		"username":     s.username,
+		"secret":       s.password,
+	}
+
+	var response struct {
+		Data struct {
+			SessionToken string `json:"session_token"`
+		} `json:"data"`
+	}
+
+	s.setToken("")
+
+	err := s.do(ctx, http.MethodPost, ceLoginPath, body, &response)
+	if err != nil {
+		return fmt.Errorf("failed to log in to bloodhound ce: %w", err)
+	}
+
+	if response.Data.SessionToken == "" {
+		return errors.New("failed to log in to bloodhound ce: no session token in response")
+	}
+
+	s.setToken(response.Data.SessionToken)
+	return nil
+}
+
+func (s *BloodhoundCEService) setToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+func (s *BloodhoundCEService) clearDatabase(ctx context.Context) error {
+	body := map[string]any{
+		"deleteCollectedGraphData":  true,
+		"deleteFileIngestHistory":   true,
+		"deleteDataQualityHistory":  true,
+		"deleteAssetGroupSelectors": []int{},
+	}
+
+	err := s.do(ctx, http.MethodPost, "/api/v2/clear-database", body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to clear bloodhound ce database: %w", err)
+	}
+
+	return nil
+}
+
+func (s *BloodhoundCEService) upload(ctx context.Context, path string) (int64, error) {
+	var job struct {
+		Data struct {
+			ID int64 `json:"id"`
+		} `json:"data"`
+	}
+
+	err := s.do(ctx, http.MethodPost, "/api/v2/file-upload/start", nil, &job)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file upload job: %w", err)
+	}
+
+	jobID := job.Data.ID
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// The client closes a body that can be closed, so the file is wrapped
+	// to keep it open for a retry after logging in again.
+	body := io.NewSectionReader(file, 0, info.Size())
+
+	err = s.doRaw(ctx, http.MethodPost, fmt.Sprintf("/api/v2/file-upload/%d", jobID), "application/zip", body, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload %s: %w", path, err)
+	}
+
+	err = s.do(ctx, http.MethodPost, fmt.Sprintf("/api/v2/file-upload/%d/end", jobID), nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to end file upload job %d: %w", jobID, err)
+	}
+
+	return jobID, nil
+}
+
+// waitForJob polls a file upload job until BloodHound has finished with it.
+func (s *BloodhoundCEService) waitForJob(ctx context.Context, jobID int64) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var jobs struct {
+			Data []struct {
+				ID            int64  `json:"id"`
+				Status        int    `json:"status"`
+				StatusMessage string `json:"status_message"`
+			} `json:"data"`
+		}
+
+		err := s.do(ctx, http.MethodGet, fmt.Sprintf("/api/v2/file-upload?id=eq:%d", jobID), nil, &jobs)
+		if err != nil {
+			return transientError(CodeDataLoadFailed, fmt.Errorf("failed to get status of file upload job %d: %w", jobID, err))
+		}
+
+		for _, job := range jobs.Data {
+			if job.ID != jobID {
+				continue
+			}
+
+			switch job.Status {
+			case ceJobComplete:
+				return nil
+			case ceJobPartiallyComplete:
+				s.logger.WarnContext(ctx, "bloodhound ce only partially ingested the collection", "job_id", jobID, "message", job.StatusMessage)
+				return nil
+			case ceJobInvalid, ceJobFailed:
+				// BloodHound rejected the collection itself, which won't
+				// change on a retry.
+				return permanentError(CodeDataLoadFailed, fmt.Errorf("bloodhound ce failed to ingest the collection: %s", job.StatusMessage))
+			case ceJobCanceled, ceJobTimedOut:
+				return transientError(CodeDataLoadFailed, fmt.Errorf("bloodhound ce did not finish ingesting the collection: %s", job.StatusMessage))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return transientError(CodeDataLoadFailed, fmt.Errorf("gave up waiting for file upload job %d: %w", jobID, ctx.Err()))
+		case <-ticker.C:
+		}
+	}
+}
+
+// do sends a JSON request to the API and decodes the JSON response into
+// response, if it isn't nil.
+func (s *BloodhoundCEService) do(ctx context.Context, method, path string, body, response any) error {
+	var reader io.Reader
+	contentType := ""
+
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(js)
+		contentType = "application/json"
+	}
+
+	return s.doRaw(ctx, method, path, contentType, reader, response)
+}
+
+// doRaw sends a request to the API. Sessions expire, so a request that is
+// refused is sent once more after logging in again, if its body can be
+// rewound.
+func (s *BloodhoundCEService) doRaw(ctx context.Context, method, path, contentType string, body io.Reader, response any) error {
+	err := s.send(ctx, method, path, contentType, body, response)
+	if !errors.Is(err, errCEUnauthorized) || path == ceLoginPath {
+		return err
+	}
+
+	if body != nil {
+		seeker, ok := body.(io.Seeker)
+		if !ok {
+			return err
+		}
+
+		_, seekErr := seeker.Seek(0, io.SeekStart)
+		if seekErr != nil {
+			return err
+		}
+	}
+
+	s.logger.InfoContext(ctx, "bloodhound ce session expired, logging in again")
+
+	loginErr := s.login(ctx)
+	if loginErr != nil {
+		return loginErr
+	}
+
+	return s.send(ctx, method, path, contentType, body, response)
+}
+
+func (s *BloodhoundCEService) send(ctx context.Context, method, path, contentType string, body io.Reader, response any) error {
+	ctx, span := tracer.Start(ctx, method+" bloodhound-ce", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("url.path", path),
+	))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= 300 {
+		// Error bodies are short JSON documents; the limit guards against
+		// something else answering on the port.
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+		if resp.StatusCode == http.StatusUnauthorized {
+			err = fmt.Errorf("%w: %w", errCEUnauthorized, err)
+		}
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
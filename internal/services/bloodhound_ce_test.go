@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testCEOrg      = "acme"
+	testCEPassword = "secret"
+	testCEJobID    = 7
+	ceJobRunning   = 1
+)
+
+// fakeCE is a BloodHound CE API that runs one file upload job through the
+// given statuses, repeating the last one.
+type fakeCE struct {
+	mu       sync.Mutex
+	calls    []string
+	tokens   map[string]bool
+	logins   int
+	statuses []int
+	uploaded []byte
+
+	// expirePath expires every session the first time it is requested.
+	expirePath string
+}
+
+func newFakeCE(t *testing.T, statuses ...int) (*fakeCE, *httptest.Server) {
+	t.Helper()
+
+	ce := &fakeCE{tokens: map[string]bool{}, statuses: statuses}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/login", ce.login)
+	mux.HandleFunc("POST /api/v2/clear-database", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /api/v2/file-upload/start", func(w http.ResponseWriter, r *http.Request) {
+		writeCEJSON(w, map[string]any{"data": map[string]any{"id": testCEJobID}})
+	})
+	mux.HandleFunc("POST /api/v2/file-upload/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/zip" {
+			http.Error(w, "unsupported content type", http.StatusBadRequest)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		ce.mu.Lock()
+		ce.uploaded = body
+		ce.mu.Unlock()
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("POST /api/v2/file-upload/{id}/end", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /api/v2/file-upload", ce.jobs)
+
+	server := httptest.NewServer(ce.authenticate(mux))
+	t.Cleanup(server.Close)
+
+	return ce, server
+}
+
+func (ce *fakeCE) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ce.mu.Lock()
+		ce.calls = append(ce.calls, r.Method+" "+r.URL.Path)
+
+		if r.URL.Path != ceLoginPath {
+			if ce.expirePath != "" && r.URL.Path == ce.expirePath {
+				ce.expirePath = ""
+				ce.tokens = map[string]bool{}
+			}
+
+			if !ce.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+				ce.mu.Unlock()
+				http.Error(w, `{"errors":[{"message":"unauthorized"}]}`, http.StatusUnauthorized)
+				return
+			}
+		}
+		ce.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ce *fakeCE) login(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Secret string `json:"secret"`
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+
+	if input.Secret != testCEPassword {
+		http.Error(w, `{"errors":[{"message":"invalid credentials"}]}`, http.StatusUnauthorized)
+		return
+	}
+
+	ce.mu.Lock()
+	ce.logins++
+	token := fmt.Sprintf("token-%d", ce.logins)
+	ce.tokens[token] = true
+	ce.mu.Unlock()
+
+	writeCEJSON(w, map[string]any{"data": map[string]any{"session_token": token}})
+}
+
+func (ce *fakeCE) jobs(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("id") != fmt.Sprintf("eq:%d", testCEJobID) {
+		writeCEJSON(w, map[string]any{"data": []any{}})
+		return
+	}
+
+	ce.mu.Lock()
+	status := ce.statuses[0]
+	if len(ce.statuses) > 1 {
+		ce.statuses = ce.statuses[1:]
+	}
+	ce.mu.Unlock()
+
+	writeCEJSON(w, map[string]any{"data": []any{
+		map[string]any{"id": testCEJobID, "status": status, "status_message": fmt.Sprintf("status %d", status)},
+	}})
+}
+
+func (ce *fakeCE) callList() []string {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	return slices.Clone(ce.calls)
+}
+
+func writeCEJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fakeLock records whether it is held.
+type fakeLock struct {
+	mu     sync.Mutex
+	held   bool
+	locked int
+}
+
+func (l *fakeLock) Lock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held {
+		return errors.New("lock is already held")
+	}
+
+	l.held = true
+	l.locked++
+	return nil
+}
+
+func (l *fakeLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held = false
+	return nil
+}
+
+func (l *fakeLock) isHeld() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// newTestCEService returns a service for server, with a collection for
+// testCEOrg in its download directory.
+func newTestCEService(t *testing.T, server *httptest.Server, password string) (*BloodhoundCEService, *fakeLock, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("S3_DOWNLOAD_LOCATION", dir)
+
+	collection := []byte("PK\x03\x04 sharphound collection")
+	err := os.MkdirAll(filepath.Join(dir, testCEOrg), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, testCEOrg, "sharphound.zip"), collection, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := &fakeLock{}
+	s := NewBloodhoundCEService(server.URL, "admin", password, time.Millisecond, server.Client(), lock, slog.New(slog.DiscardHandler))
+
+	return s, lock, collection
+}
+
+func TestBloodhoundCEWorkflow(t *testing.T) {
+	ce, server := newFakeCE(t, ceJobRunning, ceJobRunning, ceJobComplete)
+	s, lock, collection := newTestCEService(t, server, testCEPassword)
+	ctx := context.Background()
+
+	_, err := s.StartInstance(ctx, testCEOrg)
+	if err != nil {
+		t.Fatalf("StartInstance: %v", err)
+	}
+
+	if !lock.isHeld() {
+		t.Error("instance is not locked while in use")
+	}
+
+	err = s.LoadData(ctx, testCEOrg, "sharphound.zip")
+	if err != nil {
+		t.Fatalf("LoadData: %v", err)
+	}
+
+	err = s.DeleteInstance(ctx, testCEOrg)
+	if err != nil {
+		t.Fatalf("DeleteInstance: %v", err)
+	}
+
+	if lock.isHeld() {
+		t.Error("instance is still locked after the run")
+	}
+
+	wantCalls := []string{
+		"POST /api/v2/login",
+		"POST /api/v2/clear-database",
+		"POST /api/v2/file-upload/start",
+		"POST /api/v2/file-upload/7",
+		"POST /api/v2/file-upload/7/end",
+		"GET /api/v2/file-upload",
+		"GET /api/v2/file-upload",
+		"GET /api/v2/file-upload",
+		"POST /api/v2/clear-database",
+	}
+	if got := ce.callList(); !slices.Equal(got, wantCalls) {
+		t.Errorf("calls = %v, want %v", got, wantCalls)
+	}
+
+	if string(ce.uploaded) != string(collection) {
+		t.Errorf("uploaded %q, want %q", ce.uploaded, collection)
+	}
+}
+
+func TestBloodhoundCEJobStatuses(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{"complete", ceJobComplete, false, false},
+		{"partially complete", ceJobPartiallyComplete, false, false},
+		{"failed", ceJobFailed, true, true},
+		{"invalid", ceJobInvalid, true, true},
+		{"canceled", ceJobCanceled, true, false},
+		{"timed out", ceJobTimedOut, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := newFakeCE(t, ceJobRunning, tt.status)
+			s, _, _ := newTestCEService(t, server, testCEPassword)
+			ctx := context.Background()
+
+			_, err := s.StartInstance(ctx, testCEOrg)
+			if err != nil {
+				t.Fatalf("StartInstance: %v", err)
+			}
+			defer s.DeleteInstance(ctx, testCEOrg)
+
+			err = s.LoadData(ctx, testCEOrg, "sharphound.zip")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadData error = %v, want error %t", err, tt.wantErr)
+			}
+
+			if err == nil {
+				return
+			}
+
+			if IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("permanent = %t, want %t", IsPermanent(err), tt.wantPermanent)
+			}
+
+			if code := ErrorCode(err); code != CodeDataLoadFailed {
+				t.Errorf("code = %s, want %s", code, CodeDataLoadFailed)
+			}
+		})
+	}
+}
+
+func TestBloodhoundCEJobTimeout(t *testing.T) {
+	_, server := newFakeCE(t, ceJobRunning)
+	s, _, _ := newTestCEService(t, server, testCEPassword)
+
+	_, err := s.StartInstance(context.Background(), testCEOrg)
+	if err != nil {
+		t.Fatalf("StartInstance: %v", err)
+	}
+	defer s.DeleteInstance(context.Background(), testCEOrg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = s.LoadData(ctx, testCEOrg, "sharphound.zip")
+	if err == nil {
+		t.Fatal("expected an error when the job never finishes")
+	}
+
+	// The job may finish on a later attempt.
+	if IsPermanent(err) {
+		t.Error("timeout is permanent, want transient")
+	}
+
+	if code := ErrorCode(err); code != CodeDataLoadFailed {
+		t.Errorf("code = %s, want %s", code, CodeDataLoadFailed)
+	}
+}
+
+func TestBloodhoundCELogsInAgainWhenSessionExpires(t *testing.T) {
+	ce, server := newFakeCE(t, ceJobComplete)
+	s, _, collection := newTestCEService(t, server, testCEPassword)
+	ctx := context.Background()
+
+	_, err := s.StartInstance(ctx, testCEOrg)
+	if err != nil {
+		t.Fatalf("StartInstance: %v", err)
+	}
+	defer s.DeleteInstance(ctx, testCEOrg)
+
+	// The session expires as the collection is uploaded, which has to be
+	// sent again in full.
+	ce.mu.Lock()
+	ce.expirePath = "/api/v2/file-upload/7"
+	ce.mu.Unlock()
+
+	err = s.LoadData(ctx, testCEOrg, "sharphound.zip")
+	if err != nil {
+		t.Fatalf("LoadData: %v", err)
+	}
+
+	if ce.logins != 2 {
+		t.Errorf("logged in %d times, want 2", ce.logins)
+	}
+
+	if string(ce.uploaded) != string(collection) {
+		t.Errorf("uploaded %q after logging in again, want %q", ce.uploaded, collection)
+	}
+}
+
+func TestBloodhoundCELoginFailure(t *testing.T) {
+	ce, server := newFakeCE(t, ceJobComplete)
+	s, lock, _ := newTestCEService(t, server, "wrong")
+	ctx := context.Background()
+
+	_, err := s.StartInstance(ctx, testCEOrg)
+	if err == nil {
+		t.Fatal("expected an error with the wrong password")
+	}
+
+	if IsPermanent(err) || ErrorCode(err) != CodeBloodhoundStartFailed {
+		t.Errorf("error = %v (code %s, permanent %t), want transient %s", err, ErrorCode(err), IsPermanent(err), CodeBloodhoundStartFailed)
+	}
+
+	// A failed login isn't retried as an expired session.
+	if got := ce.callList(); !slices.Equal(got, []string{"POST /api/v2/login"}) {
+		t.Errorf("calls = %v, want a single login", got)
+	}
+
+	// The run is torn down after a failed start, which frees the instance.
+	s.DeleteInstance(ctx, testCEOrg)
+
+	if lock.isHeld() {
+		t.Error("instance is still locked after a failed start")
+	}
+}
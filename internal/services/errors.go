@@ -0,0 +1,62 @@
+package services
+
+import (
+	"errors"
+)
+
+// Error codes for pipeline failures. They are stored with failed results, so
+// they are part of the API and shouldn't be renamed.
+const (
+	CodeInputNotFound         = "input_not_found"
+	CodeInvalidInput          = "invalid_input"
+	CodeStorageUnavailable    = "storage_unavailable"
+	CodeBloodhoundStartFailed = "bloodhound_start_failed"
+	CodeDataLoadFailed        = "data_load_failed"
+	CodeAnalysisFailed        = "analysis_failed"
+	CodeUploadFailed          = "upload_failed"
+	CodeTimeout               = "timeout"
+	CodeTaskLost              = "task_lost"
+	CodeUnknown               = "unknown"
+)
+
+// Error is a classified service failure. Permanent errors, such as missing or
+// corrupt input, fail the same way however many times they are retried.
+type Error struct {
+	Code      string
+	Permanent bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func permanentError(code string, err error) error {
+	return &Error{Code: code, Permanent: true, Err: err}
+}
+
+func transientError(code string, err error) error {
+	return &Error{Code: code, Err: err}
+}
+
+// ErrorCode returns the code of the first classified error in err's chain, or
+// CodeUnknown if there isn't one.
+func ErrorCode(err error) string {
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Code
+	}
+
+	return CodeUnknown
+}
+
+// IsPermanent reports whether retrying the operation that returned err is
+// pointless.
+func IsPermanent(err error) bool {
+	var serviceErr *Error
+	return errors.As(err, &serviceErr) && serviceErr.Permanent
+}
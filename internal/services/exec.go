@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/env"
+	"com.activehacks.ad-miner-backend/internal/metrics"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const subprocessWaitDelay = 30 * time.Second
+
+var tracer = otel.Tracer("com.activehacks.ad-miner-backend/internal/services")
+
+// runCommand runs cmd and returns its combined output, counting failures per
+// tool so that a misbehaving dependency shows up in metrics.
+//
+// Each invocation gets its own span. Only the tool name is recorded, not the
+// arguments, as some tools are passed credentials on the command line.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	tool := filepath.Base(cmd.Args[0])
+
+	_, span := tracer.Start(ctx, "exec "+tool, trace.WithAttributes(
+		attribute.String("process.executable.name", tool),
+	))
+	defer span.End()
+
+	// Commands built with exec.CommandContext are killed when their context
+	// is cancelled, e.g. when the worker shuts down. Ask nicely first so the
+	// tools get a chance to stop their containers, then kill them if they
+	// haven't exited in time.
+	if cmd.Cancel != nil {
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(syscall.SIGTERM)
+		}
+		cmd.WaitDelay = subprocessWaitDelay
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		metrics.SubprocessFailures.WithLabelValues(tool).Inc()
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			span.SetAttributes(attribute.Int("process.exit.code", exitErr.ExitCode()))
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return output, err
+}
+
+// localWorkPath joins elem onto the local download location, and refuses a
+// path that isn't strictly inside it, so that an organization name such as
+// ".." can't turn a cleanup into deleting something else on the host.
+func localWorkPath(elem ...string) (string, error) {
+	root := filepath.Clean(env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"))
+	localPath := filepath.Join(append([]string{root}, elem...)...)
+
+	rel, err := filepath.Rel(root, localPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the download location", localPath)
+	}
+
+	return localPath, nil
+}
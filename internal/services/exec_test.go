@@ -0,0 +1,40 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalWorkPath(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("S3_DOWNLOAD_LOCATION", root)
+
+	tests := []struct {
+		elem []string
+		want string
+	}{
+		{[]string{"acme"}, filepath.Join(root, "acme")},
+		{[]string{"acme", "extracted"}, filepath.Join(root, "acme", "extracted")},
+		{[]string{"acme", "sharphound.zip"}, filepath.Join(root, "acme", "sharphound.zip")},
+		{[]string{".."}, ""},
+		{[]string{"..", "sharphound.zip"}, ""},
+		{[]string{"acme/../..", "etc"}, ""},
+		{[]string{"."}, ""},
+		{[]string{""}, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := localWorkPath(tt.elem...)
+
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("localWorkPath(%q) = %q, want an error", tt.elem, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("localWorkPath(%q) = %q, %v, want %q", tt.elem, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"com.activehacks.ad-miner-backend/internal/analysis"
+	"com.activehacks.ad-miner-backend/internal/services"
+)
+
+// ADMiner renders a report from whatever was loaded into the fake
+// BloodHound.
+type ADMiner struct {
+	calls      *Calls
+	dir        string
+	bloodhound *Bloodhound
+
+	mu   sync.Mutex
+	args map[string][]string
+}
+
+// Args returns the flags orgName's last analysis would have passed to
+// AD-miner, including --evolution.
+func (a *ADMiner) Args(orgName string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.args[orgName]
+}
+
+// RunAnalysis writes render_<org> to the working directory with the layout
+// AD-miner produces: an index page, one page per control, the data the pages
+// load and the data file that later runs read for evolution. Options are checked the way ADMinerService checks them.
+func (a *ADMiner) RunAnalysis(ctx context.Context, orgName string, opts analysis.Options) error {
+	if err := a.calls.record(ctx, "ADMiner.RunAnalysis"); err != nil {
+		return err
+	}
+
+	args, err := opts.Args()
+	if err != nil {
+		return &services.Error{Code: services.CodeInvalidInput, Permanent: true, Err: err}
+	}
+
+	// Like ADMinerService, only pass --evolution if there are previous runs
+	// to show.
+	evolutionPath := filepath.Join(orgDir(a.dir, orgName), services.EvolutionDir)
+	evolution, _ := os.ReadDir(evolutionPath)
+	if len(evolution) > 0 {
+		args = append(args, "--evolution", evolutionPath)
+	}
+
+	a.mu.Lock()
+	if a.args == nil {
+		a.args = make(map[string][]string)
+	}
+	a.args[orgName] = args
+	a.mu.Unlock()
+
+	loaded := a.bloodhound.Loaded(orgName)
+	if len(loaded) == 0 {
+		return &services.Error{Code: services.CodeAnalysisFailed, Err: errors.New("failed to run ADMiner: neo4j database is empty")}
+	}
+
+	renderDir := filepath.Join(orgDir(a.dir, orgName), "render_"+orgName)
+
+	files := map[string]string{
+		"index.html":             fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>AD-miner - %s</title></head><body><h1>%s</h1></body></html>\n", orgName, orgName),
+		"html/users_admin.html":  "<!DOCTYPE html>\n<html><body><h2>Admin users</h2></body></html>\n",
+		"html/computers_os.html": "<!DOCTYPE html>\n<html><body><h2>Operating systems</h2></body></html>\n",
+		"js/data.js":             fmt.Sprintf("const data = {\"org\": %q, \"files\": %d, \"evolution\": %d};\n", orgName, len(loaded), len(evolution)),
+		"csv/users_admin.csv":    "name,domain\n",
+		dataFileName(orgName):    fmt.Sprintf("{\"org\": %q, \"rating\": \"B\"}\n", orgName),
+	}
+
+	for name, content := range files {
+		path := filepath.Join(renderDir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *ADMiner) DataFile(ctx context.Context, orgName string) (string, error) {
+	if err := a.calls.record(ctx, "ADMiner.DataFile"); err != nil {
+		return "", err
+	}
+
+	name := dataFileName(orgName)
+
+	_, err := os.Stat(filepath.Join(orgDir(a.dir, orgName), "render_"+orgName, name))
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// dataFileName returns the name AD-miner gives the data file of a run on the
+// fixture collection, which is dated to when it was collected.
+func dataFileName(orgName string) string {
+	return fmt.Sprintf("data_%s_20240101.json", orgName)
+}
+
+// Cleanup removes the organization's working directory. Like DeleteInstance
+// it refuses to work with a cancelled context.
+func (a *ADMiner) Cleanup(ctx context.Context, orgName string) error {
+	if err := a.calls.record(ctx, "ADMiner.Cleanup"); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(orgDir(a.dir, orgName))
+}
+
+func (a *ADMiner) Check(ctx context.Context) error {
+	return a.calls.record(ctx, "ADMiner.Check")
+}
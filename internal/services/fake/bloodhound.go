@@ -0,0 +1,125 @@
+package fake
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"com.activehacks.ad-miner-backend/internal/services"
+)
+
+// Bloodhound keeps track of a single instance, like the automation script,
+// which can't start a second instance for an organization while one is
+// running.
+type Bloodhound struct {
+	calls *Calls
+	dir   string
+
+	mu      sync.Mutex
+	running map[string]bool
+	loaded  map[string][]string
+}
+
+// Running reports whether orgName's instance is running.
+func (b *Bloodhound) Running(orgName string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.running[orgName]
+}
+
+// Loaded returns the names of the files loaded into orgName's instance.
+func (b *Bloodhound) Loaded(orgName string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.loaded[orgName]
+}
+
+func (b *Bloodhound) StartInstance(ctx context.Context, orgName string) (*services.BloodhoundInstance, error) {
+	if err := b.calls.record(ctx, "Bloodhound.StartInstance"); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.running[orgName] {
+		return nil, &services.Error{Code: services.CodeBloodhoundStartFailed, Err: fmt.Errorf("failed to start bloodhound instance: %s is already running", orgName)}
+	}
+
+	if b.running == nil {
+		b.running = make(map[string]bool)
+		b.loaded = make(map[string][]string)
+	}
+	b.running[orgName] = true
+	b.loaded[orgName] = nil
+
+	return &services.BloodhoundInstance{OrgName: orgName, Status: "running"}, nil
+}
+
+// LoadData reads the collection from the working directory, as the script
+// does, and fails if it isn't a zip of SharpHound JSON files.
+func (b *Bloodhound) LoadData(ctx context.Context, orgName, zipFileName string) error {
+	if err := b.calls.record(ctx, "Bloodhound.LoadData"); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	running := b.running[orgName]
+	b.mu.Unlock()
+
+	if !running {
+		return &services.Error{Code: services.CodeDataLoadFailed, Err: errors.New("failed to load data: no bloodhound instance is running")}
+	}
+
+	r, err := zip.OpenReader(filepath.Join(orgDir(b.dir, orgName), zipFileName))
+	if err != nil {
+		return &services.Error{Code: services.CodeDataLoadFailed, Err: fmt.Errorf("failed to load data: %v", err)}
+	}
+	defer r.Close()
+
+	var files []string
+	for _, f := range r.File {
+		if filepath.Ext(f.Name) == ".json" {
+			files = append(files, f.Name)
+		}
+	}
+
+	if len(files) == 0 {
+		return &services.Error{Code: services.CodeDataLoadFailed, Err: errors.New("failed to load data: no SharpHound files in collection")}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.loaded[orgName] = files
+	return nil
+}
+
+// DeleteInstance stops orgName's instance. Like the script it is called with
+// a context that outlives the run, and refuses to work with a cancelled one
+// so that a test can tell.
+func (b *Bloodhound) DeleteInstance(ctx context.Context, orgName string) error {
+	if err := b.calls.record(ctx, "Bloodhound.DeleteInstance"); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.running, orgName)
+	delete(b.loaded, orgName)
+	return nil
+}
+
+func (b *Bloodhound) Check(ctx context.Context) error {
+	return b.calls.record(ctx, "Bloodhound.Check")
+}
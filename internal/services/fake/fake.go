@@ -0,0 +1,126 @@
+// Package fake provides in-memory stand-ins for the services the analysis
+// pipeline shells out to, so that the pipeline can be run without python,
+// Docker, Neo4j, AD-miner or AWS.
+//
+// The fakes share a working directory laid out like S3_DOWNLOAD_LOCATION and
+// leave the same files behind as the real tools: the downloaded collection,
+// a render_<org> report and the extracted/ directory that is uploaded.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"com.activehacks.ad-miner-backend/internal/services"
+)
+
+// Calls records the calls made to a set of fakes, in order, and lets a test
+// change what any of them does. Methods are named "Type.Method", for example
+// "Bloodhound.LoadData".
+type Calls struct {
+	mu    sync.Mutex
+	log   []string
+	hooks map[string]func(ctx context.Context) error
+}
+
+// On runs hook whenever method is called, before the fake does any work. If
+// hook returns an error, the method returns it without doing anything else.
+func (c *Calls) On(method string, hook func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hooks == nil {
+		c.hooks = make(map[string]func(ctx context.Context) error)
+	}
+	c.hooks[method] = hook
+}
+
+// Fail makes the next times calls to method return err, or every call if
+// times is zero.
+func (c *Calls) Fail(method string, err error, times int) {
+	remaining := times
+
+	c.On(method, func(ctx context.Context) error {
+		if times == 0 {
+			return err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if remaining == 0 {
+			return nil
+		}
+		remaining--
+		return err
+	})
+}
+
+// List returns the methods called so far, in order.
+func (c *Calls) List() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.log)
+}
+
+// Count returns how many times method has been called.
+func (c *Calls) Count(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, call := range c.log {
+		if call == method {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Calls) record(ctx context.Context, method string) error {
+	c.mu.Lock()
+	c.log = append(c.log, method)
+	hook := c.hooks[method]
+	c.mu.Unlock()
+
+	if hook != nil {
+		return hook(ctx)
+	}
+	return nil
+}
+
+// Services is a set of fakes wired together the way the real services are:
+// AD-miner reads what was loaded into BloodHound, and reports are uploaded
+// from the working directory to the bucket.
+type Services struct {
+	Calls      *Calls
+	Storage    *Storage
+	Bloodhound *Bloodhound
+	ADMiner    *ADMiner
+}
+
+// New returns fakes that work in dir.
+func New(dir string) *Services {
+	calls := &Calls{}
+	bloodhound := &Bloodhound{calls: calls, dir: dir}
+
+	return &Services{
+		Calls:      calls,
+		Storage:    &Storage{calls: calls, dir: dir, objects: make(map[string][]byte)},
+		Bloodhound: bloodhound,
+		ADMiner:    &ADMiner{calls: calls, dir: dir, bloodhound: bloodhound},
+	}
+}
+
+func orgDir(dir, orgName string) string {
+	return fmt.Sprintf("%s/%s", dir, orgName)
+}
+
+var (
+	_ services.Storage          = (*Storage)(nil)
+	_ services.BloodhoundRunner = (*Bloodhound)(nil)
+	_ services.ADMinerRunner    = (*ADMiner)(nil)
+)
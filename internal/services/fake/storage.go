@@ -0,0 +1,230 @@
+package fake
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/services"
+)
+
+// Storage is an in-memory bucket. Objects are keyed by their full path, such
+// as s3://bucket/prefix/sharphound.zip.
+type Storage struct {
+	calls *Calls
+	dir   string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// Put stores an object in the bucket.
+func (s *Storage) Put(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[path] = data
+}
+
+// Get returns an object from the bucket.
+func (s *Storage) Get(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.objects[path]
+	return data, ok
+}
+
+// Paths returns the paths of every object in the bucket, sorted.
+func (s *Storage) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths := make([]string, 0, len(s.objects))
+	for path := range s.objects {
+		paths = append(paths, path)
+	}
+
+	slices.Sort(paths)
+	return paths
+}
+
+// DownloadFile fails like S3Service.DownloadFile: a missing object or an
+// invalid zip is a permanent error.
+func (s *Storage) DownloadFile(ctx context.Context, orgName, bucketPath, filename string) error {
+	if err := s.calls.record(ctx, "Storage.DownloadFile"); err != nil {
+		return err
+	}
+
+	s3Path := fmt.Sprintf("%s/%s", bucketPath, filename)
+
+	data, ok := s.Get(s3Path)
+	if !ok {
+		return &services.Error{Code: services.CodeInputNotFound, Permanent: true, Err: fmt.Errorf("failed to download %s: (404) Not Found", filename)}
+	}
+
+	localPath := filepath.Join(orgDir(s.dir, orgName), filename)
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return err
+	}
+
+	if filepath.Ext(filename) == ".zip" {
+		if _, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err != nil {
+			return &services.Error{Code: services.CodeInvalidInput, Permanent: true, Err: fmt.Errorf("%s is not a valid zip archive: %v", filename, err)}
+		}
+	}
+
+	return nil
+}
+
+// UploadResults renames render_<org> to extracted, as S3Service does, and
+// copies it into the bucket.
+func (s *Storage) UploadResults(ctx context.Context, bucketPath, orgName string) error {
+	if err := s.calls.record(ctx, "Storage.UploadResults"); err != nil {
+		return err
+	}
+
+	localPath := orgDir(s.dir, orgName)
+	oldDir := filepath.Join(localPath, "render_"+orgName)
+	newDir := filepath.Join(localPath, "extracted")
+
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return &services.Error{Code: services.CodeUploadFailed, Err: fmt.Errorf("failed to rename %s: %v", oldDir, err)}
+	}
+
+	return filepath.WalkDir(newDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(newDir, path)
+		if err != nil {
+			return err
+		}
+
+		s.Put(fmt.Sprintf("%s/extracted/%s", bucketPath, filepath.ToSlash(rel)), data)
+		return nil
+	})
+}
+
+// FetchFile fails like S3Service.FetchFile: a missing object is a permanent
+// error.
+func (s *Storage) FetchFile(ctx context.Context, orgName, s3Path, filename string) error {
+	if err := s.calls.record(ctx, "Storage.FetchFile"); err != nil {
+		return err
+	}
+
+	data, ok := s.Get(s3Path)
+	if !ok {
+		return &services.Error{Code: services.CodeInputNotFound, Permanent: true, Err: fmt.Errorf("failed to download %s: (404) Not Found", s3Path)}
+	}
+
+	localPath := filepath.Join(orgDir(s.dir, orgName), filename)
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(localPath, data, 0644)
+}
+
+func (s *Storage) CopyFile(ctx context.Context, src, dst string) error {
+	if err := s.calls.record(ctx, "Storage.CopyFile"); err != nil {
+		return err
+	}
+
+	data, ok := s.Get(src)
+	if !ok {
+		return &services.Error{Code: services.CodeStorageUnavailable, Err: fmt.Errorf("failed to copy %s to %s: (404) Not Found", src, dst)}
+	}
+
+	s.Put(dst, data)
+	return nil
+}
+
+func (s *Storage) DeleteFile(ctx context.Context, bucketPath, filename string) error {
+	if err := s.calls.record(ctx, "Storage.DeleteFile"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, bucketPath+"/"+filename)
+	return nil
+}
+
+func (s *Storage) DeleteDirectory(ctx context.Context, bucketPath, dir string) error {
+	if err := s.calls.record(ctx, "Storage.DeleteDirectory"); err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(bucketPath, "/") + "/"
+	if dir != "" {
+		prefix += dir + "/"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path := range s.objects {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.objects, path)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Cleanup(ctx context.Context, orgName, filename string) error {
+	if err := s.calls.record(ctx, "Storage.Cleanup"); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(filepath.Join(orgDir(s.dir, orgName), filename))
+}
+
+// SharpHoundZip returns a small but well-formed SharpHound collection for
+// the domain, with one file per object type.
+func SharpHoundZip(domain string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	stamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Format("20060102150405")
+
+	for _, kind := range []string{"users", "computers", "groups", "domains", "gpos", "ous", "containers"} {
+		f, err := w.Create(fmt.Sprintf("%s_%s.json", stamp, kind))
+		if err != nil {
+			panic(err)
+		}
+
+		data, count := `[]`, 0
+		if kind == "domains" {
+			data = fmt.Sprintf(`[{"ObjectIdentifier":"S-1-5-21-1004336348-1177238915-682003330","Properties":{"name":%q,"domain":%q}}]`, domain, domain)
+			count = 1
+		}
+
+		fmt.Fprintf(f, `{"data":%s,"meta":{"methods":46067,"type":%q,"count":%d,"version":5}}`, data, kind, count)
+	}
+
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Locker is held while a run uses something that only one run can use at a
+// time, across every worker process.
+type Locker interface {
+	// Lock waits until the lock is free and takes it.
+	Lock(ctx context.Context) error
+
+	// Unlock releases the lock, if this process holds it.
+	Unlock(ctx context.Context) error
+}
+
+var (
+	// renewLockScript extends the lock only if it is still ours.
+	renewLockScript = redis.NewScript(`
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		end
+		return 0`)
+
+	// releaseLockScript deletes the lock only if it is still ours, so that
+	// a lock that expired and was taken by another worker isn't released.
+	releaseLockScript = redis.NewScript(`
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("DEL", KEYS[1])
+		end
+		return 0`)
+)
+
+// RedisLock is a Locker shared through Redis. It is a lease that is renewed
+// while held, so a lock held by a worker that dies is freed once its TTL
+// runs out rather than blocking every later run.
+type RedisLock struct {
+	client        *redis.Client
+	key           string
+	ttl           time.Duration
+	retryInterval time.Duration
+	logger        *slog.Logger
+
+	mu    sync.Mutex
+	token string
+	stop  chan struct{}
+}
+
+func NewRedisLock(client *redis.Client, key string, ttl, retryInterval time.Duration, logger *slog.Logger) *RedisLock {
+	return &RedisLock{
+		client:        client,
+		key:           key,
+		ttl:           ttl,
+		retryInterval: retryInterval,
+		logger:        logger,
+	}
+}
+
+func (l *RedisLock) Lock(ctx context.Context) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	waiting := false
+
+	for {
+		acquired, err := l.client.SetNX(ctx, l.key, token, l.ttl).Result()
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			break
+		}
+
+		if !waiting {
+			l.logger.InfoContext(ctx, "waiting for another run to release its lock", "key", l.key)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.retryInterval):
+		}
+	}
+
+	stop := make(chan struct{})
+
+	l.mu.Lock()
+	l.token = token
+	l.stop = stop
+	l.mu.Unlock()
+
+	go l.renew(token, stop)
+
+	return nil
+}
+
+// renew extends the lease until the lock is released.
+func (l *RedisLock) renew(token string, stop chan struct{}) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		renewed, err := renewLockScript.Run(ctx, l.client, []string{l.key}, token, l.ttl.Milliseconds()).Int()
+		cancel()
+
+		switch {
+		case err != nil:
+			l.logger.Warn("failed to renew lock", "key", l.key, "error", err)
+		case renewed == 0:
+			l.logger.Error("lock expired while held, another run may use it concurrently", "key", l.key)
+			return
+		}
+	}
+}
+
+func (l *RedisLock) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	token, stop := l.token, l.stop
+	l.token, l.stop = "", nil
+	l.mu.Unlock()
+
+	if token == "" {
+		return nil
+	}
+
+	close(stop)
+
+	return releaseLockScript.Run(ctx, l.client, []string{l.key}, token).Err()
+}
@@ -1,71 +1,296 @@
 package services
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"com.activehacks.ad-miner-backend/internal/env"
 )
 
-type S3Service struct{}
+// Storage moves a run's input and reports between the bucket and the
+// organization's working directory.
+type Storage interface {
+	// DownloadFile copies bucketPath/filename into orgName's working
+	// directory.
+	DownloadFile(ctx context.Context, orgName, bucketPath, filename string) error
 
-func NewS3Service() *S3Service {
-	return &S3Service{}
+	// UploadResults uploads orgName's rendered report to
+	// bucketPath/extracted/.
+	UploadResults(ctx context.Context, bucketPath, orgName string) error
+
+	// FetchFile copies the object at s3Path to filename in orgName's working
+	// directory.
+	FetchFile(ctx context.Context, orgName, s3Path, filename string) error
+
+	// CopyFile copies the object at src to dst within storage.
+	CopyFile(ctx context.Context, src, dst string) error
+
+	// DeleteFile deletes bucketPath/filename.
+	DeleteFile(ctx context.Context, bucketPath, filename string) error
+
+	// DeleteDirectory deletes everything under bucketPath/dir/, or under
+	// bucketPath/ if dir is empty.
+	DeleteDirectory(ctx context.Context, bucketPath, dir string) error
+
+	// Cleanup removes filename from orgName's working directory.
+	Cleanup(ctx context.Context, orgName, filename string) error
+}
+
+// EvolutionArchivePath returns where a result's AD-miner data file is
+// archived for later runs' evolution view. Each result has a directory of
+// its own, since scheduled runs share a results path.
+func EvolutionArchivePath(resultID int, filename string) string {
+	prefix := env.GetString("S3_EVOLUTION_PREFIX", "s3://active-hacks/simulations/active_directory/evolution")
+	return fmt.Sprintf("%s/%d/%s", prefix, resultID, filename)
+}
+
+// SplitStoragePath splits a storage path into the bucket path and file name
+// that DeleteFile takes. Unlike path.Dir, it leaves the "//" after the scheme
+// alone.
+func SplitStoragePath(storagePath string) (bucketPath, filename string) {
+	i := strings.LastIndex(storagePath, "/")
+	if i < 0 {
+		return "", storagePath
+	}
+
+	return storagePath[:i], storagePath[i+1:]
 }
 
-func (s *S3Service) DownloadFile(orgName, bucketPath, filename string) error {
+type S3Service struct {
+	logger *slog.Logger
+}
+
+func NewS3Service(logger *slog.Logger) *S3Service {
+	return &S3Service{
+		logger: logger,
+	}
+}
+
+func (s *S3Service) DownloadFile(ctx context.Context, orgName, bucketPath, filename string) error {
 	// Download file from S3
 	s3Path := fmt.Sprintf("%s/%s", bucketPath, filename)
 
 	localPath := fmt.Sprintf("%s/%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName, filename)
-	cmd := exec.Command("aws", "s3", "cp", s3Path, localPath)
+	cmd := exec.CommandContext(ctx, "aws", "s3", "cp", s3Path, localPath)
 
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to download %s: %v, output: %s", filename, err, output)
+		err = fmt.Errorf("failed to download %s: %v, output: %s", filename, err, output)
+		if isS3NotFound(output) {
+			return permanentError(CodeInputNotFound, err)
+		}
+		return transientError(CodeStorageUnavailable, err)
+	}
+
+	s.logger.InfoContext(ctx, "downloaded file from s3", "source", s3Path, "destination", localPath)
+
+	if strings.HasSuffix(filename, ".zip") {
+		err = checkZip(localPath)
+		if err != nil {
+			return permanentError(CodeInvalidInput, fmt.Errorf("%s is not a valid zip archive: %v", filename, err))
+		}
 	}
 
-	log.Printf("Downloaded to %s from %s", localPath, s3Path)
 	return nil
 }
 
-func (s *S3Service) UploadResults(bucketPath, orgName string) error {
+func (s *S3Service) UploadResults(ctx context.Context, bucketPath, orgName string) error {
 	// Rename render_{org_name} to extracted
 	localPath := fmt.Sprintf("%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName)
 	oldDir := fmt.Sprintf("%s/%s", localPath, fmt.Sprintf("render_%s", orgName))
 	newDir := fmt.Sprintf("%s/extracted", localPath)
 
-	cmd := exec.Command("mv", oldDir, newDir)
+	cmd := exec.CommandContext(ctx, "mv", oldDir, newDir)
 	cmd.Dir = localPath
 
-	output, err := cmd.CombinedOutput()
+	output, err := runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to rename %s: %v, output: %s", oldDir, err, output)
+		return transientError(CodeUploadFailed, fmt.Errorf("failed to rename %s: %v, output: %s", oldDir, err, output))
 	}
 
 	// Upload to S3
 	s3Path := fmt.Sprintf("%s/extracted/", bucketPath)
-	cmd = exec.Command("aws", "s3", "sync", newDir, s3Path, "--delete")
+	cmd = exec.CommandContext(ctx, "aws", "s3", "sync", newDir, s3Path, "--delete")
 
-	output, err = cmd.CombinedOutput()
+	output, err = runCommand(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("failed to upload results: %v, output: %s", err, output)
+		return transientError(CodeUploadFailed, fmt.Errorf("failed to upload results: %v, output: %s", err, output))
 	}
 
-	log.Printf("Uploaded results to %s", s3Path)
+	s.logger.InfoContext(ctx, "uploaded results to s3", "destination", s3Path)
 	return nil
 }
 
-// NOTE: Not used as of right now since this does not affect future execution
-func (s *S3Service) Cleanup(orgName, filename string) error {
+func (s *S3Service) FetchFile(ctx context.Context, orgName, s3Path, filename string) error {
 	localPath := fmt.Sprintf("%s/%s/%s", env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound"), orgName, filename)
-	cmd := exec.Command("rm", "-rf", localPath)
+	cmd := exec.CommandContext(ctx, "aws", "s3", "cp", s3Path, localPath)
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		err = fmt.Errorf("failed to download %s: %v, output: %s", s3Path, err, output)
+		if isS3NotFound(output) {
+			return permanentError(CodeInputNotFound, err)
+		}
+		return transientError(CodeStorageUnavailable, err)
+	}
+
+	s.logger.InfoContext(ctx, "downloaded file from s3", "source", s3Path, "destination", localPath)
+	return nil
+}
+
+func (s *S3Service) CopyFile(ctx context.Context, src, dst string) error {
+	cmd := exec.CommandContext(ctx, "aws", "s3", "cp", src, dst)
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		return transientError(CodeStorageUnavailable, fmt.Errorf("failed to copy %s to %s: %v, output: %s", src, dst, err, output))
+	}
+
+	s.logger.InfoContext(ctx, "copied file in s3", "source", src, "destination", dst)
+	return nil
+}
+
+// FileETag returns the ETag of bucketPath/filename, which changes whenever
+// the object is replaced. found is false if the object doesn't exist.
+func (s *S3Service) FileETag(ctx context.Context, bucketPath, filename string) (etag string, found bool, err error) {
+	bucket, prefix, ok := strings.Cut(strings.TrimPrefix(bucketPath, "s3://"), "/")
+	if !ok || bucket == "" {
+		return "", false, fmt.Errorf("invalid s3 path %q", bucketPath)
+	}
+
+	key := strings.TrimSuffix(prefix, "/") + "/" + filename
+	cmd := exec.CommandContext(ctx, "aws", "s3api", "head-object", "--bucket", bucket, "--key", key, "--query", "ETag", "--output", "text")
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		if isS3NotFound(output) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to stat %s: %v, output: %s", key, err, output)
+	}
+
+	return strings.TrimSpace(string(output)), true, nil
+}
+
+// DeleteFile deletes bucketPath/filename. Deleting an object that doesn't
+// exist succeeds.
+func (s *S3Service) DeleteFile(ctx context.Context, bucketPath, filename string) error {
+	s3Path := fmt.Sprintf("%s/%s", bucketPath, filename)
+	cmd := exec.CommandContext(ctx, "aws", "s3", "rm", s3Path)
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		return transientError(CodeStorageUnavailable, fmt.Errorf("failed to delete %s: %v, output: %s", s3Path, err, output))
+	}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	s.logger.InfoContext(ctx, "deleted file from s3", "path", s3Path)
+	return nil
+}
+
+// DeleteDirectory deletes everything under bucketPath/dir, or under
+// bucketPath itself if dir is empty.
+func (s *S3Service) DeleteDirectory(ctx context.Context, bucketPath, dir string) error {
+	s3Path := strings.TrimSuffix(bucketPath, "/") + "/"
+	if dir != "" {
+		s3Path = fmt.Sprintf("%s%s/", s3Path, dir)
+	}
+	cmd := exec.CommandContext(ctx, "aws", "s3", "rm", s3Path, "--recursive")
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		return transientError(CodeStorageUnavailable, fmt.Errorf("failed to delete %s: %v, output: %s", s3Path, err, output))
+	}
+
+	s.logger.InfoContext(ctx, "deleted directory from s3", "path", s3Path)
+	return nil
+}
+
+// Cleanup removes filename from the organization's local working directory.
+func (s *S3Service) Cleanup(ctx context.Context, orgName, filename string) error {
+	localPath, err := localWorkPath(orgName, filename)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "rm", "-rf", localPath)
+
+	if output, err := runCommand(ctx, cmd); err != nil {
 		return fmt.Errorf("failed to cleanup: %v, output: %s", err, output)
 	}
 
-	log.Printf("Cleaned up s3 artifacts")
+	s.logger.InfoContext(ctx, "cleaned up s3 artifacts", "path", localPath)
+	return nil
+}
+
+// Check verifies that the AWS CLI is installed and the results bucket can be
+// listed with the credentials available to it.
+func (s *S3Service) Check(ctx context.Context) error {
+	if _, err := exec.LookPath("aws"); err != nil {
+		return errors.New("aws not found in PATH")
+	}
+
+	prefix := env.GetString("S3_BUCKET_PREFIX", "s3://active-hacks/simulations/active_directory/results")
+	cmd := exec.CommandContext(ctx, "aws", "s3", "ls", prefix+"/")
+
+	output, err := runCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %v, output: %s", prefix, err, output)
+	}
+
+	return nil
+}
+
+// CheckFreeSpace reports an error if the filesystem holding downloads has
+// less than minFree bytes available. The download directory is created on
+// demand, so the check falls back to the nearest existing parent.
+func (s *S3Service) CheckFreeSpace(ctx context.Context, minFree uint64) error {
+	path := env.GetString("S3_DOWNLOAD_LOCATION", "/tmp/activehacks/bloodhound")
+
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return fmt.Errorf("failed to stat filesystem at %s: %v", path, err)
+	}
+
+	free := stat.Bavail * uint64(stat.Bsize)
+	if free < minFree {
+		return fmt.Errorf("%d MB free under %s, need at least %d MB", free>>20, path, minFree>>20)
+	}
+
+	return nil
+}
+
+// isS3NotFound reports whether the output of a failed aws command says the
+// object doesn't exist. The CLI has no distinct exit code for this.
+func isS3NotFound(output []byte) bool {
+	return bytes.Contains(output, []byte("(404)")) || bytes.Contains(output, []byte("(NoSuchKey)"))
+}
+
+func checkZip(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if len(r.File) == 0 {
+		return errors.New("archive is empty")
+	}
+
 	return nil
 }
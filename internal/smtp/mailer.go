@@ -6,6 +6,7 @@ import (
 
 	"com.activehacks.ad-miner-backend/assets"
 	"com.activehacks.ad-miner-backend/internal/funcs"
+	"com.activehacks.ad-miner-backend/internal/metrics"
 
 	"github.com/wneessen/go-mail"
 
@@ -90,7 +91,7 @@ func (m *Mailer) Send(recipient string, data any, patterns ...string) error {
 		err = m.client.DialAndSend(msg)
 
 		if nil == err {
-			return nil
+			break
 		}
 
 		if i != 3 {
@@ -98,5 +99,6 @@ func (m *Mailer) Send(recipient string, data any, patterns ...string) error {
 		}
 	}
 
+	metrics.MailSends.WithLabelValues(metrics.Outcome(err)).Inc()
 	return err
 }
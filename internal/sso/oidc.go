@@ -0,0 +1,281 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+const discoveryTimeout = 10 * time.Second
+
+// AuthRequestTTL is how long a login started by AuthCodeURL can be completed.
+const AuthRequestTTL = 10 * time.Minute
+
+var (
+	ErrUnknownState   = errors.New("sso: unknown or expired state")
+	ErrNoMatchingRole = errors.New("sso: identity is not a member of any permitted group")
+	ErrEmailMissing   = errors.New("sso: ID token has no verified email claim")
+)
+
+// requestStore keeps login requests between AuthCodeURL and Exchange. GetDel
+// deletes the request, returning redis.Nil if there is none.
+type requestStore interface {
+	Set(ctx context.Context, state string, value []byte, ttl time.Duration) error
+	GetDel(ctx context.Context, state string) ([]byte, error)
+	Close() error
+}
+
+type redisStore struct {
+	client *redis.Client
+}
+
+func (s redisStore) Set(ctx context.Context, state string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, stateKey(state), value, ttl).Err()
+}
+
+func (s redisStore) GetDel(ctx context.Context, state string) ([]byte, error) {
+	return s.client.GetDel(ctx, stateKey(state)).Bytes()
+}
+
+func (s redisStore) Close() error {
+	return s.client.Close()
+}
+
+type Provider struct {
+	requests        requestStore
+	verifier        *oidc.IDTokenVerifier
+	oauth2Config    oauth2.Config
+	groupsClaim     string
+	adminGroups     []string
+	analystGroups   []string
+	requireVerified bool
+}
+
+// Identity is the subset of ID token claims used to log in or provision a
+// user. Role is derived from the group claim.
+type Identity struct {
+	Subject string
+	Email   string
+	Groups  []string
+	Role    string
+}
+
+type authRequest struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewProvider performs OIDC discovery against issuerURL. Members of
+// adminGroups are mapped to the admin role and members of analystGroups to
+// the analyst role. If analystGroups is empty every other authenticated
+// identity is treated as an analyst.
+func NewProvider(redisAddr, redisPassword, issuerURL, clientID, clientSecret, redirectURL, groupsClaim string, adminGroups, analystGroups []string, requireVerifiedEmail bool) (*Provider, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddr,
+		Password: redisPassword,
+	})
+
+	p, err := newProvider(redisStore{client: client}, issuerURL, clientID, clientSecret, redirectURL, groupsClaim, adminGroups, analystGroups, requireVerifiedEmail)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func newProvider(requests requestStore, issuerURL, clientID, clientSecret, redirectURL, groupsClaim string, adminGroups, analystGroups []string, requireVerifiedEmail bool) (*Provider, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("sso: discovery failed: %w", err)
+	}
+
+	p := &Provider{
+		requests: requests,
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		groupsClaim:     groupsClaim,
+		adminGroups:     adminGroups,
+		analystGroups:   analystGroups,
+		requireVerified: requireVerifiedEmail,
+	}
+
+	return p, nil
+}
+
+func (p *Provider) Close() error {
+	return p.requests.Close()
+}
+
+// AuthCodeURL starts an authorization-code flow with PKCE and returns the URL
+// to send the browser to along with the flow's state. The state, nonce and
+// code verifier are kept in Redis until the callback consumes them. The
+// caller should also bind the state to the browser, so that a callback
+// carrying someone else's state is rejected.
+func (p *Provider) AuthCodeURL(ctx context.Context) (string, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	req := authRequest{
+		Verifier: oauth2.GenerateVerifier(),
+	}
+
+	req.Nonce, err = randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	js, err := json.Marshal(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = p.requests.Set(ctx, state, js, AuthRequestTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	url := p.oauth2Config.AuthCodeURL(state, oidc.Nonce(req.Nonce), oauth2.S256ChallengeOption(req.Verifier))
+	return url, state, nil
+}
+
+// Exchange completes the flow started by AuthCodeURL. Each state can only be
+// used once. With ErrNoMatchingRole it also returns the identity, so that the
+// refused login can be recorded.
+func (p *Provider) Exchange(ctx context.Context, state, code string) (Identity, error) {
+	js, err := p.requests.GetDel(ctx, state)
+	if errors.Is(err, redis.Nil) {
+		return Identity{}, ErrUnknownState
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var req authRequest
+
+	err = json.Unmarshal(js, &req)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	token, err := p.oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(req.Verifier))
+	if err != nil {
+		return Identity{}, fmt.Errorf("sso: code exchange failed: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("sso: token response has no id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Identity{}, fmt.Errorf("sso: invalid ID token: %w", err)
+	}
+
+	if idToken.Nonce != req.Nonce {
+		return Identity{}, errors.New("sso: ID token nonce mismatch")
+	}
+
+	var claims map[string]any
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{
+		Subject: idToken.Subject,
+		Groups:  stringSlice(claims[p.groupsClaim]),
+	}
+
+	identity.Email, _ = claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	if identity.Email == "" || (p.requireVerified && !emailVerified) {
+		return Identity{}, ErrEmailMissing
+	}
+
+	identity.Role, ok = p.role(identity.Groups)
+	if !ok {
+		return identity, ErrNoMatchingRole
+	}
+
+	return identity, nil
+}
+
+func (p *Provider) role(groups []string) (string, bool) {
+	for _, group := range groups {
+		if slices.Contains(p.adminGroups, group) {
+			return database.RoleAdmin, true
+		}
+	}
+
+	if len(p.analystGroups) == 0 {
+		return database.RoleAnalyst, true
+	}
+
+	for _, group := range groups {
+		if slices.Contains(p.analystGroups, group) {
+			return database.RoleAnalyst, true
+		}
+	}
+
+	return "", false
+}
+
+// stringSlice accepts a claim that is either a single string or an array of
+// strings, as IdPs differ in how they encode group membership.
+func stringSlice(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func stateKey(state string) string {
+	return "oidc:state:" + state
+}
@@ -0,0 +1,346 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"com.activehacks.ad-miner-backend/internal/database"
+
+	"github.com/pascaldekloe/jwt"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testClientID = "ad-miner-backend"
+	testCode     = "test-code"
+)
+
+// memoryStore keeps login requests in memory in place of Redis.
+type memoryStore struct {
+	mu       sync.Mutex
+	requests map[string][]byte
+}
+
+func (s *memoryStore) Set(ctx context.Context, state string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[state] = value
+	return nil
+}
+
+func (s *memoryStore) GetDel(ctx context.Context, state string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.requests[state]
+	if !ok {
+		return nil, redis.Nil
+	}
+
+	delete(s.requests, state)
+	return value, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// mockIdP is an OIDC provider that issues an ID token with the configured
+// claims for testCode.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	claims   map[string]any
+	verifier string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", idp.token)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("code") != testCode {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idp.mu.Lock()
+	idp.verifier = r.PostFormValue("code_verifier")
+	set := map[string]any{}
+	for name, value := range idp.claims {
+		set[name] = value
+	}
+	idp.mu.Unlock()
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Registered: jwt.Registered{
+			Issuer:    idp.URL,
+			Audiences: []string{testClientID},
+			Issued:    jwt.NewNumericTime(now),
+			Expires:   jwt.NewNumericTime(now.Add(time.Hour)),
+		},
+		Set:   set,
+		KeyID: "test",
+	}
+
+	idToken, err := claims.RSASign(jwt.RS256, idp.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     string(idToken),
+	})
+}
+
+func (idp *mockIdP) setClaims(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newTestProvider(t *testing.T, idp *mockIdP, analystGroups []string) *Provider {
+	t.Helper()
+
+	p, err := newProvider(&memoryStore{requests: map[string][]byte{}}, idp.URL, testClientID, "secret", "http://localhost/oidc/callback", "groups", []string{"admins"}, analystGroups, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// startLogin starts a login and returns its state and the parameters sent to
+// the identity provider.
+func startLogin(t *testing.T, p *Provider) (string, url.Values) {
+	t.Helper()
+
+	authURL, state, err := p.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := u.Query()
+	if params.Get("state") != state {
+		t.Fatalf("state = %q, want %q", params.Get("state"), state)
+	}
+
+	return state, params
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdP(t)
+
+	tests := []struct {
+		name          string
+		analystGroups []string
+		claims        map[string]any
+		wantRole      string
+		wantErr       error
+	}{
+		{
+			name:     "admin",
+			claims:   map[string]any{"groups": []string{"staff", "admins"}},
+			wantRole: database.RoleAdmin,
+		},
+		{
+			name:          "analyst",
+			analystGroups: []string{"analysts"},
+			claims:        map[string]any{"groups": []string{"analysts"}},
+			wantRole:      database.RoleAnalyst,
+		},
+		{
+			name:          "single group claim",
+			analystGroups: []string{"analysts"},
+			claims:        map[string]any{"groups": "analysts"},
+			wantRole:      database.RoleAnalyst,
+		},
+		{
+			name:     "any group is an analyst",
+			claims:   map[string]any{},
+			wantRole: database.RoleAnalyst,
+		},
+		{
+			name:          "no matching group",
+			analystGroups: []string{"analysts"},
+			claims:        map[string]any{"groups": []string{"staff"}},
+			wantErr:       ErrNoMatchingRole,
+		},
+		{
+			name:    "unverified email",
+			claims:  map[string]any{"email_verified": false},
+			wantErr: ErrEmailMissing,
+		},
+		{
+			name:    "no email",
+			claims:  map[string]any{"email": ""},
+			wantErr: ErrEmailMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProvider(t, idp, tt.analystGroups)
+			state, params := startLogin(t, p)
+
+			claims := map[string]any{
+				"sub":            "user-1",
+				"nonce":          params.Get("nonce"),
+				"email":          "alice@example.test",
+				"email_verified": true,
+			}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+			idp.setClaims(claims)
+
+			identity, err := p.Exchange(context.Background(), state, testCode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+
+			// A refused login still identifies who was refused.
+			if errors.Is(err, ErrNoMatchingRole) && identity.Email != "alice@example.test" {
+				t.Errorf("email = %q, want alice@example.test", identity.Email)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if identity.Subject != "user-1" || identity.Email != "alice@example.test" || identity.Role != tt.wantRole {
+				t.Errorf("identity = %+v, want subject user-1, email alice@example.test, role %s", identity, tt.wantRole)
+			}
+
+			challenge := sha256.Sum256([]byte(idp.verifier))
+			if base64.RawURLEncoding.EncodeToString(challenge[:]) != params.Get("code_challenge") {
+				t.Error("code verifier doesn't match the code challenge")
+			}
+		})
+	}
+}
+
+func TestExchangeState(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp, nil)
+
+	state, params := startLogin(t, p)
+	idp.setClaims(map[string]any{
+		"sub":            "user-1",
+		"nonce":          params.Get("nonce"),
+		"email":          "alice@example.test",
+		"email_verified": true,
+	})
+
+	_, err := p.Exchange(context.Background(), state, testCode)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = p.Exchange(context.Background(), state, testCode)
+	if !errors.Is(err, ErrUnknownState) {
+		t.Errorf("reused state: error = %v, want %v", err, ErrUnknownState)
+	}
+
+	_, err = p.Exchange(context.Background(), "unknown", testCode)
+	if !errors.Is(err, ErrUnknownState) {
+		t.Errorf("unknown state: error = %v, want %v", err, ErrUnknownState)
+	}
+}
+
+func TestExchangeNonceMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp, nil)
+
+	state, _ := startLogin(t, p)
+	idp.setClaims(map[string]any{
+		"sub":            "user-1",
+		"nonce":          "another login's nonce",
+		"email":          "alice@example.test",
+		"email_verified": true,
+	})
+
+	_, err := p.Exchange(context.Background(), state, testCode)
+	if err == nil {
+		t.Fatal("expected an error for a mismatched nonce")
+	}
+}
+
+func TestExchangeInvalidCode(t *testing.T) {
+	idp := newMockIdP(t)
+	p := newTestProvider(t, idp, nil)
+
+	state, _ := startLogin(t, p)
+
+	_, err := p.Exchange(context.Background(), state, "wrong-code")
+	if err == nil {
+		t.Fatal("expected an error for an invalid code")
+	}
+}